@@ -18,15 +18,22 @@ package main
 
 import (
 	goflag "flag"
+	"fmt"
 	"os"
 	"time"
 
 	"github.com/go-logr/glogr"
 	"github.com/pusher/wave/pkg/apis"
 	"github.com/pusher/wave/pkg/controller"
+	"github.com/pusher/wave/pkg/controller/generic"
+	"github.com/pusher/wave/pkg/controller/stalepods"
+	"github.com/pusher/wave/pkg/core"
 	"github.com/pusher/wave/pkg/webhook"
+	"github.com/pusher/wave/pkg/webhook/certs"
 	flag "github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/types"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
@@ -34,10 +41,31 @@ import (
 )
 
 var (
-	leaderElection          = flag.Bool("leader-election", false, "Should the controller use leader election")
-	leaderElectionID        = flag.String("leader-election-id", "", "Name of the configmap used by the leader election system")
-	leaderElectionNamespace = flag.String("leader-election-namespace", "", "Namespace for the configmap used by the leader election system")
-	syncPeriod              = flag.Duration("sync-period", 5*time.Minute, "Reconcile sync period")
+	leaderElection             = flag.Bool("leader-election", false, "Should the controller use leader election")
+	leaderElectionID           = flag.String("leader-election-id", "", "Name of the configmap used by the leader election system")
+	leaderElectionNamespace    = flag.String("leader-election-namespace", "", "Namespace for the configmap used by the leader election system")
+	syncPeriod                 = flag.Duration("sync-period", 5*time.Minute, "Reconcile sync period")
+	metricsAddr                = flag.String("metrics-addr", ":8080", "Address the Prometheus metrics endpoint binds to, or 0 to disable it")
+	workloads                  = flag.StringArray("workload", []string{}, "Custom resource to manage, in the form <group>/<version>/<Kind>=<path.to.pod.template> (may be repeated)")
+	workloadConfig             = flag.String("workload-config", "", "Path to a YAML file listing custom resources to manage")
+	digestCache                = flag.Bool("digest-cache", false, "Cache digests of ConfigMap and Secret values instead of their contents (requires --tracking-mode=index)")
+	trackingMode               = flag.String("tracking-mode", string(core.OwnerReferencesTracking), "How referenced ConfigMaps and Secrets are tracked, either \"owner-references\" or \"index\"")
+	hashKeyFile                = flag.String("hash-key-file", "", "Path to a key used to calculate configuration hashes with HMAC-SHA256")
+	previousHashKeyFile        = flag.String("previous-hash-key-file", "", "Path to the hash key being rotated out (requires --hash-key-file)")
+	configDigestsKeySecretName = flag.String("config-digests-key-secret-name", "wave-config-digests-key", "Name of the Secret Wave stores the key used to digest configuration values for change summaries in")
+	configDigestsKeyNamespace  = flag.String("config-digests-key-namespace", os.Getenv("POD_NAMESPACE"), "Namespace of the config digests key Secret, or empty to generate a new key each time Wave starts")
+	configMapValueDiffs        = flag.Bool("configmap-value-diffs", false, "Show how ConfigMap values changed in ConfigChanged Events, recording them in an annotation on each instance")
+	stalePods                  = flag.Bool("stale-pods", false, "Watch the Pods of managed Deployments, StatefulSets and DaemonSets and report those running a stale configuration")
+	stalePodsThreshold         = flag.Duration("stale-pods-threshold", 10*time.Minute, "How long Pods may run a stale configuration before an Event is recorded, or 0 to record no Events")
+	enableWebhooks             = flag.Bool("enable-webhooks", false, "Serve the admission webhooks, which are also needed to attribute configuration changes to the user who made them (best effort)")
+	validationMode             = flag.String("validation-mode", string(core.DenyValidation), "How the validating webhook handles missing required ConfigMaps and Secrets, either \"deny\" or \"warn\"")
+	serviceAccount             = flag.String("service-account", defaultServiceAccount(), "Username of the service account Wave runs as, whose updates the validating webhook doesn't check")
+	webhookPort                = flag.Int("webhook-port", 9876, "Port the admission webhooks are served on")
+	webhookCertDir             = flag.String("webhook-cert-dir", "/tmp/cert", "Directory containing the tls.crt and tls.key for the admission webhooks")
+	webhookManageCerts         = flag.Bool("webhook-manage-certs", false, "Generate and rotate the admission webhook certificates (requires a writable --webhook-cert-dir)")
+	webhookNamespace           = flag.String("webhook-namespace", os.Getenv("POD_NAMESPACE"), "Namespace of the admission webhook Service and Secret")
+	webhookServiceName         = flag.String("webhook-service-name", "wave-controller-manager-service", "Name of the Service fronting the admission webhooks")
+	webhookSecretName          = flag.String("webhook-secret-name", os.Getenv("SECRET_NAME"), "Name of the Secret the admission webhook certificates are stored in")
 )
 
 func main() {
@@ -64,6 +92,7 @@ func main() {
 		LeaderElectionID:        *leaderElectionID,
 		LeaderElectionNamespace: *leaderElectionNamespace,
 		SyncPeriod:              syncPeriod,
+		MetricsBindAddress:      *metricsAddr,
 	})
 	if err != nil {
 		log.Error(err, "unable to set up overall controller manager")
@@ -79,6 +108,70 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Configure how the controllers track ConfigMaps and Secrets
+	mode, err := core.ParseTrackingMode(*trackingMode)
+	if err != nil {
+		log.Error(err, "invalid tracking mode")
+		os.Exit(1)
+	}
+	core.DefaultOptions.TrackingMode = mode
+
+	validation, err := core.ParseValidationMode(*validationMode)
+	if err != nil {
+		log.Error(err, "invalid validation mode")
+		os.Exit(1)
+	}
+	core.DefaultOptions.ValidationMode = validation
+	core.DefaultOptions.ServiceAccount = *serviceAccount
+	core.DefaultOptions.StalePodsThreshold = *stalePodsThreshold
+	core.DefaultOptions.ConfigMapValueDiffs = *configMapValueDiffs
+
+	if *digestCache {
+		log.Info("setting up digest cache")
+		digests, err := core.NewDigestCache(cfg, *syncPeriod)
+		if err != nil {
+			log.Error(err, "unable to set up digest cache")
+			os.Exit(1)
+		}
+		if err := mgr.Add(digests); err != nil {
+			log.Error(err, "unable to add digest cache to the manager")
+			os.Exit(1)
+		}
+		core.DefaultOptions.DigestCache = digests
+	}
+
+	if *hashKeyFile != "" {
+		key, err := core.LoadHashKey(*hashKeyFile)
+		if err != nil {
+			log.Error(err, "unable to load hash key")
+			os.Exit(1)
+		}
+		core.DefaultOptions.HashKey = key
+	}
+	if *previousHashKeyFile != "" {
+		key, err := core.LoadHashKey(*previousHashKeyFile)
+		if err != nil {
+			log.Error(err, "unable to load previous hash key")
+			os.Exit(1)
+		}
+		core.DefaultOptions.PreviousHashKey = key
+	}
+
+	if *configDigestsKeyNamespace != "" {
+		log.Info("setting up config digests key")
+		key, err := ensureConfigDigestsKey(mgr)
+		if err != nil {
+			log.Error(err, "unable to set up config digests key")
+			os.Exit(1)
+		}
+		core.DefaultOptions.ConfigDigestsKey = key
+	}
+
+	if err := core.DefaultOptions.Validate(); err != nil {
+		log.Error(err, "invalid options")
+		os.Exit(1)
+	}
+
 	// Setup all Controllers
 	log.Info("Setting up controller")
 	if err := controller.AddToManager(mgr); err != nil {
@@ -86,16 +179,142 @@ func main() {
 		os.Exit(1)
 	}
 
-	log.Info("setting up webhooks")
-	if err := webhook.AddToManager(mgr); err != nil {
-		log.Error(err, "unable to register webhooks to the manager")
+	log.Info("setting up workload controllers")
+	if err := addWorkloads(mgr); err != nil {
+		log.Error(err, "unable to register workload controllers to the manager")
 		os.Exit(1)
 	}
 
+	stop := signals.SetupSignalHandler()
+
+	if *stalePods {
+		log.Info("setting up stale pods controllers")
+		if err := stalepods.Add(mgr); err != nil {
+			log.Error(err, "unable to register stale pods controllers to the manager")
+			os.Exit(1)
+		}
+	}
+
+	managerStop, rotated := stop, make(chan struct{})
+	if *enableWebhooks && *webhookManageCerts {
+		log.Info("setting up webhook certificates")
+		rotator, err := newCertRotator(mgr)
+		if err != nil {
+			log.Error(err, "unable to set up webhook certificates")
+			os.Exit(1)
+		}
+		managerStop = stopOnRotation(rotator, stop, rotated)
+	}
+
+	if *enableWebhooks {
+		log.Info("setting up webhooks")
+		if err := webhook.AddToManager(mgr, webhook.Options{Port: *webhookPort, CertDir: *webhookCertDir}); err != nil {
+			log.Error(err, "unable to register webhooks to the manager")
+			os.Exit(1)
+		}
+	}
+
 	// Start the Cmd
 	log.Info("Starting the Cmd.")
-	if err := mgr.Start(signals.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(managerStop); err != nil {
 		log.Error(err, "unable to run the manager")
 		os.Exit(1)
 	}
+	select {
+	case <-rotated:
+		log.Info("webhook serving certificate rotated, exiting to serve the new certificate")
+	default:
+	}
+}
+
+// addWorkloads adds a generic controller to the manager for each custom
+// workload configured by flags
+func addWorkloads(mgr manager.Manager) error {
+	configured := []generic.Workload{}
+	if *workloadConfig != "" {
+		loaded, err := generic.LoadWorkloads(*workloadConfig)
+		if err != nil {
+			return err
+		}
+		configured = append(configured, loaded...)
+	}
+	for _, value := range *workloads {
+		workload, err := generic.ParseWorkload(value)
+		if err != nil {
+			return err
+		}
+		configured = append(configured, workload)
+	}
+
+	log := logf.Log.WithName("entrypoint")
+	for _, workload := range configured {
+		log.Info("adding workload controller", "workload", workload.String())
+		if err := generic.Add(mgr, workload); err != nil {
+			return fmt.Errorf("error adding controller for %s: %v", workload, err)
+		}
+	}
+	return nil
+}
+
+// newCertRotator ensures the webhook certificates exist before the webhook
+// server is started and returns a Rotator to keep them from expiring
+func newCertRotator(mgr manager.Manager) (*certs.Rotator, error) {
+	if *webhookNamespace == "" || *webhookSecretName == "" {
+		return nil, fmt.Errorf("--webhook-namespace and --webhook-secret-name must be set")
+	}
+
+	// The manager's cache has not been started yet so read directly from the
+	// API server
+	c, err := client.New(mgr.GetConfig(), client.Options{Scheme: mgr.GetScheme()})
+	if err != nil {
+		return nil, fmt.Errorf("error creating client: %v", err)
+	}
+
+	rotator := &certs.Rotator{
+		Client:  c,
+		Secret:  types.NamespacedName{Name: *webhookSecretName, Namespace: *webhookNamespace},
+		Service: types.NamespacedName{Name: *webhookServiceName, Namespace: *webhookNamespace},
+		CertDir: *webhookCertDir,
+	}
+	if err := rotator.Ensure(); err != nil {
+		return nil, err
+	}
+	return rotator, nil
+}
+
+// ensureConfigDigestsKey reads the config digests key from its Secret,
+// generating it if this is the first time Wave has started
+func ensureConfigDigestsKey(mgr manager.Manager) ([]byte, error) {
+	// The manager's cache has not been started yet so read directly from the
+	// API server
+	c, err := client.New(mgr.GetConfig(), client.Options{Scheme: mgr.GetScheme()})
+	if err != nil {
+		return nil, fmt.Errorf("error creating client: %v", err)
+	}
+	return core.EnsureConfigDigestsKey(c, types.NamespacedName{Name: *configDigestsKeySecretName, Namespace: *configDigestsKeyNamespace})
+}
+
+// stopOnRotation runs the Rotator and returns a channel that is closed when
+// stop is closed or once the serving certificate has been rotated, so that the
+// manager stops cleanly and Kubernetes restarts Wave to serve the new
+// certificate. rotated is closed first in the latter case.
+func stopOnRotation(rotator *certs.Rotator, stop <-chan struct{}, rotated chan<- struct{}) <-chan struct{} {
+	managerStop := make(chan struct{})
+	go func() {
+		defer close(managerStop)
+		if err := rotator.Start(stop); err == certs.ErrRotated {
+			close(rotated)
+		}
+	}()
+	return managerStop
+}
+
+// defaultServiceAccount returns the username of the service account Wave runs
+// as from the POD_NAMESPACE and SERVICE_ACCOUNT_NAME environment variables
+func defaultServiceAccount() string {
+	namespace, name := os.Getenv("POD_NAMESPACE"), os.Getenv("SERVICE_ACCOUNT_NAME")
+	if namespace == "" || name == "" {
+		return ""
+	}
+	return fmt.Sprintf("system:serviceaccount:%s:%s", namespace, name)
 }
@@ -17,6 +17,7 @@ limitations under the License.
 package controller
 
 import (
+	"github.com/pusher/wave/pkg/core"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
 
@@ -25,6 +26,14 @@ var AddToManagerFuncs []func(manager.Manager) error
 
 // AddToManager adds all Controllers to the Manager
 func AddToManager(m manager.Manager) error {
+	// The owner indexes are shared by all Controllers so must only be added once.
+	// The DigestCache maintains its own indexes and ConfigMaps and Secrets must
+	// not be cached by the Manager when it is used.
+	if core.DefaultOptions.DigestCache == nil {
+		if err := core.IndexOwners(m.GetFieldIndexer()); err != nil {
+			return err
+		}
+	}
 	for _, f := range AddToManagerFuncs {
 		if err := f(m); err != nil {
 			return err
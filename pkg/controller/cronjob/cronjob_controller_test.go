@@ -0,0 +1,49 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cronjob
+
+import (
+	"github.com/pusher/wave/test/specs"
+	"github.com/pusher/wave/test/utils"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var _ = specs.DescribeController(func() *rest.Config { return cfg }, specs.Controller{
+	Kind: "CronJob",
+	New: func() utils.Object {
+		return utils.ExampleCronJob.DeepCopy()
+	},
+	List: func() runtime.Object {
+		return &batchv1beta1.CronJobList{}
+	},
+	OwnerRef: func(obj utils.Object) metav1.OwnerReference {
+		return utils.GetCronJobOwnerRef(obj.(*batchv1beta1.CronJob))
+	},
+	PodTemplate: func(obj utils.Object) *corev1.PodTemplateSpec {
+		return &obj.(*batchv1beta1.CronJob).Spec.JobTemplate.Spec.Template
+	},
+	Add: func(mgr manager.Manager) (<-chan reconcile.Request, error) {
+		recFn, requests := specs.SetupTestReconcile(newReconciler(mgr))
+		return requests, add(mgr, recFn)
+	},
+})
@@ -0,0 +1,49 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package daemonset
+
+import (
+	"github.com/pusher/wave/test/specs"
+	"github.com/pusher/wave/test/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var _ = specs.DescribeController(func() *rest.Config { return cfg }, specs.Controller{
+	Kind: "DaemonSet",
+	New: func() utils.Object {
+		return utils.ExampleDaemonSet.DeepCopy()
+	},
+	List: func() runtime.Object {
+		return &appsv1.DaemonSetList{}
+	},
+	OwnerRef: func(obj utils.Object) metav1.OwnerReference {
+		return utils.GetDaemonSetOwnerRef(obj.(*appsv1.DaemonSet))
+	},
+	PodTemplate: func(obj utils.Object) *corev1.PodTemplateSpec {
+		return &obj.(*appsv1.DaemonSet).Spec.Template
+	},
+	Add: func(mgr manager.Manager) (<-chan reconcile.Request, error) {
+		recFn, requests := specs.SetupTestReconcile(newReconciler(mgr))
+		return requests, add(mgr, recFn)
+	},
+})
@@ -21,7 +21,6 @@ import (
 
 	"github.com/pusher/wave/pkg/core"
 	appsv1 "k8s.io/api/apps/v1"
-	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
@@ -53,26 +52,20 @@ func add(mgr manager.Manager, r reconcile.Reconciler) error {
 		return err
 	}
 
-	// Watch for changes to Deployment
-	err = c.Watch(&source.Kind{Type: &appsv1.Deployment{}}, &handler.EnqueueRequestForObject{})
+	// Watch for changes to Deployment, ignoring status-only updates
+	err = c.Watch(&source.Kind{Type: &appsv1.Deployment{}}, &handler.EnqueueRequestForObject{}, core.InstanceChanged())
 	if err != nil {
 		return err
 	}
 
-	// Watch ConfigMaps owned by a Deployment
-	err = c.Watch(&source.Kind{Type: &corev1.ConfigMap{}}, &handler.EnqueueRequestForOwner{
-		IsController: false,
-		OwnerType:    &appsv1.Deployment{},
-	})
+	// Index Deployments by the ConfigMaps and Secrets they reference
+	err = core.IndexReferences(mgr.GetFieldIndexer(), &appsv1.Deployment{})
 	if err != nil {
 		return err
 	}
 
-	// Watch Secrets owned by a Deployment
-	err = c.Watch(&source.Kind{Type: &corev1.Secret{}}, &handler.EnqueueRequestForOwner{
-		IsController: false,
-		OwnerType:    &appsv1.Deployment{},
-	})
+	// Watch ConfigMaps and Secrets referenced by a Deployment
+	err = core.WatchChildren(c, mgr.GetClient(), &appsv1.Deployment{}, &appsv1.DeploymentList{})
 	if err != nil {
 		return err
 	}
@@ -101,6 +94,7 @@ func (r *ReconcileDeployment) Reconcile(request reconcile.Request) (reconcile.Re
 	if err != nil {
 		if errors.IsNotFound(err) {
 			// Object not found, return.  Created objects are automatically garbage collected.
+			r.handler.HandleNotFound("Deployment", request.NamespacedName)
 			return reconcile.Result{}, nil
 		}
 		// Error reading the object - requeue the request.
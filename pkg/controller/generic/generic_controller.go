@@ -0,0 +1,124 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package generic
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pusher/wave/pkg/core"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// Add creates a new Controller for the given Workload and adds it to the
+// Manager. The Manager will set fields on the Controller and Start it when
+// the Manager is Started.
+// RBAC for the Workload's resource must be granted separately.
+func Add(mgr manager.Manager, workload Workload) error {
+	return add(mgr, newReconciler(mgr, workload), workload)
+}
+
+// newReconciler returns a new reconcile.Reconciler
+func newReconciler(mgr manager.Manager, workload Workload) reconcile.Reconciler {
+	return &ReconcileWorkload{
+		workload: workload,
+		handler:  core.NewHandler(mgr.GetClient(), mgr.GetEventRecorderFor("wave")),
+	}
+}
+
+// add adds a new Controller to mgr with r as the reconcile.Reconciler
+func add(mgr manager.Manager, r reconcile.Reconciler, workload Workload) error {
+	// Create a new controller
+	c, err := controller.New(controllerName(workload), mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// Watch for changes to the Workload, ignoring status-only updates
+	err = c.Watch(&source.Kind{Type: newObject(workload)}, &handler.EnqueueRequestForObject{}, core.InstanceChanged())
+	if err != nil {
+		return err
+	}
+
+	// Index the Workload by the ConfigMaps and Secrets it references
+	err = core.IndexUnstructuredReferences(mgr.GetFieldIndexer(), newObject(workload), workload.TemplatePath)
+	if err != nil {
+		return err
+	}
+
+	// Watch ConfigMaps and Secrets referenced by the Workload
+	err = core.WatchChildren(c, mgr.GetClient(), newObject(workload), newList(workload))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// controllerName returns a unique name for the Workload's controller
+func controllerName(workload Workload) string {
+	gk := workload.GroupVersionKind.GroupKind()
+	return fmt.Sprintf("%s-controller", strings.ToLower(gk.String()))
+}
+
+// newObject returns an empty Unstructured object of the Workload's kind
+func newObject(workload Workload) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(workload.GroupVersionKind)
+	return obj
+}
+
+// newList returns an empty list of the Workload's kind
+func newList(workload Workload) *unstructured.UnstructuredList {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(workload.GroupVersionKind.GroupVersion().WithKind(workload.GroupVersionKind.Kind + "List"))
+	return list
+}
+
+var _ reconcile.Reconciler = &ReconcileWorkload{}
+
+// ReconcileWorkload reconciles a custom resource embedding a PodTemplateSpec
+type ReconcileWorkload struct {
+	workload Workload
+	handler  *core.Handler
+}
+
+// Reconcile reads that state of the cluster for a Workload object and
+// updates its PodSpec based on mounted configuration
+func (r *ReconcileWorkload) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	// Fetch the Workload instance
+	instance := newObject(r.workload)
+	err := r.handler.Get(context.TODO(), request.NamespacedName, instance)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			// Object not found, return.  Created objects are automatically garbage collected.
+			r.handler.HandleNotFound(r.workload.GroupVersionKind.Kind, request.NamespacedName)
+			return reconcile.Result{}, nil
+		}
+		// Error reading the object - requeue the request.
+		return reconcile.Result{}, err
+	}
+
+	return r.handler.HandleUnstructured(instance, r.workload.TemplatePath)
+}
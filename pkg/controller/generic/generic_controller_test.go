@@ -0,0 +1,253 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package generic
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pusher/wave/pkg/core"
+	"github.com/pusher/wave/test/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var _ = Describe("Generic controller Suite", func() {
+	var c client.Client
+	var m utils.Matcher
+
+	var workload Workload
+	var instance *unstructured.Unstructured
+	var requests <-chan reconcile.Request
+	var mgrStopped *sync.WaitGroup
+	var stopMgr chan struct{}
+
+	const timeout = time.Second * 5
+	const consistentlyTimeout = time.Second
+
+	var ownerRef metav1.OwnerReference
+	var cm1 *corev1.ConfigMap
+	var cm2 *corev1.ConfigMap
+	var cm3 *corev1.ConfigMap
+	var s1 *corev1.Secret
+	var s2 *corev1.Secret
+	var s3 *corev1.Secret
+
+	var waitForInstanceReconciled = func(obj core.Object) {
+		request := reconcile.Request{
+			NamespacedName: types.NamespacedName{
+				Name:      obj.GetName(),
+				Namespace: obj.GetNamespace(),
+			},
+		}
+		// wait for reconcile for creating the instance
+		Eventually(requests, timeout).Should(Receive(Equal(request)))
+	}
+
+	BeforeEach(func() {
+		var err error
+		workload, err = ParseWorkload("test.wave.pusher.com/v1alpha1/Example=spec.template")
+		Expect(err).NotTo(HaveOccurred())
+
+		mgr, err := manager.New(cfg, manager.Options{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(core.IndexOwners(mgr.GetFieldIndexer())).To(Succeed())
+		c = mgr.GetClient()
+		m = utils.Matcher{Client: c}
+
+		var recFn reconcile.Reconciler
+		recFn, requests = SetupTestReconcile(newReconciler(mgr, workload))
+		Expect(add(mgr, recFn, workload)).NotTo(HaveOccurred())
+
+		stopMgr, mgrStopped = StartTestManager(mgr)
+
+		// Create some configmaps and secrets
+		cm1 = utils.ExampleConfigMap1.DeepCopy()
+		cm2 = utils.ExampleConfigMap2.DeepCopy()
+		cm3 = utils.ExampleConfigMap3.DeepCopy()
+		s1 = utils.ExampleSecret1.DeepCopy()
+		s2 = utils.ExampleSecret2.DeepCopy()
+		s3 = utils.ExampleSecret3.DeepCopy()
+
+		m.Create(cm1).Should(Succeed())
+		m.Create(cm2).Should(Succeed())
+		m.Create(cm3).Should(Succeed())
+		m.Create(s1).Should(Succeed())
+		m.Create(s2).Should(Succeed())
+		m.Create(s3).Should(Succeed())
+		m.Get(cm1, timeout).Should(Succeed())
+		m.Get(cm2, timeout).Should(Succeed())
+		m.Get(cm3, timeout).Should(Succeed())
+		m.Get(s1, timeout).Should(Succeed())
+		m.Get(s2, timeout).Should(Succeed())
+		m.Get(s3, timeout).Should(Succeed())
+
+		instance = utils.ExampleWorkload.DeepCopy()
+
+		// Create an instance and wait for it to be reconciled
+		m.Create(instance).Should(Succeed())
+		waitForInstanceReconciled(instance)
+
+		ownerRef = utils.GetWorkloadOwnerRef(instance)
+	})
+
+	AfterEach(func() {
+		// Make sure to delete any finalizers (if the instance exists)
+		Eventually(func() error {
+			key := types.NamespacedName{Namespace: instance.GetNamespace(), Name: instance.GetName()}
+			err := c.Get(context.TODO(), key, instance)
+			if err != nil && errors.IsNotFound(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			instance.SetFinalizers([]string{})
+			return c.Update(context.TODO(), instance)
+		}, timeout).Should(Succeed())
+
+		Eventually(func() error {
+			key := types.NamespacedName{Namespace: instance.GetNamespace(), Name: instance.GetName()}
+			err := c.Get(context.TODO(), key, instance)
+			if err != nil && errors.IsNotFound(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if len(instance.GetFinalizers()) > 0 {
+				return fmt.Errorf("Finalizers not upated")
+			}
+			return nil
+		}, timeout).Should(Succeed())
+
+		close(stopMgr)
+		mgrStopped.Wait()
+
+		utils.DeleteAll(cfg, timeout,
+			newList(workload),
+			&corev1.ConfigMapList{},
+			&corev1.SecretList{},
+			&corev1.EventList{},
+		)
+	})
+
+	Context("When a custom resource is reconciled", func() {
+		Context("And it has the required annotation", func() {
+			BeforeEach(func() {
+				annotations := instance.GetAnnotations()
+				if annotations == nil {
+					annotations = make(map[string]string)
+				}
+				annotations[core.RequiredAnnotation] = "true"
+				instance.SetAnnotations(annotations)
+
+				m.Update(instance).Should(Succeed())
+				waitForInstanceReconciled(instance)
+
+				// Get the updated instance
+				m.Get(instance, timeout).Should(Succeed())
+			})
+
+			It("Adds OwnerReferences to all children", func() {
+				for _, obj := range []core.Object{cm1, cm2, cm3, s1, s2, s3} {
+					m.Eventually(obj, timeout).Should(utils.WithOwnerReferences(ContainElement(ownerRef)))
+				}
+			})
+
+			It("Adds a finalizer to the instance", func() {
+				m.Eventually(instance, timeout).Should(utils.WithFinalizers(ContainElement(core.FinalizerString)))
+			})
+
+			It("Adds a config hash to the embedded Pod Template", func() {
+				m.Eventually(instance, timeout).Should(utils.WithPodTemplateAnnotations(HaveKey(core.ConfigHashAnnotation)))
+			})
+
+			Context("And a child is updated", func() {
+				var originalHash string
+
+				BeforeEach(func() {
+					m.Eventually(instance, timeout).Should(utils.WithPodTemplateAnnotations(HaveKey(core.ConfigHashAnnotation)))
+					annotations, _, err := unstructured.NestedStringMap(instance.Object, "spec", "template", "metadata", "annotations")
+					Expect(err).NotTo(HaveOccurred())
+					originalHash = annotations[core.ConfigHashAnnotation]
+
+					m.Get(cm1, timeout).Should(Succeed())
+					cm1.Data["key1"] = "modified"
+					m.Update(cm1).Should(Succeed())
+
+					waitForInstanceReconciled(instance)
+
+					// Get the updated instance
+					m.Get(instance, timeout).Should(Succeed())
+				})
+
+				It("Updates the config hash in the embedded Pod Template", func() {
+					m.Eventually(instance, timeout).ShouldNot(utils.WithPodTemplateAnnotations(HaveKeyWithValue(core.ConfigHashAnnotation, originalHash)))
+				})
+			})
+
+			Context("And is deleted", func() {
+				BeforeEach(func() {
+					// Make sure the cache has synced before we run the test
+					m.Eventually(instance, timeout).Should(utils.WithPodTemplateAnnotations(HaveKey(core.ConfigHashAnnotation)))
+					m.Delete(instance).Should(Succeed())
+					m.Eventually(instance, timeout).ShouldNot(utils.WithDeletionTimestamp(BeNil()))
+					waitForInstanceReconciled(instance)
+				})
+
+				It("Removes the OwnerReference from the all children", func() {
+					for _, obj := range []core.Object{cm1, cm2, s1, s2} {
+						m.Eventually(obj, timeout).ShouldNot(utils.WithOwnerReferences(ContainElement(ownerRef)))
+					}
+				})
+
+				It("Removes the instance's finalizer", func() {
+					// Removing the finalizer causes the instance to be deleted
+					m.Get(instance, timeout).ShouldNot(Succeed())
+				})
+			})
+		})
+
+		Context("And it does not have the required annotation", func() {
+			BeforeEach(func() {
+				// Get the updated instance
+				m.Get(instance, timeout).Should(Succeed())
+			})
+
+			It("Doesn't add any OwnerReferences to any children", func() {
+				for _, obj := range []core.Object{cm1, cm2, s1, s2} {
+					m.Consistently(obj, consistentlyTimeout).ShouldNot(utils.WithOwnerReferences(ContainElement(ownerRef)))
+				}
+			})
+
+			It("Doesn't add a finalizer to the instance", func() {
+				m.Consistently(instance, consistentlyTimeout).ShouldNot(utils.WithFinalizers(ContainElement(core.FinalizerString)))
+			})
+		})
+	})
+})
@@ -0,0 +1,123 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package generic
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Workload describes a kind of resource, typically a custom resource, that
+// embeds a PodTemplateSpec which Wave should manage
+type Workload struct {
+	GroupVersionKind schema.GroupVersionKind
+	TemplatePath     []string
+}
+
+// workloadConfig is the format of each entry in a workload config file
+type workloadConfig struct {
+	APIVersion      string `json:"apiVersion"`
+	Kind            string `json:"kind"`
+	PodTemplatePath string `json:"podTemplatePath"`
+}
+
+// workloadConfigFile is the format of a workload config file
+type workloadConfigFile struct {
+	Workloads []workloadConfig `json:"workloads"`
+}
+
+// String returns the Workload in the format accepted by ParseWorkload
+func (w Workload) String() string {
+	apiVersion, kind := w.GroupVersionKind.ToAPIVersionAndKind()
+	return fmt.Sprintf("%s/%s=%s", apiVersion, kind, strings.Join(w.TemplatePath, "."))
+}
+
+// ParseWorkload parses a Workload from a string of the form
+// <group>/<version>/<Kind>=<path.to.template>,
+// eg. argoproj.io/v1alpha1/Rollout=spec.template
+func ParseWorkload(value string) (Workload, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return Workload{}, fmt.Errorf("invalid workload %q: expected <group>/<version>/<Kind>=<path.to.template>", value)
+	}
+
+	i := strings.LastIndex(parts[0], "/")
+	if i < 0 {
+		return Workload{}, fmt.Errorf("invalid workload %q: expected <group>/<version>/<Kind>=<path.to.template>", value)
+	}
+	return newWorkload(parts[0][:i], parts[0][i+1:], parts[1])
+}
+
+// LoadWorkloads reads a list of Workloads from the YAML config file at the
+// given path. The file should be of the form:
+//
+//	workloads:
+//	- apiVersion: argoproj.io/v1alpha1
+//	  kind: Rollout
+//	  podTemplatePath: spec.template
+func LoadWorkloads(path string) ([]Workload, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading workload config: %v", err)
+	}
+
+	config := &workloadConfigFile{}
+	err = yaml.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing workload config: %v", err)
+	}
+
+	workloads := []Workload{}
+	for _, c := range config.Workloads {
+		workload, err := newWorkload(c.APIVersion, c.Kind, c.PodTemplatePath)
+		if err != nil {
+			return nil, err
+		}
+		workloads = append(workloads, workload)
+	}
+	return workloads, nil
+}
+
+// newWorkload validates the given fields and constructs a Workload from them
+func newWorkload(apiVersion, kind, templatePath string) (Workload, error) {
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return Workload{}, fmt.Errorf("invalid apiVersion %q: %v", apiVersion, err)
+	}
+	if gv.Version == "" {
+		return Workload{}, fmt.Errorf("invalid apiVersion %q: version must be set", apiVersion)
+	}
+	if kind == "" {
+		return Workload{}, fmt.Errorf("kind must be set for apiVersion %q", apiVersion)
+	}
+
+	path := strings.Split(templatePath, ".")
+	for _, field := range path {
+		if field == "" {
+			return Workload{}, fmt.Errorf("invalid pod template path %q for %s", templatePath, kind)
+		}
+	}
+
+	return Workload{
+		GroupVersionKind: gv.WithKind(kind),
+		TemplatePath:     path,
+	}, nil
+}
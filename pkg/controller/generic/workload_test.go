@@ -0,0 +1,106 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package generic
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var _ = Describe("Workload Suite", func() {
+	rollout := Workload{
+		GroupVersionKind: schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout"},
+		TemplatePath:     []string{"spec", "template"},
+	}
+
+	Context("ParseWorkload", func() {
+		It("parses a group, version, kind and template path", func() {
+			workload, err := ParseWorkload("argoproj.io/v1alpha1/Rollout=spec.template")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(workload).To(Equal(rollout))
+		})
+
+		It("round trips with String", func() {
+			workload, err := ParseWorkload(rollout.String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(workload).To(Equal(rollout))
+		})
+
+		It("returns an error when the template path is missing", func() {
+			_, err := ParseWorkload("argoproj.io/v1alpha1/Rollout")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when the template path is invalid", func() {
+			_, err := ParseWorkload("argoproj.io/v1alpha1/Rollout=spec..template")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when the version is missing", func() {
+			_, err := ParseWorkload("Rollout=spec.template")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when the kind is missing", func() {
+			_, err := ParseWorkload("argoproj.io/v1alpha1/=spec.template")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("LoadWorkloads", func() {
+		var path string
+
+		BeforeEach(func() {
+			f, err := ioutil.TempFile("", "workloads")
+			Expect(err).NotTo(HaveOccurred())
+			defer f.Close()
+			path = f.Name()
+
+			_, err = f.WriteString(`workloads:
+- apiVersion: argoproj.io/v1alpha1
+  kind: Rollout
+  podTemplatePath: spec.template
+- apiVersion: apps.kruise.io/v1alpha1
+  kind: CloneSet
+  podTemplatePath: spec.template
+`)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.Remove(path)).To(Succeed())
+		})
+
+		It("returns each workload in the file", func() {
+			workloads, err := LoadWorkloads(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(workloads).To(ConsistOf(rollout, Workload{
+				GroupVersionKind: schema.GroupVersionKind{Group: "apps.kruise.io", Version: "v1alpha1", Kind: "CloneSet"},
+				TemplatePath:     []string{"spec", "template"},
+			}))
+		})
+
+		It("returns an error when the file doesn't exist", func() {
+			_, err := LoadWorkloads(path + "-missing")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,163 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stalepods
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pusher/wave/pkg/core"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// kind describes an instance whose Pods are checked for stale configuration
+type kind struct {
+	name      string
+	newObject func() runtime.Object
+}
+
+// kinds are the instances whose Pods are checked for stale configuration.
+// CronJobs are not included as their Pods run to completion.
+var kinds = []kind{
+	{name: "Deployment", newObject: func() runtime.Object { return &appsv1.Deployment{} }},
+	{name: "StatefulSet", newObject: func() runtime.Object { return &appsv1.StatefulSet{} }},
+	{name: "DaemonSet", newObject: func() runtime.Object { return &appsv1.DaemonSet{} }},
+}
+
+// Add creates a new Controller for each kind of instance which compares the
+// configuration hash of its Pods with its Pod Template and adds them to the
+// Manager. The Manager will set fields on the Controllers and Start them when
+// the Manager is Started.
+func Add(mgr manager.Manager) error {
+	for _, k := range kinds {
+		if err := add(mgr, newReconciler(mgr, k), k); err != nil {
+			return fmt.Errorf("error adding stale pods controller for %s: %v", k.name, err)
+		}
+	}
+	return nil
+}
+
+// newReconciler returns a new reconcile.Reconciler
+func newReconciler(mgr manager.Manager, k kind) reconcile.Reconciler {
+	return &ReconcilePods{
+		kind:    k,
+		handler: core.NewHandler(mgr.GetClient(), mgr.GetEventRecorderFor("wave")),
+	}
+}
+
+// add adds a new Controller to mgr with r as the reconcile.Reconciler
+func add(mgr manager.Manager, r reconcile.Reconciler, k kind) error {
+	// Create a new controller
+	name := fmt.Sprintf("%s-stale-pods-controller", strings.ToLower(k.name))
+	c, err := controller.New(name, mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// Watch for changes to the instance, ignoring status-only updates
+	err = c.Watch(&source.Kind{Type: k.newObject()}, &handler.EnqueueRequestForObject{}, core.InstanceChanged())
+	if err != nil {
+		return err
+	}
+
+	// Watch Pods controlled by the instance. Deployments control their Pods
+	// through ReplicaSets.
+	var podHandler handler.EventHandler = &handler.EnqueueRequestForOwner{
+		OwnerType:    k.newObject(),
+		IsController: true,
+	}
+	if k.name == "Deployment" {
+		podHandler = &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: &replicaSetOwnerMapper{client: mgr.GetClient()},
+		}
+	}
+	err = c.Watch(&source.Kind{Type: &corev1.Pod{}}, podHandler, core.PodChanged())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// replicaSetOwnerMapper maps Pods to requests for the Deployment controlling
+// their ReplicaSet
+type replicaSetOwnerMapper struct {
+	client client.Client
+}
+
+// Map implements the handler.Mapper interface
+func (m *replicaSetOwnerMapper) Map(obj handler.MapObject) []reconcile.Request {
+	ref := metav1.GetControllerOf(obj.Meta)
+	if ref == nil || ref.Kind != "ReplicaSet" {
+		return []reconcile.Request{}
+	}
+
+	rs := &appsv1.ReplicaSet{}
+	key := types.NamespacedName{Namespace: obj.Meta.GetNamespace(), Name: ref.Name}
+	if err := m.client.Get(context.TODO(), key, rs); err != nil {
+		return []reconcile.Request{}
+	}
+
+	ref = metav1.GetControllerOf(rs)
+	if ref == nil || ref.Kind != "Deployment" {
+		return []reconcile.Request{}
+	}
+	return []reconcile.Request{
+		{NamespacedName: types.NamespacedName{Namespace: rs.GetNamespace(), Name: ref.Name}},
+	}
+}
+
+var _ reconcile.Reconciler = &ReconcilePods{}
+
+// ReconcilePods reconciles the Pods of an instance
+type ReconcilePods struct {
+	kind    kind
+	handler *core.Handler
+}
+
+// Reconcile reads that state of the cluster for an instance and its Pods and
+// records how many of its Pods are running a stale configuration
+// +kubebuilder:rbac:groups=,resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get;list;watch
+func (r *ReconcilePods) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	// Fetch the instance
+	instance := r.kind.newObject()
+	err := r.handler.Get(context.TODO(), request.NamespacedName, instance)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			// Object not found, stop tracking its Pods
+			r.handler.ForgetPods(r.kind.name, request.NamespacedName)
+			return reconcile.Result{}, nil
+		}
+		// Error reading the object - requeue the request.
+		return reconcile.Result{}, err
+	}
+
+	return r.handler.HandlePods(instance)
+}
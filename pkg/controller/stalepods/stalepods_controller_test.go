@@ -0,0 +1,161 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stalepods
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pusher/wave/pkg/core"
+	"github.com/pusher/wave/test/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var _ = Describe("Stale pods controller Suite", func() {
+	var c client.Client
+	var m utils.Matcher
+
+	var deployment *appsv1.Deployment
+	var replicaSet *appsv1.ReplicaSet
+	var requests <-chan reconcile.Request
+	var mgrStopped *sync.WaitGroup
+	var stopMgr chan struct{}
+
+	const timeout = time.Second * 5
+
+	var controllerRef = func(obj metav1.Object, kind string) metav1.OwnerReference {
+		t := true
+		return metav1.OwnerReference{
+			APIVersion: "apps/v1",
+			Kind:       kind,
+			Name:       obj.GetName(),
+			UID:        obj.GetUID(),
+			Controller: &t,
+		}
+	}
+
+	var newPod = func(owner metav1.OwnerReference) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "example-pod",
+				Namespace:       deployment.GetNamespace(),
+				Labels:          deployment.Spec.Selector.MatchLabels,
+				Annotations:     map[string]string{core.ConfigHashAnnotation: "v1:previous"},
+				OwnerReferences: []metav1.OwnerReference{owner},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "container", Image: "container"}},
+			},
+		}
+	}
+
+	var deploymentRequest = func() reconcile.Request {
+		return reconcile.Request{
+			NamespacedName: types.NamespacedName{
+				Name:      deployment.GetName(),
+				Namespace: deployment.GetNamespace(),
+			},
+		}
+	}
+
+	BeforeEach(func() {
+		mgr, err := manager.New(cfg, manager.Options{})
+		Expect(err).NotTo(HaveOccurred())
+		c = mgr.GetClient()
+		m = utils.Matcher{Client: c}
+
+		var recFn reconcile.Reconciler
+		recFn, requests = SetupTestReconcile(newReconciler(mgr, kinds[0]))
+		Expect(add(mgr, recFn, kinds[0])).NotTo(HaveOccurred())
+
+		stopMgr, mgrStopped = StartTestManager(mgr)
+
+		deployment = utils.ExampleDeployment.DeepCopy()
+		deployment.SetAnnotations(map[string]string{core.RequiredAnnotation: "true"})
+		deployment.Spec.Template.SetAnnotations(map[string]string{core.ConfigHashAnnotation: "v1:current"})
+		m.Create(deployment).Should(Succeed())
+		Eventually(requests, timeout).Should(Receive(Equal(deploymentRequest())))
+
+		replicaSet = &appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "example-rs",
+				Namespace:       deployment.GetNamespace(),
+				Labels:          deployment.Spec.Selector.MatchLabels,
+				OwnerReferences: []metav1.OwnerReference{controllerRef(deployment, "Deployment")},
+			},
+			Spec: appsv1.ReplicaSetSpec{
+				Selector: deployment.Spec.Selector,
+				Template: deployment.Spec.Template,
+			},
+		}
+		m.Create(replicaSet).Should(Succeed())
+		m.Get(replicaSet, timeout).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		close(stopMgr)
+		mgrStopped.Wait()
+
+		utils.DeleteAll(cfg, timeout,
+			&corev1.PodList{},
+			&appsv1.ReplicaSetList{},
+			&appsv1.DeploymentList{},
+			&corev1.EventList{},
+		)
+	})
+
+	It("reconciles the Deployment when a Pod of its ReplicaSet is created", func() {
+		m.Create(newPod(controllerRef(replicaSet, "ReplicaSet"))).Should(Succeed())
+		Eventually(requests, timeout).Should(Receive(Equal(deploymentRequest())))
+	})
+
+	Context("replicaSetOwnerMapper", func() {
+		var mapper *replicaSetOwnerMapper
+
+		BeforeEach(func() {
+			mapper = &replicaSetOwnerMapper{client: c}
+		})
+
+		It("maps Pods to the Deployment controlling their ReplicaSet", func() {
+			pod := newPod(controllerRef(replicaSet, "ReplicaSet"))
+			Eventually(func() []reconcile.Request {
+				return mapper.Map(handler.MapObject{Meta: pod, Object: pod})
+			}, timeout).Should(ConsistOf(deploymentRequest()))
+		})
+
+		It("does not map Pods controlled by something else", func() {
+			pod := newPod(controllerRef(deployment, "StatefulSet"))
+			Expect(mapper.Map(handler.MapObject{Meta: pod, Object: pod})).To(BeEmpty())
+		})
+
+		It("does not map Pods whose ReplicaSet doesn't exist", func() {
+			missing := replicaSet.DeepCopy()
+			missing.SetName("missing")
+			pod := newPod(controllerRef(missing, "ReplicaSet"))
+			Expect(mapper.Map(handler.MapObject{Meta: pod, Object: pod})).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,183 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// MutateDeployment is called by the Deployment mutating webhook to set the
+// configuration hash on a Deployment as it is admitted, so that its first
+// rollout already includes the hash.
+// The Deployment is modified in place and is not updated on the API server.
+// It returns true if the Deployment was modified.
+func (h *Handler) MutateDeployment(instance *appsv1.Deployment) (bool, error) {
+	return h.mutatePodController(&deployment{Deployment: instance})
+}
+
+// mutatePodController sets the configuration hash, and the finalizer when
+// tracking children by OwnerReferences, on the given instance in place.
+// OwnerReferences are left for the controller to add as the instance may not
+// exist yet.
+func (h *Handler) mutatePodController(instance podController) (bool, error) {
+	if !hasRequiredAnnotation(instance) || toBeDeleted(instance) {
+		return false, nil
+	}
+
+	current, err := h.getCurrentChildren(instance)
+	if err != nil {
+		return false, err
+	}
+
+	hash, equivalent, err := h.calculateHash(instance, current)
+	if err != nil {
+		return false, err
+	}
+
+	original := instance.DeepCopy()
+	setConfigHash(instance, hash)
+	setEquivalentConfigHash(instance, equivalent)
+	if err := h.setConfigSummary(instance, current); err != nil {
+		return false, err
+	}
+	if getConfigHash(original) != hash {
+		setTriggerAnnotations(original, instance, time.Now())
+	}
+	if h.options.TrackingMode == OwnerReferencesTracking {
+		addFinalizer(instance)
+	}
+	clearMissingDependencies(instance)
+
+	return !reflect.DeepEqual(original, instance), nil
+}
+
+// ValidateDeployment is called by the Deployment validating webhook to check
+// that the required ConfigMaps, Secrets and keys referenced by a Deployment
+// exist.
+// Missing children are returned as an error, or as warnings when the
+// ValidationMode is WarnValidation. Children that can't be checked are always
+// returned as warnings so that Wave never blocks a Deployment it can't verify.
+func (h *Handler) ValidateDeployment(instance *appsv1.Deployment) ([]string, error) {
+	return h.validatePodController(&deployment{Deployment: instance})
+}
+
+// ValidateDeploymentUpdate is called by the Deployment validating webhook to
+// check an update to a Deployment made by the user with the given username.
+// Only updates that change the children the Deployment references, or add
+// the required annotation, are checked, so that a Deployment whose children
+// have since been deleted can still be rolled back or otherwise updated.
+// Updates made by Wave itself are never checked.
+func (h *Handler) ValidateDeploymentUpdate(old, new *appsv1.Deployment, username string) ([]string, error) {
+	if h.options.ServiceAccount != "" && username == h.options.ServiceAccount {
+		return nil, nil
+	}
+	if !referencesChanged(&deployment{Deployment: old}, &deployment{Deployment: new}) {
+		return nil, nil
+	}
+	return h.ValidateDeployment(new)
+}
+
+// referencesChanged returns true if the children referenced by the instance,
+// or whether it has the required annotation, differ between old and new
+func referencesChanged(old, new podController) bool {
+	if hasRequiredAnnotation(old) != hasRequiredAnnotation(new) {
+		return true
+	}
+	oldConfigMaps, oldSecrets := getChildNamesByType(old)
+	newConfigMaps, newSecrets := getChildNamesByType(new)
+	return !reflect.DeepEqual(oldConfigMaps, newConfigMaps) || !reflect.DeepEqual(oldSecrets, newSecrets)
+}
+
+// validatePodController checks that the required children of the instance
+// exist
+func (h *Handler) validatePodController(instance podController) ([]string, error) {
+	if !hasRequiredAnnotation(instance) || toBeDeleted(instance) {
+		return nil, nil
+	}
+
+	var missing, warnings []string
+	configMaps, secrets := getChildNamesByType(instance)
+	for name, metadata := range configMaps {
+		cm := &corev1.ConfigMap{}
+		m, err := h.findMissing(instance.GetNamespace(), name, metadata, cm, func(key string) bool {
+			_, ok := cm.Data[key]
+			_, binaryOk := cm.BinaryData[key]
+			return ok || binaryOk
+		})
+		if err != nil {
+			warnings = append(warnings, err.Error())
+		}
+		missing = append(missing, m...)
+	}
+	for name, metadata := range secrets {
+		s := &corev1.Secret{}
+		m, err := h.findMissing(instance.GetNamespace(), name, metadata, s, func(key string) bool {
+			_, ok := s.Data[key]
+			return ok
+		})
+		if err != nil {
+			warnings = append(warnings, err.Error())
+		}
+		missing = append(missing, m...)
+	}
+	sort.Strings(missing)
+	sort.Strings(warnings)
+
+	if len(missing) == 0 {
+		return warnings, nil
+	}
+	if h.options.ValidationMode == WarnValidation {
+		return append(warnings, fmt.Sprintf("required children not found: %s", strings.Join(missing, ", "))), nil
+	}
+	return warnings, &missingChildrenError{missing: missing}
+}
+
+// findMissing gets the child with the given name and returns it, or any of its
+// required keys, if they don't exist.
+// hasKey reports whether the fetched child contains the given key.
+func (h *Handler) findMissing(namespace, name string, metadata configMetadata, obj Object, hasKey func(string) bool) ([]string, error) {
+	if !metadata.required {
+		return nil, nil
+	}
+
+	kind := reflect.TypeOf(obj).Elem().Name()
+	err := h.childReader().Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: name}, obj)
+	if errors.IsNotFound(err) {
+		return []string{fmt.Sprintf("%s/%s", kind, name)}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to check %s/%s: %v", kind, name, err)
+	}
+
+	var missing []string
+	for key := range metadata.requiredKeys {
+		if !hasKey(key) {
+			missing = append(missing, fmt.Sprintf("%s/%s[%s]", kind, name, key))
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pusher/wave/test/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+var _ = Describe("Wave admission Suite", func() {
+	var h *Handler
+	var m utils.Matcher
+	var deployment *appsv1.Deployment
+	var mgrStopped *sync.WaitGroup
+	var stopMgr chan struct{}
+
+	const timeout = time.Second * 5
+
+	BeforeEach(func() {
+		mgr, err := manager.New(cfg, manager.Options{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(IndexOwners(mgr.GetFieldIndexer())).To(Succeed())
+		h = NewHandler(mgr.GetClient(), mgr.GetEventRecorderFor("wave"))
+		m = utils.Matcher{Client: mgr.GetClient()}
+
+		stopMgr, mgrStopped = StartTestManager(mgr)
+
+		for _, obj := range []Object{
+			utils.ExampleConfigMap1.DeepCopy(),
+			utils.ExampleConfigMap2.DeepCopy(),
+			utils.ExampleConfigMap3.DeepCopy(),
+			utils.ExampleSecret1.DeepCopy(),
+			utils.ExampleSecret2.DeepCopy(),
+			utils.ExampleSecret3.DeepCopy(),
+		} {
+			m.Create(obj).Should(Succeed())
+			m.Get(obj, timeout).Should(Succeed())
+		}
+
+		// The Deployment is not created as it is being admitted
+		deployment = utils.ExampleDeployment.DeepCopy()
+		deployment.SetAnnotations(map[string]string{RequiredAnnotation: "true"})
+	})
+
+	AfterEach(func() {
+		close(stopMgr)
+		mgrStopped.Wait()
+
+		utils.DeleteAll(cfg, timeout,
+			&corev1.ConfigMapList{},
+			&corev1.SecretList{},
+		)
+	})
+
+	Context("MutateDeployment", func() {
+		It("sets the config hash on the Pod Template", func() {
+			mutated, err := h.MutateDeployment(deployment)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mutated).To(BeTrue())
+
+			Expect(deployment.Spec.Template.GetAnnotations()).To(HaveKeyWithValue(ConfigHashAnnotation, "v1:f445cf63c10f7fc531f81beb46bd96e9dc36ab495f864f789c51d4bec49fdca5"))
+		})
+
+		It("adds the finalizer", func() {
+			_, err := h.MutateDeployment(deployment)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(deployment.GetFinalizers()).To(ContainElement(FinalizerString))
+		})
+
+		It("doesn't add the finalizer with index tracking", func() {
+			indexHandler := NewHandlerWithOptions(h.Client, h.recorder, Options{TrackingMode: IndexTracking})
+			_, err := indexHandler.MutateDeployment(deployment)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(deployment.GetFinalizers()).NotTo(ContainElement(FinalizerString))
+		})
+
+		It("doesn't modify a Deployment without the required annotation", func() {
+			deployment.SetAnnotations(map[string]string{})
+			mutated, err := h.MutateDeployment(deployment)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mutated).To(BeFalse())
+
+			Expect(deployment.Spec.Template.GetAnnotations()).NotTo(HaveKey(ConfigHashAnnotation))
+		})
+
+		It("doesn't modify a Deployment that is already up to date", func() {
+			_, err := h.MutateDeployment(deployment)
+			Expect(err).NotTo(HaveOccurred())
+
+			mutated, err := h.MutateDeployment(deployment)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mutated).To(BeFalse())
+		})
+
+		It("returns an error when a required child is missing", func() {
+			deployment.Spec.Template.Spec.Volumes[0].Secret.SecretName = "missing"
+			_, err := h.MutateDeployment(deployment)
+			Expect(err).To(HaveOccurred())
+			Expect(deployment.Spec.Template.GetAnnotations()).NotTo(HaveKey(ConfigHashAnnotation))
+		})
+	})
+
+	Context("ValidateDeployment", func() {
+		It("doesn't return an error when all required children exist", func() {
+			warnings, err := h.ValidateDeployment(deployment)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(BeEmpty())
+		})
+
+		It("doesn't check keys that are optional", func() {
+			// example3 doesn't contain the optional key4
+			_, err := h.ValidateDeployment(deployment)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("returns an error listing missing children and keys", func() {
+			deployment.Spec.Template.Spec.Volumes[0].Secret.SecretName = "missing"
+			deployment.Spec.Template.Spec.Containers[1].Env[0].ValueFrom.ConfigMapKeyRef.Key = "missing"
+			_, err := h.ValidateDeployment(deployment)
+			Expect(err).To(MatchError("required children not found: ConfigMap/example3[missing], Secret/missing"))
+		})
+
+		It("returns missing children as warnings with warn validation", func() {
+			warnHandler := NewHandlerWithOptions(h.Client, h.recorder, Options{
+				TrackingMode:   OwnerReferencesTracking,
+				ValidationMode: WarnValidation,
+			})
+			deployment.Spec.Template.Spec.Volumes[0].Secret.SecretName = "missing"
+			warnings, err := warnHandler.ValidateDeployment(deployment)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(ConsistOf("required children not found: Secret/missing"))
+		})
+
+		It("doesn't check a Deployment without the required annotation", func() {
+			deployment.SetAnnotations(map[string]string{})
+			deployment.Spec.Template.Spec.Volumes[0].Secret.SecretName = "missing"
+			_, err := h.ValidateDeployment(deployment)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+})
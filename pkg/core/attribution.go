@@ -0,0 +1,179 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// changeAttributionTTL is how long a change to a ConfigMap or Secret is kept
+// for the controllers to attribute the rollouts it triggers to
+const changeAttributionTTL = time.Hour
+
+// changeAttribution records who changed a ConfigMap or Secret
+type changeAttribution struct {
+	manager   string
+	operation string
+	child     string
+	time      time.Time
+
+	// digests are the config digests of the child's keys after the change
+	digests map[string]string
+}
+
+// String describes the change, for example
+// "alice (Update ConfigMap/app at 2019-01-01T00:00:00Z)"
+func (a changeAttribution) String() string {
+	return fmt.Sprintf("%s (%s %s at %s)", a.manager, a.operation, a.child, a.time.UTC().Format(time.RFC3339))
+}
+
+// matches returns true if the digests of the child after the change are
+// those of the keys an instance uses
+func (a changeAttribution) matches(digests map[string]string) bool {
+	if digests == nil {
+		return false
+	}
+	for key, digest := range digests {
+		if a.digests[key] != digest {
+			return false
+		}
+	}
+	return true
+}
+
+// RecordChange is called by the ConfigMap and Secret webhooks to record who
+// is changing the child, so that the rollouts it triggers of the given
+// instances, for example "Deployment/app", can be attributed to them.
+// The Kubernetes API Wave is built against does not record managedFields, so
+// changes are only attributed when they are admitted by this process.
+func (h *Handler) RecordChange(child Object, instances []string, manager, operation string) {
+	change := changeAttribution{
+		manager:   manager,
+		operation: operation,
+		child:     childName(child),
+		time:      time.Now(),
+		digests:   h.getChildDigests(configObject{object: child, allKeys: true}, false),
+	}
+	for _, instance := range instances {
+		attributions.record(fmt.Sprintf("%s/%s", child.GetNamespace(), instance), change)
+	}
+}
+
+// attributeChange returns who made the most recent change to the children
+// whose digests differ between the old and new instances, or an empty string
+// if it isn't known.
+// A change is only attributed when the child's digests after it are those now
+// behind the new instance's configuration hash, so a later change made by
+// someone else isn't attributed to them.
+// It also returns a function to forget the changes used once the instance
+// has been updated.
+func attributeChange(old, new podController) (string, func()) {
+	oldDigests, newDigests := getComparableDigests(old, new)
+	if oldDigests == nil {
+		return "", func() {}
+	}
+	instance := fmt.Sprintf("%s/%s/%s", new.GetNamespace(), kindOf(new.GetObject()), new.GetName())
+	children := changedChildren(oldDigests, newDigests)
+	attribution, used, ok := attributions.latest(instance, children, newDigests, time.Now())
+	if !ok {
+		return "", func() {}
+	}
+	return attribution.String(), func() { attributions.forget(used, attribution.time) }
+}
+
+// setTriggeredBy sets the LastTriggeredByAnnotation on the instance, or
+// removes it if who triggered the change isn't known so that an earlier change
+// isn't attributed to the wrong person
+func setTriggeredBy(obj podController, triggeredBy string) {
+	annotations := obj.GetAnnotations()
+	if triggeredBy == "" {
+		if _, ok := annotations[LastTriggeredByAnnotation]; ok {
+			delete(annotations, LastTriggeredByAnnotation)
+			obj.SetAnnotations(annotations)
+		}
+		return
+	}
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[LastTriggeredByAnnotation] = triggeredBy
+	obj.SetAnnotations(annotations)
+}
+
+// attributions holds the changes recorded by the webhooks
+var attributions = &attributionRecorder{changes: make(map[string]changeAttribution)}
+
+// attributionRecorder holds the most recent change to each child for each
+// instance whose rollout it triggers
+type attributionRecorder struct {
+	mutex   sync.Mutex
+	changes map[string]changeAttribution
+}
+
+// record stores the change for the instance, replacing any earlier change to
+// the same child, and forgets changes older than changeAttributionTTL
+func (r *attributionRecorder) record(instance string, change changeAttribution) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for key, existing := range r.changes {
+		if change.time.Sub(existing.time) > changeAttributionTTL {
+			delete(r.changes, key)
+		}
+	}
+	r.changes[fmt.Sprintf("%s/%s", instance, change.child)] = change
+}
+
+// latest returns the most recent change for the instance to any of the
+// children, made within changeAttributionTTL of now, that left the child with
+// the given digests.
+// It also returns the keys of every matching change.
+func (r *attributionRecorder) latest(instance string, children []string, digests configKeys, now time.Time) (changeAttribution, []string, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var latest changeAttribution
+	used := []string{}
+	for _, child := range children {
+		key := fmt.Sprintf("%s/%s", instance, child)
+		change, ok := r.changes[key]
+		if !ok || now.Sub(change.time) > changeAttributionTTL || !change.matches(digests[child]) {
+			continue
+		}
+		if len(used) == 0 || change.time.After(latest.time) {
+			latest = change
+		}
+		used = append(used, key)
+	}
+	return latest, used, len(used) > 0
+}
+
+// forget removes the changes with the given keys once they have been
+// attributed, unless they have since been replaced by changes made after
+// until
+func (r *attributionRecorder) forget(keys []string, until time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, key := range keys {
+		if change, ok := r.changes[key]; ok && !change.time.After(until) {
+			delete(r.changes, key)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Wave attribution Suite", func() {
+	var recorder *attributionRecorder
+	var now time.Time
+	var digests configKeys
+
+	const instance = "default/Deployment/example"
+
+	var change = func(manager, child string, at time.Time) changeAttribution {
+		return changeAttribution{manager: manager, operation: "Update", child: child, time: at, digests: digests[child]}
+	}
+
+	BeforeEach(func() {
+		recorder = &attributionRecorder{changes: make(map[string]changeAttribution)}
+		now = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+		digests = configKeys{
+			"ConfigMap/app": {"level": "aaa", "port": "bbb"},
+			"Secret/creds":  {"password": "ccc"},
+		}
+	})
+
+	It("describes who made the change", func() {
+		Expect(change("alice", "ConfigMap/app", now).String()).To(Equal("alice (Update ConfigMap/app at 2019-01-01T00:00:00Z)"))
+	})
+
+	It("returns the most recent change to any of the children", func() {
+		recorder.record(instance, change("alice", "ConfigMap/app", now))
+		recorder.record(instance, change("bob", "Secret/creds", now.Add(time.Minute)))
+
+		latest, used, ok := recorder.latest(instance, []string{"ConfigMap/app", "Secret/creds"}, digests, now.Add(2*time.Minute))
+		Expect(ok).To(BeTrue())
+		Expect(latest.manager).To(Equal("bob"))
+		Expect(used).To(HaveLen(2))
+	})
+
+	It("only returns changes to the given children for the instance", func() {
+		recorder.record(instance, change("alice", "ConfigMap/app", now))
+		recorder.record("other/Deployment/example", change("bob", "Secret/creds", now))
+
+		_, _, ok := recorder.latest(instance, []string{"Secret/creds"}, digests, now)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("only returns changes that left the child with the instance's digests", func() {
+		recorder.record(instance, change("alice", "ConfigMap/app", now))
+		digests["ConfigMap/app"] = map[string]string{"level": "ddd", "port": "bbb"}
+
+		_, _, ok := recorder.latest(instance, []string{"ConfigMap/app"}, digests, now)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("ignores the digests of keys the instance doesn't use", func() {
+		recorder.record(instance, change("alice", "ConfigMap/app", now))
+		digests["ConfigMap/app"] = map[string]string{"level": "aaa"}
+
+		latest, _, ok := recorder.latest(instance, []string{"ConfigMap/app"}, digests, now)
+		Expect(ok).To(BeTrue())
+		Expect(latest.manager).To(Equal("alice"))
+	})
+
+	It("doesn't return expired changes", func() {
+		recorder.record(instance, change("alice", "ConfigMap/app", now))
+
+		_, _, ok := recorder.latest(instance, []string{"ConfigMap/app"}, digests, now.Add(changeAttributionTTL+time.Second))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("forgets expired changes when recording", func() {
+		recorder.record(instance, change("alice", "ConfigMap/app", now))
+		recorder.record(instance, change("bob", "Secret/creds", now.Add(changeAttributionTTL+time.Second)))
+
+		Expect(recorder.changes).To(HaveLen(1))
+	})
+
+	It("forgets changes once they have been attributed", func() {
+		recorder.record(instance, change("alice", "ConfigMap/app", now))
+		latest, used, ok := recorder.latest(instance, []string{"ConfigMap/app"}, digests, now)
+		Expect(ok).To(BeTrue())
+
+		recorder.forget(used, latest.time)
+		_, _, ok = recorder.latest(instance, []string{"ConfigMap/app"}, digests, now)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("keeps changes made since they were attributed", func() {
+		recorder.record(instance, change("alice", "ConfigMap/app", now))
+		latest, used, ok := recorder.latest(instance, []string{"ConfigMap/app"}, digests, now)
+		Expect(ok).To(BeTrue())
+
+		recorder.record(instance, change("bob", "ConfigMap/app", now.Add(time.Minute)))
+		recorder.forget(used, latest.time)
+		Expect(recorder.changes).To(HaveLen(1))
+	})
+})
@@ -19,9 +19,13 @@ package core
 import (
 	"context"
 	"fmt"
+	"reflect"
+	"sort"
 	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -36,6 +40,10 @@ type configMetadata struct {
 	required bool
 	allKeys  bool
 	keys     map[string]struct{}
+
+	// requiredKeys are the keys referenced without being marked optional.
+	// They are tracked even once allKeys is set so that they can be validated.
+	requiredKeys map[string]struct{}
 }
 
 // getResult is returned from the getObject method as a helper struct to be
@@ -44,6 +52,18 @@ type getResult struct {
 	err      error
 	obj      Object
 	metadata configMetadata
+	missing  string
+}
+
+// missingChildrenError is returned from getCurrentChildren when required
+// ConfigMaps or Secrets referenced by an instance do not exist
+type missingChildrenError struct {
+	missing []string
+}
+
+// Error implements the error interface
+func (e *missingChildrenError) Error() string {
+	return fmt.Sprintf("required children not found: %s", strings.Join(e.missing, ", "))
 }
 
 // getCurrentChildren returns a list of all Secrets and ConfigMaps that are
@@ -68,10 +88,13 @@ func (h *Handler) getCurrentChildren(obj podController) ([]configObject, error)
 
 	// Range over and collect results from the gets
 	var errs []string
+	var missing []string
 	var children []configObject
 	for i := 0; i < len(configMaps)+len(secrets); i++ {
 		result := <-resultsChan
-		if result.err != nil {
+		if result.missing != "" {
+			missing = append(missing, result.missing)
+		} else if result.err != nil {
 			errs = append(errs, result.err.Error())
 		}
 		if result.obj != nil {
@@ -86,9 +109,16 @@ func (h *Handler) getCurrentChildren(obj podController) ([]configObject, error)
 
 	// If there were any errors, don't return any children
 	if len(errs) > 0 {
+		errs = append(errs, missing...)
 		return []configObject{}, fmt.Errorf("error(s) encountered when geting children: %s", strings.Join(errs, ", "))
 	}
 
+	// If only required children were missing, return an error listing them
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return []configObject{}, &missingChildrenError{missing: missing}
+	}
+
 	// No errors, return the list of children
 	return children, nil
 }
@@ -105,28 +135,41 @@ func getChildNamesByType(obj podController) (map[string]configMetadata, map[stri
 	// and Secrets
 	for _, vol := range obj.GetPodTemplate().Spec.Volumes {
 		if cm := vol.VolumeSource.ConfigMap; cm != nil {
-			configMaps[cm.Name] = configMetadata{required: true, allKeys: true}
+			configMaps[cm.Name] = parseItems(configMaps[cm.Name], cm.Items, cm.Optional)
 		}
 		if s := vol.VolumeSource.Secret; s != nil {
-			secrets[s.SecretName] = configMetadata{required: true, allKeys: true}
+			secrets[s.SecretName] = parseItems(secrets[s.SecretName], s.Items, s.Optional)
+		}
+
+		// Projected volumes may combine several ConfigMaps and Secrets, each
+		// optionally selecting individual items
+		if projected := vol.VolumeSource.Projected; projected != nil {
+			for _, source := range projected.Sources {
+				if cm := source.ConfigMap; cm != nil {
+					configMaps[cm.Name] = parseItems(configMaps[cm.Name], cm.Items, cm.Optional)
+				}
+				if s := source.Secret; s != nil {
+					secrets[s.Name] = parseItems(secrets[s.Name], s.Items, s.Optional)
+				}
+			}
 		}
 	}
 
 	// Range through all Containers and their respective EnvFrom,
 	// then check the EnvFromSources for ConfigMaps and Secrets
-	for _, container := range obj.GetPodTemplate().Spec.Containers {
+	for _, container := range getContainers(obj.GetPodTemplate()) {
 		for _, env := range container.EnvFrom {
 			if cm := env.ConfigMapRef; cm != nil {
-				configMaps[cm.Name] = configMetadata{required: true, allKeys: true}
+				configMaps[cm.Name] = parseAllKeysRef(configMaps[cm.Name], cm.Optional)
 			}
 			if s := env.SecretRef; s != nil {
-				secrets[s.Name] = configMetadata{required: true, allKeys: true}
+				secrets[s.Name] = parseAllKeysRef(secrets[s.Name], s.Optional)
 			}
 		}
 	}
 
 	// Range through all Containers and their respective Env
-	for _, container := range obj.GetPodTemplate().Spec.Containers {
+	for _, container := range getContainers(obj.GetPodTemplate()) {
 		for _, env := range container.Env {
 			if valFrom := env.ValueFrom; valFrom != nil {
 				if cm := valFrom.ConfigMapKeyRef; cm != nil {
@@ -142,34 +185,89 @@ func getChildNamesByType(obj podController) (map[string]configMetadata, map[stri
 	return configMaps, secrets
 }
 
+// getContainers returns the InitContainers and Containers of the PodTemplate
+// so that references from either are discovered.
+// EphemeralContainers are not part of the PodSpec in the Kubernetes API
+// version Wave is built against, so they cannot be inspected here.
+func getContainers(template *corev1.PodTemplateSpec) []corev1.Container {
+	containers := make([]corev1.Container, 0, len(template.Spec.InitContainers)+len(template.Spec.Containers))
+	containers = append(containers, template.Spec.InitContainers...)
+	return append(containers, template.Spec.Containers...)
+}
+
+// parseAllKeysRef updates the metadata for a ConfigMap or Secret that is
+// referenced in its entirety (i.e. via an EnvFrom or a Volume).
+// The object is required if any reference to it is not optional.
+func parseAllKeysRef(metadata configMetadata, optional *bool) configMetadata {
+	return configMetadata{
+		required:     metadata.required || !isOptional(optional),
+		allKeys:      true,
+		requiredKeys: metadata.requiredKeys,
+	}
+}
+
+// parseItems updates the metadata for a ConfigMap or Secret mounted as a
+// volume or projection to include the keys selected by its items.
+// A volume without any items includes all keys of the source.
+func parseItems(metadata configMetadata, items []corev1.KeyToPath, optional *bool) configMetadata {
+	if len(items) == 0 {
+		return parseAllKeysRef(metadata, optional)
+	}
+	keys := make([]string, 0, len(items))
+	for _, item := range items {
+		keys = append(keys, item.Key)
+	}
+	return parseKeys(metadata, keys, optional)
+}
+
 // parseConfigMapKeyRef updates the metadata for a ConfigMap to include the keys specified in this ConfigMapKeySelector
 func parseConfigMapKeyRef(metadata configMetadata, cm *corev1.ConfigMapKeySelector) configMetadata {
-	if !metadata.allKeys {
-		if metadata.keys == nil {
-			metadata.keys = make(map[string]struct{})
-		}
-		if cm.Optional == nil || !*cm.Optional {
-			metadata.required = true
-		}
-		metadata.keys[cm.Key] = struct{}{}
-	}
-	return metadata
+	return parseKeys(metadata, []string{cm.Key}, cm.Optional)
 }
 
 // parseSecretKeyRef updates the metadata for a Secret to include the keys specified in this SecretKeySelector
 func parseSecretKeyRef(metadata configMetadata, s *corev1.SecretKeySelector) configMetadata {
+	return parseKeys(metadata, []string{s.Key}, s.Optional)
+}
+
+// parseKeys updates the metadata for a ConfigMap or Secret to include the
+// given keys.
+// Once any reference includes all keys, individual keys are no longer tracked
+// so the result is independent of the order in which references are parsed.
+func parseKeys(metadata configMetadata, keys []string, optional *bool) configMetadata {
+	if !isOptional(optional) {
+		metadata.required = true
+		if metadata.requiredKeys == nil {
+			metadata.requiredKeys = make(map[string]struct{})
+		}
+		for _, key := range keys {
+			metadata.requiredKeys[key] = struct{}{}
+		}
+	}
 	if !metadata.allKeys {
 		if metadata.keys == nil {
 			metadata.keys = make(map[string]struct{})
 		}
-		if s.Optional == nil || !*s.Optional {
-			metadata.required = true
+		for _, key := range keys {
+			metadata.keys[key] = struct{}{}
 		}
-		metadata.keys[s.Key] = struct{}{}
 	}
 	return metadata
 }
 
+// isOptional returns true if the reference has been marked as optional
+func isOptional(optional *bool) bool {
+	return optional != nil && *optional
+}
+
+// childReader returns the Reader used to fetch ConfigMaps and Secrets
+func (h *Handler) childReader() client.Reader {
+	if h.options.DigestCache != nil {
+		return h.options.DigestCache
+	}
+	return h.Client
+}
+
 // getConfigMap gets a ConfigMap with the given name and namespace from the
 // API server.
 func (h *Handler) getConfigMap(namespace, name string, metadata configMetadata) getResult {
@@ -186,31 +284,39 @@ func (h *Handler) getSecret(namespace, name string, metadata configMetadata) get
 // server
 func (h *Handler) getObject(namespace, name string, metadata configMetadata, obj Object) getResult {
 	objectName := types.NamespacedName{Namespace: namespace, Name: name}
-	err := h.Get(context.TODO(), objectName, obj)
+	start := time.Now()
+	err := h.childReader().Get(context.TODO(), objectName, obj)
+	observeFetch(obj, start)
 	if err != nil {
-		if metadata.required {
+		if !errors.IsNotFound(err) {
 			return getResult{err: err}
 		}
+		if metadata.required {
+			return getResult{err: err, missing: fmt.Sprintf("%s/%s", reflect.TypeOf(obj).Elem().Name(), name)}
+		}
+		// Optional children that don't exist are left out of the hash
 		return getResult{metadata: metadata}
 	}
 	return getResult{obj: obj, metadata: metadata}
 }
 
 // getExistingChildren returns a list of all Secrets and ConfigMaps that are
-// owned by the Deployment instance
+// owned by the Deployment instance.
+// The owner UID indexes registered by IndexOwners must be present.
 func (h *Handler) getExistingChildren(obj podController) ([]Object, error) {
 	inNamespace := client.InNamespace(obj.GetNamespace())
+	ownedBy := client.MatchingField(ownerUIDIndexField, string(obj.GetUID()))
 
-	// List all ConfigMaps in the Deployment's namespace
+	// List the ConfigMaps in the Deployment's namespace owned by the Deployment
 	configMaps := &corev1.ConfigMapList{}
-	err := h.List(context.TODO(), configMaps, inNamespace)
+	err := h.childReader().List(context.TODO(), configMaps, inNamespace, ownedBy)
 	if err != nil {
 		return []Object{}, fmt.Errorf("error listing ConfigMaps: %v", err)
 	}
 
-	// List all Secrets in the Deployment's namespcae
+	// List the Secrets in the Deployment's namespace owned by the Deployment
 	secrets := &corev1.SecretList{}
-	err = h.List(context.TODO(), secrets, inNamespace)
+	err = h.childReader().List(context.TODO(), secrets, inNamespace, ownedBy)
 	if err != nil {
 		return []Object{}, fmt.Errorf("error listing Secrets: %v", err)
 	}
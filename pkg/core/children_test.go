@@ -17,6 +17,8 @@ limitations under the License.
 package core
 
 import (
+	"context"
+	"fmt"
 	"sync"
 	"time"
 
@@ -25,7 +27,10 @@ import (
 	"github.com/pusher/wave/test/utils"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
@@ -55,6 +60,7 @@ var _ = Describe("Wave children Suite", func() {
 	BeforeEach(func() {
 		mgr, err := manager.New(cfg, manager.Options{})
 		Expect(err).NotTo(HaveOccurred())
+		Expect(IndexOwners(mgr.GetFieldIndexer())).To(Succeed())
 		c = mgr.GetClient()
 		h = NewHandler(c, mgr.GetEventRecorderFor("wave"))
 		m = utils.Matcher{Client: c}
@@ -202,6 +208,18 @@ var _ = Describe("Wave children Suite", func() {
 			Expect(err).To(HaveOccurred())
 			Expect(current).To(BeEmpty())
 		})
+
+		It("lists the missing children in the returned error", func() {
+			// Delete s2 and cm2 and wait for the cache to sync
+			m.Delete(s2).Should(Succeed())
+			m.Delete(cm2).Should(Succeed())
+			m.Get(s2, timeout).ShouldNot(Succeed())
+			m.Get(cm2, timeout).ShouldNot(Succeed())
+
+			_, err := h.getCurrentChildren(podControllerDeployment)
+			Expect(err).To(BeAssignableToTypeOf(&missingChildrenError{}))
+			Expect(err.(*missingChildrenError).missing).To(Equal([]string{"ConfigMap/example2", "Secret/example2"}))
+		})
 	})
 
 	Context("getChildNamesByType", func() {
@@ -213,7 +231,13 @@ var _ = Describe("Wave children Suite", func() {
 		})
 
 		It("returns ConfigMaps referenced in Volumes", func() {
-			Expect(configMaps).To(HaveKeyWithValue(cm1.GetName(), configMetadata{required: true, allKeys: true}))
+			Expect(configMaps).To(HaveKeyWithValue(cm1.GetName(), configMetadata{
+				required: true,
+				allKeys:  true,
+				requiredKeys: map[string]struct{}{
+					"key1": {},
+				},
+			}))
 		})
 
 		It("returns ConfigMaps referenced in EnvFrom", func() {
@@ -229,11 +253,21 @@ var _ = Describe("Wave children Suite", func() {
 					"key2": {},
 					"key4": {},
 				},
+				requiredKeys: map[string]struct{}{
+					"key1": {},
+					"key2": {},
+				},
 			}))
 		})
 
 		It("returns Secrets referenced in Volumes", func() {
-			Expect(secrets).To(HaveKeyWithValue(s1.GetName(), configMetadata{required: true, allKeys: true}))
+			Expect(secrets).To(HaveKeyWithValue(s1.GetName(), configMetadata{
+				required: true,
+				allKeys:  true,
+				requiredKeys: map[string]struct{}{
+					"key1": {},
+				},
+			}))
 		})
 
 		It("returns Secrets referenced in EnvFrom", func() {
@@ -249,6 +283,10 @@ var _ = Describe("Wave children Suite", func() {
 					"key2": {},
 					"key4": {},
 				},
+				requiredKeys: map[string]struct{}{
+					"key1": {},
+					"key2": {},
+				},
 			}))
 		})
 
@@ -256,6 +294,400 @@ var _ = Describe("Wave children Suite", func() {
 			Expect(configMaps).To(HaveLen(4))
 			Expect(secrets).To(HaveLen(4))
 		})
+
+		It("returns children referenced by InitContainers", func() {
+			initDeployment := utils.ExampleDeployment.DeepCopy()
+			initDeployment.Spec.Template.Spec.InitContainers = initDeployment.Spec.Template.Spec.Containers
+			initDeployment.Spec.Template.Spec.Containers = []corev1.Container{
+				{
+					Name:  "container",
+					Image: "container",
+				},
+			}
+
+			initConfigMaps, initSecrets := getChildNamesByType(&deployment{initDeployment})
+			Expect(initConfigMaps).To(Equal(configMaps))
+			Expect(initSecrets).To(Equal(secrets))
+		})
+
+		It("merges keys referenced by InitContainers and Containers", func() {
+			initDeployment := utils.ExampleDeployment.DeepCopy()
+			initDeployment.Spec.Template.Spec.InitContainers = []corev1.Container{
+				{
+					Name:  "migrate",
+					Image: "migrate",
+					Env: []corev1.EnvVar{
+						{
+							Name: "DB_PASSWORD",
+							ValueFrom: &corev1.EnvVarSource{
+								SecretKeyRef: &corev1.SecretKeySelector{
+									LocalObjectReference: corev1.LocalObjectReference{
+										Name: s3.GetName(),
+									},
+									Key: "key3",
+								},
+							},
+						},
+					},
+				},
+			}
+
+			_, initSecrets := getChildNamesByType(&deployment{initDeployment})
+			Expect(initSecrets).To(HaveKeyWithValue(s3.GetName(), configMetadata{
+				required: true,
+				allKeys:  false,
+				keys: map[string]struct{}{
+					"key1": {},
+					"key2": {},
+					"key3": {},
+					"key4": {},
+				},
+				requiredKeys: map[string]struct{}{
+					"key1": {},
+					"key2": {},
+					"key3": {},
+				},
+			}))
+		})
+
+		Context("with volume items", func() {
+			var itemsDeployment *appsv1.Deployment
+
+			BeforeEach(func() {
+				itemsDeployment = utils.ExampleDeployment.DeepCopy()
+
+				// Only reference example1 through the volumes
+				itemsDeployment.Spec.Template.Spec.Containers[0].Env = nil
+				itemsDeployment.Spec.Template.Spec.Containers[0].EnvFrom = nil
+				for _, vol := range itemsDeployment.Spec.Template.Spec.Volumes {
+					items := []corev1.KeyToPath{
+						{
+							Key:  "key3",
+							Path: "key3",
+						},
+					}
+					if vol.VolumeSource.ConfigMap != nil {
+						vol.VolumeSource.ConfigMap.Items = items
+					}
+					if vol.VolumeSource.Secret != nil {
+						vol.VolumeSource.Secret.Items = items
+					}
+				}
+			})
+
+			It("returns only the selected keys", func() {
+				itemsConfigMaps, itemsSecrets := getChildNamesByType(&deployment{itemsDeployment})
+				Expect(itemsConfigMaps).To(HaveKeyWithValue(cm1.GetName(), configMetadata{
+					required: true,
+					allKeys:  false,
+					keys: map[string]struct{}{
+						"key3": {},
+					},
+					requiredKeys: map[string]struct{}{
+						"key3": {},
+					},
+				}))
+				Expect(itemsSecrets).To(HaveKeyWithValue(s1.GetName(), configMetadata{
+					required: true,
+					allKeys:  false,
+					keys: map[string]struct{}{
+						"key3": {},
+					},
+					requiredKeys: map[string]struct{}{
+						"key3": {},
+					},
+				}))
+			})
+
+			It("merges the selected keys with keys referenced in Env", func() {
+				container := &itemsDeployment.Spec.Template.Spec.Containers[0]
+				container.Env = append(container.Env, corev1.EnvVar{
+					Name: "example1_key1",
+					ValueFrom: &corev1.EnvVarSource{
+						ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{
+								Name: cm1.GetName(),
+							},
+							Key: "key1",
+						},
+					},
+				})
+
+				itemsConfigMaps, _ := getChildNamesByType(&deployment{itemsDeployment})
+				Expect(itemsConfigMaps).To(HaveKeyWithValue(cm1.GetName(), configMetadata{
+					required: true,
+					allKeys:  false,
+					keys: map[string]struct{}{
+						"key1": {},
+						"key3": {},
+					},
+					requiredKeys: map[string]struct{}{
+						"key1": {},
+						"key3": {},
+					},
+				}))
+			})
+
+			It("includes all keys if any reference includes all keys", func() {
+				container := &itemsDeployment.Spec.Template.Spec.Containers[0]
+				container.EnvFrom = append(container.EnvFrom, corev1.EnvFromSource{
+					ConfigMapRef: &corev1.ConfigMapEnvSource{
+						LocalObjectReference: corev1.LocalObjectReference{
+							Name: cm1.GetName(),
+						},
+					},
+				})
+
+				itemsConfigMaps, _ := getChildNamesByType(&deployment{itemsDeployment})
+				Expect(itemsConfigMaps).To(HaveKeyWithValue(cm1.GetName(), configMetadata{
+					required: true,
+					allKeys:  true,
+					requiredKeys: map[string]struct{}{
+						"key3": {},
+					},
+				}))
+			})
+
+			It("includes all keys regardless of reference ordering", func() {
+				itemsDeployment.Spec.Template.Spec.Volumes = append(itemsDeployment.Spec.Template.Spec.Volumes, corev1.Volume{
+					Name: "configmap1-all",
+					VolumeSource: corev1.VolumeSource{
+						ConfigMap: &corev1.ConfigMapVolumeSource{
+							LocalObjectReference: corev1.LocalObjectReference{
+								Name: cm1.GetName(),
+							},
+						},
+					},
+				}, corev1.Volume{
+					Name: "configmap1-items",
+					VolumeSource: corev1.VolumeSource{
+						ConfigMap: &corev1.ConfigMapVolumeSource{
+							LocalObjectReference: corev1.LocalObjectReference{
+								Name: cm1.GetName(),
+							},
+							Items: []corev1.KeyToPath{
+								{
+									Key:  "key2",
+									Path: "key2",
+								},
+							},
+						},
+					},
+				})
+
+				itemsConfigMaps, _ := getChildNamesByType(&deployment{itemsDeployment})
+				Expect(itemsConfigMaps).To(HaveKeyWithValue(cm1.GetName(), configMetadata{
+					required: true,
+					allKeys:  true,
+					requiredKeys: map[string]struct{}{
+						"key2": {},
+						"key3": {},
+					},
+				}))
+			})
+		})
+
+		Context("with a projected volume", func() {
+			var projectedConfigMaps map[string]configMetadata
+			var projectedSecrets map[string]configMetadata
+
+			BeforeEach(func() {
+				optional := true
+				projectedDeployment := utils.ExampleDeployment.DeepCopy()
+				// Only reference example1 in its entirety through the projection
+				projectedDeployment.Spec.Template.Spec.Containers[0].EnvFrom = nil
+				projectedDeployment.Spec.Template.Spec.Volumes = []corev1.Volume{
+					{
+						Name: "projected",
+						VolumeSource: corev1.VolumeSource{
+							Projected: &corev1.ProjectedVolumeSource{
+								Sources: []corev1.VolumeProjection{
+									{
+										ConfigMap: &corev1.ConfigMapProjection{
+											LocalObjectReference: corev1.LocalObjectReference{
+												Name: cm1.GetName(),
+											},
+										},
+									},
+									{
+										ConfigMap: &corev1.ConfigMapProjection{
+											LocalObjectReference: corev1.LocalObjectReference{
+												Name: cm4.GetName(),
+											},
+											Items: []corev1.KeyToPath{
+												{
+													Key:  "key2",
+													Path: "key2",
+												},
+											},
+											Optional: &optional,
+										},
+									},
+									{
+										Secret: &corev1.SecretProjection{
+											LocalObjectReference: corev1.LocalObjectReference{
+												Name: s1.GetName(),
+											},
+											Items: []corev1.KeyToPath{
+												{
+													Key:  "key1",
+													Path: "key1",
+												},
+												{
+													Key:  "key2",
+													Path: "key2",
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				}
+
+				projectedConfigMaps, projectedSecrets = getChildNamesByType(&deployment{projectedDeployment})
+			})
+
+			It("returns ConfigMaps projected without items", func() {
+				Expect(projectedConfigMaps).To(HaveKeyWithValue(cm1.GetName(), configMetadata{
+					required: true,
+					allKeys:  true,
+					requiredKeys: map[string]struct{}{
+						"key1": {},
+					},
+				}))
+			})
+
+			It("returns optional ConfigMaps projected with items", func() {
+				Expect(projectedConfigMaps).To(HaveKeyWithValue(cm4.GetName(), configMetadata{
+					required: false,
+					allKeys:  false,
+					keys: map[string]struct{}{
+						"key1": {},
+						"key2": {},
+					},
+				}))
+			})
+
+			It("returns Secrets projected with items", func() {
+				Expect(projectedSecrets).To(HaveKeyWithValue(s1.GetName(), configMetadata{
+					required: true,
+					allKeys:  false,
+					keys: map[string]struct{}{
+						"key1": {},
+						"key2": {},
+					},
+					requiredKeys: map[string]struct{}{
+						"key1": {},
+						"key2": {},
+					},
+				}))
+			})
+		})
+
+		It("returns the same children for a CronJob with the same Job template", func() {
+			cronjobConfigMaps, cronjobSecrets := getChildNamesByType(&cronjob{utils.ExampleCronJob.DeepCopy()})
+			Expect(cronjobConfigMaps).To(Equal(configMaps))
+			Expect(cronjobSecrets).To(Equal(secrets))
+		})
+
+		It("returns the same children for a custom resource with the same template", func() {
+			workload := &unstructuredPodController{utils.ExampleWorkload.DeepCopy(), []string{"spec", "template"}}
+			workloadConfigMaps, workloadSecrets := getChildNamesByType(workload)
+			Expect(workloadConfigMaps).To(Equal(configMaps))
+			Expect(workloadSecrets).To(Equal(secrets))
+		})
+	})
+
+	Context("with optional references", func() {
+		var optionalDeployment *appsv1.Deployment
+		var optionalCM *corev1.ConfigMap
+
+		BeforeEach(func() {
+			optional := true
+			optionalCM = utils.ExampleConfigMap1.DeepCopy()
+			optionalCM.SetName("optional")
+
+			optionalDeployment = utils.ExampleDeployment.DeepCopy()
+			optionalDeployment.Spec.Template.Spec.Volumes = append(optionalDeployment.Spec.Template.Spec.Volumes, corev1.Volume{
+				Name: "optional-configmap",
+				VolumeSource: corev1.VolumeSource{
+					ConfigMap: &corev1.ConfigMapVolumeSource{
+						LocalObjectReference: corev1.LocalObjectReference{
+							Name: optionalCM.GetName(),
+						},
+						Optional: &optional,
+					},
+				},
+			})
+			container := &optionalDeployment.Spec.Template.Spec.Containers[0]
+			container.EnvFrom = append(container.EnvFrom, corev1.EnvFromSource{
+				SecretRef: &corev1.SecretEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: "optional",
+					},
+					Optional: &optional,
+				},
+			})
+		})
+
+		It("marks optional Volumes and EnvFrom sources as not required", func() {
+			configMaps, secrets := getChildNamesByType(&deployment{optionalDeployment})
+			Expect(configMaps).To(HaveKeyWithValue("optional", configMetadata{required: false, allKeys: true}))
+			Expect(secrets).To(HaveKeyWithValue("optional", configMetadata{required: false, allKeys: true}))
+		})
+
+		It("marks a child as required if any reference to it is required", func() {
+			container := &optionalDeployment.Spec.Template.Spec.Containers[0]
+			container.Env = append(container.Env, corev1.EnvVar{
+				Name: "optional_key1",
+				ValueFrom: &corev1.EnvVarSource{
+					ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{
+							Name: "optional",
+						},
+						Key: "key1",
+					},
+				},
+			})
+
+			configMaps, _ := getChildNamesByType(&deployment{optionalDeployment})
+			Expect(configMaps).To(HaveKeyWithValue("optional", configMetadata{
+				required: true,
+				allKeys:  true,
+				requiredKeys: map[string]struct{}{
+					"key1": {},
+				},
+			}))
+		})
+
+		It("does not return an error when optional children are missing", func() {
+			current, err := h.getCurrentChildren(&deployment{optionalDeployment})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(current).To(HaveLen(8))
+		})
+
+		It("returns optional children once they exist", func() {
+			m.Create(optionalCM).Should(Succeed())
+			m.Get(optionalCM, timeout).Should(Succeed())
+
+			current, err := h.getCurrentChildren(&deployment{optionalDeployment})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(current).To(ContainElement(configObject{
+				object:   optionalCM,
+				required: false,
+				allKeys:  true,
+			}))
+		})
+
+		It("returns an error when optional children can't be fetched", func() {
+			h = NewHandler(&failingGetClient{Client: c, name: optionalCM.GetName()}, nil)
+
+			_, err := h.getCurrentChildren(&deployment{optionalDeployment})
+			Expect(err).To(HaveOccurred())
+			Expect(err).NotTo(BeAssignableToTypeOf(&missingChildrenError{}))
+		})
 	})
 
 	Context("getExistingChildren", func() {
@@ -298,6 +730,52 @@ var _ = Describe("Wave children Suite", func() {
 		It("does not return duplicate children", func() {
 			Expect(existingChildren).To(HaveLen(2))
 		})
+
+		It("only lists the children owned by the instance", func() {
+			counter := &countingListClient{Client: c}
+			h = NewHandler(counter, nil)
+
+			_, err := h.getExistingChildren(podControllerDeployment)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(counter.listed).To(Equal(2))
+		})
+	})
+
+	Context("getExistingChildren performance", func() {
+		const samples = 5
+
+		for _, size := range []int{0, 50, 250} {
+			unrelated := size
+
+			Context(fmt.Sprintf("With %d unrelated ConfigMaps and Secrets in the namespace", unrelated), func() {
+				BeforeEach(func() {
+					var cm *corev1.ConfigMap
+					var s *corev1.Secret
+					for i := 0; i < unrelated; i++ {
+						cm = utils.ExampleConfigMap1.DeepCopy()
+						cm.SetName(fmt.Sprintf("unrelated-%d", i))
+						m.Create(cm).Should(Succeed())
+
+						s = utils.ExampleSecret1.DeepCopy()
+						s.SetName(fmt.Sprintf("unrelated-%d", i))
+						m.Create(s).Should(Succeed())
+					}
+
+					// Ensure the caches have synced
+					if unrelated > 0 {
+						m.Get(cm, timeout).Should(Succeed())
+						m.Get(s, timeout).Should(Succeed())
+					}
+				})
+
+				Measure("lists the existing children", func(b Benchmarker) {
+					b.Time("getExistingChildren", func() {
+						_, err := h.getExistingChildren(podControllerDeployment)
+						Expect(err).NotTo(HaveOccurred())
+					})
+				}, samples)
+			})
+		}
 	})
 
 	Context("isOwnedBy", func() {
@@ -327,3 +805,36 @@ var _ = Describe("Wave children Suite", func() {
 	})
 
 })
+
+// failingGetClient fails to get any object with the given name with an error
+// other than NotFound
+type failingGetClient struct {
+	client.Client
+	name string
+}
+
+func (f *failingGetClient) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	if key.Name == f.name {
+		return errors.NewInternalError(fmt.Errorf("unavailable"))
+	}
+	return f.Client.Get(ctx, key, obj)
+}
+
+// countingListClient counts the objects returned by each List call
+type countingListClient struct {
+	client.Client
+	listed int
+}
+
+func (c *countingListClient) List(ctx context.Context, list runtime.Object, opts ...client.ListOptionFunc) error {
+	err := c.Client.List(ctx, list, opts...)
+	if err != nil {
+		return err
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return err
+	}
+	c.listed += len(items)
+	return nil
+}
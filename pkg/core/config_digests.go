@@ -0,0 +1,338 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// configDigestLength is the number of hex characters of each key's digest
+	// that are recorded. It is enough to detect changes without recording the
+	// full digest of every value.
+	configDigestLength = 12
+
+	// maxConfigValueLength is the number of bytes of each ConfigMap value
+	// recorded when ConfigMap value diffs are enabled
+	maxConfigValueLength = 64
+
+	// maxConfigChanges is the number of changes listed in a ConfigChanged
+	// Event
+	maxConfigChanges = 20
+
+	// maxConfigKeysLength is the number of bytes the config digests and
+	// values annotations may each hold. All of an object's annotations must
+	// fit in 256KB, so larger ones are not recorded.
+	maxConfigKeysLength = 32 * 1024
+)
+
+// configKeys maps the kind and name of each child, for example
+// "ConfigMap/app", to a value for each of its keys
+type configKeys map[string]map[string]string
+
+// getConfigDigests returns a digest of each key of the children used by the
+// configuration hash.
+// The digests are calculated with the config digests key from the SHA256
+// digest of each value, so they are the same whether or not the children
+// were read from the DigestCache and can't be used to confirm guesses of
+// Secret values.
+func (h *Handler) getConfigDigests(children []configObject) configKeys {
+	digests := make(configKeys)
+	for _, child := range children {
+		if child.object == nil {
+			continue
+		}
+		digests[childName(child.object)] = h.getChildDigests(child, h.digested())
+	}
+	return digests
+}
+
+// getChildDigests returns a digest of each key of the child used by the
+// configuration hash.
+// digested is true when the child was read from the DigestCache.
+func (h *Handler) getChildDigests(child configObject, digested bool) map[string]string {
+	key := h.configDigestsKey()
+	digest := func(valueDigests map[string]string) map[string]string {
+		digests := make(map[string]string, len(valueDigests))
+		for name, valueDigest := range valueDigests {
+			digests[name] = digestHashSource([]byte(valueDigest), key)[:configDigestLength]
+		}
+		return digests
+	}
+
+	switch child.object.(type) {
+	case *corev1.ConfigMap:
+		keys := digest(getStringDigests(getConfigMapData(child), digested))
+		for name, value := range digest(getBytesDigests(getConfigMapBinaryData(child), digested)) {
+			keys[name] = value
+		}
+		return keys
+	case *corev1.Secret:
+		return digest(getBytesDigests(getSecretData(child), digested))
+	default:
+		return map[string]string{}
+	}
+}
+
+// configDigestsKey returns the key config digests are calculated with
+func (h *Handler) configDigestsKey() []byte {
+	if len(h.options.ConfigDigestsKey) > 0 {
+		return h.options.ConfigDigestsKey
+	}
+	return generatedConfigDigestsKey
+}
+
+// getConfigDigestsKey identifies the key that config digests are calculated
+// with, without revealing it
+func (h *Handler) getConfigDigestsKey() string {
+	return digestHashSource([]byte(ConfigDigestsKeyAnnotation), h.configDigestsKey())[:configDigestLength]
+}
+
+// getConfigValues returns the value of each ConfigMap key used by the
+// configuration hash, truncated to maxConfigValueLength.
+// Secret values are never returned.
+func getConfigValues(children []configObject) configKeys {
+	values := make(configKeys)
+	for _, child := range children {
+		if _, ok := child.object.(*corev1.ConfigMap); !ok {
+			continue
+		}
+		keys := make(map[string]string)
+		for key, value := range getConfigMapData(child) {
+			keys[key] = truncateValue(value)
+		}
+		values[childName(child.object)] = keys
+	}
+	return values
+}
+
+// truncateValue shortens the value to maxConfigValueLength bytes without
+// splitting a character
+func truncateValue(value string) string {
+	if len(value) <= maxConfigValueLength {
+		return value
+	}
+	end := maxConfigValueLength
+	for end > 0 && !utf8.RuneStart(value[end]) {
+		end--
+	}
+	return value[:end] + "..."
+}
+
+// childName returns the kind and name of the child, for example
+// "ConfigMap/app"
+func childName(child Object) string {
+	return fmt.Sprintf("%s/%s", kindOf(child), child.GetName())
+}
+
+// getConfigKeys parses the annotation with the given key on the instance.
+// It returns nil if the annotation is missing or can't be parsed.
+func getConfigKeys(obj podController, annotation string) configKeys {
+	value, ok := obj.GetAnnotations()[annotation]
+	if !ok {
+		return nil
+	}
+	keys := configKeys{}
+	if err := json.Unmarshal([]byte(value), &keys); err != nil {
+		return nil
+	}
+	return keys
+}
+
+// setConfigKeys sets the annotation with the given key on the instance, or
+// removes it if keys is nil or would be longer than maxConfigKeysLength
+func setConfigKeys(obj podController, annotation string, keys configKeys) error {
+	var value []byte
+	if keys != nil {
+		var err error
+		value, err = json.Marshal(keys)
+		if err != nil {
+			return fmt.Errorf("unable to marshal JSON: %v", err)
+		}
+	}
+
+	annotations := obj.GetAnnotations()
+	if value == nil || len(value) > maxConfigKeysLength {
+		if _, ok := annotations[annotation]; ok {
+			delete(annotations, annotation)
+			obj.SetAnnotations(annotations)
+		}
+		return nil
+	}
+
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[annotation] = string(value)
+	obj.SetAnnotations(annotations)
+	return nil
+}
+
+// setConfigSummary records the digests, and the ConfigMap values when
+// enabled, of the children on the instance so that the next configuration
+// change can be summarised
+func (h *Handler) setConfigSummary(obj podController, children []configObject) error {
+	if err := setConfigKeys(obj, ConfigDigestsAnnotation, h.getConfigDigests(children)); err != nil {
+		return err
+	}
+
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[ConfigDigestsKeyAnnotation] = h.getConfigDigestsKey()
+	obj.SetAnnotations(annotations)
+
+	var values configKeys
+	if h.options.ConfigMapValueDiffs {
+		values = getConfigValues(children)
+	}
+	return setConfigKeys(obj, ConfigValuesAnnotation, values)
+}
+
+// summarizeConfigChanges lists the children and keys that were added, removed
+// or changed between the recorded digests and the current children.
+// ConfigMap values are included when both old and new values are given.
+func summarizeConfigChanges(oldDigests, newDigests, oldValues, newValues configKeys) []string {
+	changes := []string{}
+	for _, child := range sortedChildren(oldDigests, newDigests) {
+		oldKeys, existed := oldDigests[child]
+		newKeys, exists := newDigests[child]
+		switch {
+		case !existed:
+			changes = append(changes, fmt.Sprintf("%s added", child))
+			continue
+		case !exists:
+			changes = append(changes, fmt.Sprintf("%s removed", child))
+			continue
+		}
+
+		for _, key := range sortedKeys(oldKeys, newKeys) {
+			oldDigest, existed := oldKeys[key]
+			newDigest, exists := newKeys[key]
+			switch {
+			case !existed:
+				changes = append(changes, fmt.Sprintf("%s[%s] added", child, key))
+			case !exists:
+				changes = append(changes, fmt.Sprintf("%s[%s] removed", child, key))
+			case oldDigest != newDigest:
+				oldValue, hasOld := oldValues[child][key]
+				newValue, hasNew := newValues[child][key]
+				if hasOld && hasNew {
+					changes = append(changes, fmt.Sprintf("%s[%s] changed from %q to %q", child, key, oldValue, newValue))
+				} else {
+					changes = append(changes, fmt.Sprintf("%s[%s] changed", child, key))
+				}
+			}
+		}
+	}
+
+	if len(changes) > maxConfigChanges {
+		more := len(changes) - maxConfigChanges
+		changes = append(changes[:maxConfigChanges], fmt.Sprintf("and %d more", more))
+	}
+	return changes
+}
+
+// getComparableDigests returns the config digests recorded on the old and new
+// instances.
+// The old digests are nil when the old instance has no recorded digests, such
+// as when its hash is first set, or when they were calculated with a different
+// hash key, as every digest would then differ.
+func getComparableDigests(old, new podController) (configKeys, configKeys) {
+	if old.GetAnnotations()[ConfigDigestsKeyAnnotation] != new.GetAnnotations()[ConfigDigestsKeyAnnotation] {
+		return nil, getConfigKeys(new, ConfigDigestsAnnotation)
+	}
+	return getConfigKeys(old, ConfigDigestsAnnotation), getConfigKeys(new, ConfigDigestsAnnotation)
+}
+
+// getConfigChanges summarises the changes between the configuration recorded
+// on the old and new instances.
+// Nothing is listed when the old digests can't be compared with the new ones.
+func getConfigChanges(old, new podController) []string {
+	oldDigests, newDigests := getComparableDigests(old, new)
+	if oldDigests == nil {
+		return nil
+	}
+	return summarizeConfigChanges(
+		oldDigests,
+		newDigests,
+		getConfigKeys(old, ConfigValuesAnnotation),
+		getConfigKeys(new, ConfigValuesAnnotation),
+	)
+}
+
+// changedChildren returns the children whose digests differ between old and
+// new, in order
+func changedChildren(oldDigests, newDigests configKeys) []string {
+	changed := []string{}
+	for _, child := range sortedChildren(oldDigests, newDigests) {
+		if !reflect.DeepEqual(oldDigests[child], newDigests[child]) {
+			changed = append(changed, child)
+		}
+	}
+	return changed
+}
+
+// sortedChildren returns the children present in either configKeys in order
+func sortedChildren(a, b configKeys) []string {
+	set := make(map[string]string)
+	for child := range a {
+		set[child] = ""
+	}
+	for child := range b {
+		set[child] = ""
+	}
+	return sortedKeys(set, nil)
+}
+
+// sortedKeys returns the keys present in either map in order
+func sortedKeys(a, b map[string]string) []string {
+	set := make(map[string]struct{})
+	for key := range a {
+		set[key] = struct{}{}
+	}
+	for key := range b {
+		set[key] = struct{}{}
+	}
+	sorted := make([]string, 0, len(set))
+	for key := range set {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// configChangedMessage returns the message of the ConfigChanged Event,
+// listing the changes and who made them when they are known
+func configChangedMessage(hash string, changes []string, triggeredBy string) string {
+	message := fmt.Sprintf("Configuration hash updated to %s", hash)
+	if len(changes) > 0 {
+		message = fmt.Sprintf("%s: %s", message, strings.Join(changes, ", "))
+	}
+	if triggeredBy != "" {
+		message = fmt.Sprintf("%s; triggered by %s", message, triggeredBy)
+	}
+	return message
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// ConfigDigestsKeyName is the key of the config digests key in the Secret
+	// it is stored in
+	ConfigDigestsKeyName = "config-digests.key"
+
+	// configDigestsKeyLength is the number of random bytes in a generated
+	// config digests key
+	configDigestsKeyLength = 32
+
+	// maxConfigDigestsKeyAttempts is how many times storing a generated key
+	// is attempted when other replicas store theirs first
+	maxConfigDigestsKeyAttempts = 3
+)
+
+// generatedConfigDigestsKey is used by Handlers without a ConfigDigestsKey.
+// As it is generated when Wave starts, changes are not summarised across
+// restarts.
+var generatedConfigDigestsKey = mustNewConfigDigestsKey()
+
+// NewConfigDigestsKey generates a random config digests key
+func NewConfigDigestsKey() ([]byte, error) {
+	key := make([]byte, configDigestsKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("error generating config digests key: %v", err)
+	}
+	return key, nil
+}
+
+// mustNewConfigDigestsKey generates a random config digests key and panics if
+// it can't
+func mustNewConfigDigestsKey() []byte {
+	key, err := NewConfigDigestsKey()
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// EnsureConfigDigestsKey returns the config digests key stored in the Secret,
+// generating and storing one if the Secret doesn't hold one yet.
+// When replicas start together, the key stored by the first is used by all.
+func EnsureConfigDigestsKey(c client.Client, name types.NamespacedName) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt < maxConfigDigestsKeyAttempts; attempt++ {
+		var key []byte
+		key, err = ensureConfigDigestsKey(c, name)
+		if err == nil {
+			return key, nil
+		}
+		if !errors.IsAlreadyExists(err) && !errors.IsConflict(err) {
+			break
+		}
+	}
+	return nil, fmt.Errorf("error storing config digests key in Secret %s: %v", name, err)
+}
+
+// ensureConfigDigestsKey reads the config digests key from the Secret, or
+// generates one and stores it
+func ensureConfigDigestsKey(c client.Client, name types.NamespacedName) ([]byte, error) {
+	secret := &corev1.Secret{}
+	err := c.Get(context.TODO(), name, secret)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	exists := err == nil
+	if key := secret.Data[ConfigDigestsKeyName]; len(key) > 0 {
+		return key, nil
+	}
+
+	key, err := NewConfigDigestsKey()
+	if err != nil {
+		return nil, err
+	}
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	secret.Data[ConfigDigestsKeyName] = key
+	if exists {
+		err = c.Update(context.TODO(), secret)
+	} else {
+		secret.ObjectMeta = metav1.ObjectMeta{Name: name.Name, Namespace: name.Namespace}
+		err = c.Create(context.TODO(), secret)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pusher/wave/test/utils"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("Wave config digests key Suite", func() {
+	var c client.Client
+	var m utils.Matcher
+	var name types.NamespacedName
+
+	const timeout = time.Second * 5
+
+	BeforeEach(func() {
+		var err error
+		c, err = client.New(cfg, client.Options{Scheme: scheme.Scheme})
+		Expect(err).NotTo(HaveOccurred())
+		m = utils.Matcher{Client: c}
+		name = types.NamespacedName{Name: "wave-config-digests-key", Namespace: "default"}
+	})
+
+	AfterEach(func() {
+		utils.DeleteAll(cfg, timeout, &corev1.SecretList{})
+	})
+
+	It("generates a key and stores it in the Secret", func() {
+		key, err := EnsureConfigDigestsKey(c, name)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(key).To(HaveLen(configDigestsKeyLength))
+
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name.Name, Namespace: name.Namespace}}
+		m.Get(secret, timeout).Should(Succeed())
+		Expect(secret.Data[ConfigDigestsKeyName]).To(Equal(key))
+	})
+
+	It("returns the stored key once it has been generated", func() {
+		key, err := EnsureConfigDigestsKey(c, name)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(EnsureConfigDigestsKey(c, name)).To(Equal(key))
+	})
+
+	It("adds a key to an existing Secret", func() {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name.Name, Namespace: name.Namespace},
+			Data:       map[string][]byte{"other": []byte("value")},
+		}
+		m.Create(secret).Should(Succeed())
+
+		key, err := EnsureConfigDigestsKey(c, name)
+		Expect(err).NotTo(HaveOccurred())
+
+		m.Get(secret, timeout).Should(Succeed())
+		Expect(secret.Data).To(HaveKeyWithValue(ConfigDigestsKeyName, key))
+		Expect(secret.Data).To(HaveKeyWithValue("other", []byte("value")))
+	})
+})
@@ -0,0 +1,217 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pusher/wave/test/utils"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var _ = Describe("Wave config digests Suite", func() {
+	var cm *corev1.ConfigMap
+	var s *corev1.Secret
+	var children []configObject
+
+	BeforeEach(func() {
+		cm = utils.ExampleConfigMap1.DeepCopy()
+		s = utils.ExampleSecret1.DeepCopy()
+		s.Data = map[string][]byte{"key1": []byte("secret1"), "key2": []byte("secret2")}
+		children = []configObject{
+			{object: cm, allKeys: true},
+			{object: s, keys: map[string]struct{}{"key1": {}}},
+		}
+	})
+
+	Context("getConfigDigests", func() {
+		It("digests each key used by the instance", func() {
+			digests := NewHandlerWithOptions(nil, nil, Options{ConfigDigestsKey: []byte("key")}).getConfigDigests(children)
+			Expect(digests).To(HaveKey("ConfigMap/example1"))
+			Expect(digests["ConfigMap/example1"]).To(HaveLen(len(cm.Data)))
+			Expect(digests["Secret/example1"]).To(HaveKey("key1"))
+			Expect(digests["Secret/example1"]).NotTo(HaveKey("key2"))
+			Expect(digests["Secret/example1"]["key1"]).To(HaveLen(configDigestLength))
+		})
+
+		It("digests values with the config digests key", func() {
+			digests := NewHandler(nil, nil).getConfigDigests(children)
+			keyed := NewHandlerWithOptions(nil, nil, Options{ConfigDigestsKey: []byte("key")}).getConfigDigests(children)
+			Expect(keyed["ConfigMap/example1"]["key1"]).NotTo(Equal(digests["ConfigMap/example1"]["key1"]))
+			Expect(keyed["Secret/example1"]["key1"]).NotTo(Equal(digests["Secret/example1"]["key1"]))
+		})
+
+		It("digests Secret values without a configured key", func() {
+			digests := NewHandler(nil, nil).getConfigDigests(children)
+			Expect(digests["Secret/example1"]["key1"]).To(HaveLen(configDigestLength))
+		})
+
+		It("returns the same digests from children read from the DigestCache", func() {
+			cm.BinaryData = map[string][]byte{"binary1": []byte("binary")}
+			digested := []configObject{
+				{object: digestConfigMap(cm), allKeys: true},
+				{object: digestSecret(s), keys: map[string]struct{}{"key1": {}}},
+			}
+
+			h := NewHandlerWithOptions(nil, nil, Options{ConfigDigestsKey: []byte("key")})
+			digestHandler := NewHandlerWithOptions(nil, nil, Options{ConfigDigestsKey: []byte("key"), DigestCache: &DigestCache{}})
+			Expect(digestHandler.getConfigDigests(digested)).To(Equal(h.getConfigDigests(children)))
+		})
+	})
+
+	Context("getConfigChanges", func() {
+		var old, new podController
+
+		BeforeEach(func() {
+			old = &deployment{utils.ExampleDeployment.DeepCopy()}
+			new = old.DeepCopy()
+			keyed := NewHandlerWithOptions(nil, nil, Options{ConfigDigestsKey: []byte("key")})
+			Expect(keyed.setConfigSummary(old, children)).To(Succeed())
+			cm.Data["key1"] = "modified"
+		})
+
+		It("lists the changes made with the same config digests key", func() {
+			keyed := NewHandlerWithOptions(nil, nil, Options{ConfigDigestsKey: []byte("key")})
+			Expect(keyed.setConfigSummary(new, children)).To(Succeed())
+			Expect(getConfigChanges(old, new)).To(Equal([]string{"ConfigMap/example1[key1] changed"}))
+		})
+
+		It("lists nothing once the config digests key changes", func() {
+			rotated := NewHandlerWithOptions(nil, nil, Options{ConfigDigestsKey: []byte("rotated")})
+			Expect(rotated.setConfigSummary(new, children)).To(Succeed())
+			Expect(new.GetAnnotations()[ConfigDigestsKeyAnnotation]).NotTo(Equal(old.GetAnnotations()[ConfigDigestsKeyAnnotation]))
+			Expect(getConfigChanges(old, new)).To(BeNil())
+		})
+	})
+
+	Context("setConfigKeys", func() {
+		var obj podController
+
+		BeforeEach(func() {
+			obj = &deployment{utils.ExampleDeployment.DeepCopy()}
+		})
+
+		It("records the keys in the annotation", func() {
+			keys := configKeys{"ConfigMap/app": {"level": "aaa"}}
+			Expect(setConfigKeys(obj, ConfigDigestsAnnotation, keys)).To(Succeed())
+			Expect(getConfigKeys(obj, ConfigDigestsAnnotation)).To(Equal(keys))
+		})
+
+		It("removes the annotation when the keys would be too long", func() {
+			Expect(setConfigKeys(obj, ConfigDigestsAnnotation, configKeys{"ConfigMap/app": {"level": "aaa"}})).To(Succeed())
+
+			keys := configKeys{"ConfigMap/app": {"level": strings.Repeat("a", maxConfigKeysLength)}}
+			Expect(setConfigKeys(obj, ConfigDigestsAnnotation, keys)).To(Succeed())
+			Expect(obj.GetAnnotations()).NotTo(HaveKey(ConfigDigestsAnnotation))
+		})
+	})
+
+	Context("getConfigValues", func() {
+		It("never returns Secret values", func() {
+			values := getConfigValues(children)
+			Expect(values).To(HaveKey("ConfigMap/example1"))
+			Expect(values).NotTo(HaveKey("Secret/example1"))
+		})
+
+		It("truncates long values", func() {
+			cm.Data["key1"] = strings.Repeat("é", maxConfigValueLength)
+			value := getConfigValues(children)["ConfigMap/example1"]["key1"]
+			Expect(value).To(HaveSuffix("..."))
+			Expect(len(value)).To(BeNumerically("<=", maxConfigValueLength+len("...")))
+			Expect(strings.TrimSuffix(value, "...")).To(Equal(strings.Repeat("é", maxConfigValueLength/2)))
+		})
+	})
+
+	Context("summarizeConfigChanges", func() {
+		var old configKeys
+
+		BeforeEach(func() {
+			old = configKeys{
+				"ConfigMap/app": {"level": "aaa", "port": "bbb"},
+				"Secret/creds":  {"password": "ccc"},
+			}
+		})
+
+		It("lists nothing when nothing changed", func() {
+			Expect(summarizeConfigChanges(old, old, nil, nil)).To(BeEmpty())
+		})
+
+		It("lists added, removed and changed keys in order", func() {
+			new := configKeys{
+				"ConfigMap/app": {"level": "ddd", "host": "eee"},
+				"Secret/creds":  {"password": "ccc"},
+			}
+			Expect(summarizeConfigChanges(old, new, nil, nil)).To(Equal([]string{
+				"ConfigMap/app[host] added",
+				"ConfigMap/app[level] changed",
+				"ConfigMap/app[port] removed",
+			}))
+		})
+
+		It("lists added and removed children", func() {
+			new := configKeys{
+				"ConfigMap/app":   {"level": "aaa", "port": "bbb"},
+				"ConfigMap/other": {"key": "fff"},
+			}
+			Expect(summarizeConfigChanges(old, new, nil, nil)).To(Equal([]string{
+				"ConfigMap/other added",
+				"Secret/creds removed",
+			}))
+		})
+
+		It("shows how ConfigMap values changed when they were recorded", func() {
+			new := configKeys{
+				"ConfigMap/app": {"level": "ddd", "port": "bbb"},
+				"Secret/creds":  {"password": "ggg"},
+			}
+			oldValues := configKeys{"ConfigMap/app": {"level": "info", "port": "80"}}
+			newValues := configKeys{"ConfigMap/app": {"level": "debug", "port": "80"}}
+			Expect(summarizeConfigChanges(old, new, oldValues, newValues)).To(Equal([]string{
+				`ConfigMap/app[level] changed from "info" to "debug"`,
+				"Secret/creds[password] changed",
+			}))
+		})
+
+		It("limits the number of changes listed", func() {
+			new := configKeys{"ConfigMap/app": {}}
+			for i := 0; i < maxConfigChanges+5; i++ {
+				new["ConfigMap/app"][strings.Repeat("k", i+1)] = "hhh"
+			}
+			changes := summarizeConfigChanges(configKeys{"ConfigMap/app": {}}, new, nil, nil)
+			Expect(changes).To(HaveLen(maxConfigChanges + 1))
+			Expect(changes[maxConfigChanges]).To(Equal("and 5 more"))
+		})
+	})
+
+	Context("configChangedMessage", func() {
+		It("only includes the hash when nothing is listed", func() {
+			Expect(configChangedMessage("v1:abc", nil, "")).To(Equal("Configuration hash updated to v1:abc"))
+		})
+
+		It("lists the changes", func() {
+			Expect(configChangedMessage("v1:abc", []string{"ConfigMap/app added", "Secret/creds removed"}, "")).To(
+				Equal("Configuration hash updated to v1:abc: ConfigMap/app added, Secret/creds removed"))
+		})
+
+		It("includes who triggered the changes", func() {
+			Expect(configChangedMessage("v1:abc", []string{"ConfigMap/app added"}, "alice")).To(
+				Equal("Configuration hash updated to v1:abc: ConfigMap/app added; triggered by alice"))
+		})
+	})
+})
@@ -50,6 +50,7 @@ var _ = Describe("Wave owner references Suite", func() {
 	BeforeEach(func() {
 		mgr, err := manager.New(cfg, manager.Options{})
 		Expect(err).NotTo(HaveOccurred())
+		Expect(IndexOwners(mgr.GetFieldIndexer())).To(Succeed())
 		c = mgr.GetClient()
 		h = NewHandler(c, mgr.GetEventRecorderFor("wave"))
 		m = utils.Matcher{Client: c}
@@ -0,0 +1,337 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DigestCache caches ConfigMaps and Secrets with the value of each key
+// replaced by its SHA256 digest, so that configuration data is not held in
+// memory and memory use grows with the number of keys rather than the size of
+// their values.
+// Only the metadata Wave needs is kept, as annotations such as
+// kubectl.kubernetes.io/last-applied-configuration can hold the values too.
+//
+// It implements client.Reader for ConfigMaps and Secrets and must be added
+// to the Manager so that it is started with the controllers.
+// Objects read from it must never be written back to the API server.
+type DigestCache struct {
+	clientset  kubernetes.Interface
+	configMaps cache.SharedIndexInformer
+	secrets    cache.SharedIndexInformer
+}
+
+var _ client.Reader = &DigestCache{}
+
+// NewDigestCache constructs a DigestCache for all namespaces using the given
+// config
+func NewDigestCache(cfg *rest.Config, resync time.Duration) (*DigestCache, error) {
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error creating clientset: %v", err)
+	}
+	configMaps := clientset.CoreV1().ConfigMaps(metav1.NamespaceAll)
+	secrets := clientset.CoreV1().Secrets(metav1.NamespaceAll)
+
+	return &DigestCache{
+		clientset: clientset,
+		configMaps: newDigestInformer(&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				list, err := configMaps.List(options)
+				if err != nil {
+					return nil, err
+				}
+				for i := range list.Items {
+					list.Items[i] = *digestConfigMap(&list.Items[i])
+				}
+				return list, nil
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				w, err := configMaps.Watch(options)
+				if err != nil {
+					return nil, err
+				}
+				return watch.Filter(w, digestEvent), nil
+			},
+		}, &corev1.ConfigMap{}, resync),
+		secrets: newDigestInformer(&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				list, err := secrets.List(options)
+				if err != nil {
+					return nil, err
+				}
+				for i := range list.Items {
+					list.Items[i] = *digestSecret(&list.Items[i])
+				}
+				return list, nil
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				w, err := secrets.Watch(options)
+				if err != nil {
+					return nil, err
+				}
+				return watch.Filter(w, digestEvent), nil
+			},
+		}, &corev1.Secret{}, resync),
+	}, nil
+}
+
+// newDigestInformer constructs an informer indexed by namespace and by the
+// UIDs of the owners of its objects
+func newDigestInformer(lw cache.ListerWatcher, obj runtime.Object, resync time.Duration) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(lw, obj, resync, cache.Indexers{
+		cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+		ownerUIDIndexField:   ownerUIDIndexFunc,
+	})
+}
+
+// ownerUIDIndexFunc indexes objects by the namespaced UIDs of their owners
+func ownerUIDIndexFunc(obj interface{}) ([]string, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, ref := range accessor.GetOwnerReferences() {
+		keys = append(keys, accessor.GetNamespace()+"/"+string(ref.UID))
+	}
+	return keys, nil
+}
+
+// digestEvent replaces the object in a watch event with its digest
+func digestEvent(e watch.Event) (watch.Event, bool) {
+	switch o := e.Object.(type) {
+	case *corev1.ConfigMap:
+		e.Object = digestConfigMap(o)
+	case *corev1.Secret:
+		e.Object = digestSecret(o)
+	}
+	return e, true
+}
+
+// digestObjectMeta returns a copy of the identifying metadata of a ConfigMap
+// or Secret and the OwnerReferences used to track it.
+// Annotations are dropped as they may contain the object's values.
+func digestObjectMeta(meta metav1.ObjectMeta) metav1.ObjectMeta {
+	digested := metav1.ObjectMeta{
+		Name:            meta.Name,
+		Namespace:       meta.Namespace,
+		UID:             meta.UID,
+		ResourceVersion: meta.ResourceVersion,
+	}
+	if meta.Labels != nil {
+		digested.Labels = make(map[string]string, len(meta.Labels))
+		for key, value := range meta.Labels {
+			digested.Labels[key] = value
+		}
+	}
+	if meta.OwnerReferences != nil {
+		digested.OwnerReferences = make([]metav1.OwnerReference, len(meta.OwnerReferences))
+		for i := range meta.OwnerReferences {
+			meta.OwnerReferences[i].DeepCopyInto(&digested.OwnerReferences[i])
+		}
+	}
+	return digested
+}
+
+// digestConfigMap returns a copy of the ConfigMap with each value replaced by
+// the hex encoded SHA256 digest of the value
+func digestConfigMap(cm *corev1.ConfigMap) *corev1.ConfigMap {
+	digested := &corev1.ConfigMap{
+		TypeMeta:   cm.TypeMeta,
+		ObjectMeta: digestObjectMeta(cm.ObjectMeta),
+	}
+	if cm.Data != nil {
+		digested.Data = make(map[string]string, len(cm.Data))
+		for key, value := range cm.Data {
+			digested.Data[key] = digestValue([]byte(value))
+		}
+	}
+	if cm.BinaryData != nil {
+		digested.BinaryData = make(map[string][]byte, len(cm.BinaryData))
+		for key, value := range cm.BinaryData {
+			digest := sha256.Sum256(value)
+			digested.BinaryData[key] = digest[:]
+		}
+	}
+	return digested
+}
+
+// digestSecret returns a copy of the Secret with each value replaced by the
+// SHA256 digest of the value
+func digestSecret(s *corev1.Secret) *corev1.Secret {
+	digested := &corev1.Secret{
+		TypeMeta:   s.TypeMeta,
+		ObjectMeta: digestObjectMeta(s.ObjectMeta),
+		Type:       s.Type,
+	}
+	if s.Data != nil {
+		digested.Data = make(map[string][]byte, len(s.Data))
+		for key, value := range s.Data {
+			digest := sha256.Sum256(value)
+			digested.Data[key] = digest[:]
+		}
+	}
+	return digested
+}
+
+// digestValue returns the hex encoded SHA256 digest of the value
+func digestValue(value []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(value))
+}
+
+// getUndigested reads the ConfigMap or Secret given from the API server so
+// that it can be updated without overwriting its values with their digests
+func (d *DigestCache) getUndigested(obj Object) (Object, error) {
+	var undigested Object
+	var err error
+	switch obj.(type) {
+	case *corev1.ConfigMap:
+		undigested, err = d.clientset.CoreV1().ConfigMaps(obj.GetNamespace()).Get(obj.GetName(), metav1.GetOptions{})
+	case *corev1.Secret:
+		undigested, err = d.clientset.CoreV1().Secrets(obj.GetNamespace()).Get(obj.GetName(), metav1.GetOptions{})
+	default:
+		return nil, fmt.Errorf("digest cache does not support %T", obj)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return undigested, nil
+}
+
+// Start runs the informers until stop is closed
+func (d *DigestCache) Start(stop <-chan struct{}) error {
+	go d.configMaps.Run(stop)
+	go d.secrets.Run(stop)
+	if !cache.WaitForCacheSync(stop, d.HasSynced) {
+		return fmt.Errorf("digest cache failed to sync")
+	}
+	<-stop
+	return nil
+}
+
+// HasSynced returns true once both informers have synced
+func (d *DigestCache) HasSynced() bool {
+	return d.configMaps.HasSynced() && d.secrets.HasSynced()
+}
+
+// ConfigMapInformer returns the informer for digested ConfigMaps
+func (d *DigestCache) ConfigMapInformer() cache.SharedIndexInformer {
+	return d.configMaps
+}
+
+// SecretInformer returns the informer for digested Secrets
+func (d *DigestCache) SecretInformer() cache.SharedIndexInformer {
+	return d.secrets
+}
+
+// informerFor returns the informer which caches objects of the given type
+func (d *DigestCache) informerFor(obj runtime.Object) (cache.SharedIndexInformer, string, error) {
+	switch obj.(type) {
+	case *corev1.ConfigMap, *corev1.ConfigMapList:
+		return d.configMaps, "configmaps", nil
+	case *corev1.Secret, *corev1.SecretList:
+		return d.secrets, "secrets", nil
+	default:
+		return nil, "", fmt.Errorf("digest cache does not support %T", obj)
+	}
+}
+
+// Get retrieves a digested ConfigMap or Secret from the cache
+func (d *DigestCache) Get(_ context.Context, key client.ObjectKey, obj runtime.Object) error {
+	informer, resource, err := d.informerFor(obj)
+	if err != nil {
+		return err
+	}
+	if !informer.HasSynced() {
+		return fmt.Errorf("digest cache for %s has not synced", resource)
+	}
+
+	item, exists, err := informer.GetStore().GetByKey(key.String())
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.NewNotFound(corev1.Resource(resource), key.Name)
+	}
+
+	switch o := obj.(type) {
+	case *corev1.ConfigMap:
+		item.(*corev1.ConfigMap).DeepCopyInto(o)
+	case *corev1.Secret:
+		item.(*corev1.Secret).DeepCopyInto(o)
+	}
+	return nil
+}
+
+// List retrieves digested ConfigMaps or Secrets from the cache.
+// Only namespace and owner UID field selectors are supported.
+func (d *DigestCache) List(_ context.Context, list runtime.Object, opts ...client.ListOptionFunc) error {
+	informer, resource, err := d.informerFor(list)
+	if err != nil {
+		return err
+	}
+	if !informer.HasSynced() {
+		return fmt.Errorf("digest cache for %s has not synced", resource)
+	}
+
+	listOpts := (&client.ListOptions{}).ApplyOptions(opts)
+	var items []interface{}
+	if listOpts.FieldSelector != nil && !listOpts.FieldSelector.Empty() {
+		uid, found := listOpts.FieldSelector.RequiresExactMatch(ownerUIDIndexField)
+		if !found {
+			return fmt.Errorf("digest cache does not support field selector %s", listOpts.FieldSelector)
+		}
+		items, err = informer.GetIndexer().ByIndex(ownerUIDIndexField, listOpts.Namespace+"/"+uid)
+	} else if listOpts.Namespace != "" {
+		items, err = informer.GetIndexer().ByIndex(cache.NamespaceIndex, listOpts.Namespace)
+	} else {
+		items = informer.GetStore().List()
+	}
+	if err != nil {
+		return err
+	}
+
+	switch l := list.(type) {
+	case *corev1.ConfigMapList:
+		l.Items = make([]corev1.ConfigMap, 0, len(items))
+		for _, item := range items {
+			l.Items = append(l.Items, *item.(*corev1.ConfigMap).DeepCopy())
+		}
+	case *corev1.SecretList:
+		l.Items = make([]corev1.Secret, 0, len(items))
+		for _, item := range items {
+			l.Items = append(l.Items, *item.(*corev1.Secret).DeepCopy())
+		}
+	}
+	return nil
+}
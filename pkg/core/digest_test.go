@@ -0,0 +1,257 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pusher/wave/test/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+var _ = Describe("Wave digest Suite", func() {
+	const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+	Context("digestConfigMap", func() {
+		var cm *corev1.ConfigMap
+		var digested *corev1.ConfigMap
+
+		BeforeEach(func() {
+			cm = utils.ExampleConfigMap1.DeepCopy()
+			cm.BinaryData = map[string][]byte{"binary1": []byte("binary")}
+			cm.SetLabels(map[string]string{"app": "example"})
+			cm.SetAnnotations(map[string]string{lastAppliedAnnotation: `{"data":{"key1":"example1:key1"}}`})
+			cm.SetOwnerReferences([]metav1.OwnerReference{utils.GetOwnerRef(utils.ExampleDeployment)})
+			digested = digestConfigMap(cm)
+		})
+
+		It("replaces each Data value with its digest", func() {
+			for key, value := range cm.Data {
+				Expect(digested.Data).To(HaveKeyWithValue(key, fmt.Sprintf("%x", sha256.Sum256([]byte(value)))))
+			}
+		})
+
+		It("replaces each BinaryData value with its digest", func() {
+			digest := sha256.Sum256([]byte("binary"))
+			Expect(digested.BinaryData).To(HaveKeyWithValue("binary1", digest[:]))
+		})
+
+		It("keeps the identifying metadata, labels and OwnerReferences", func() {
+			Expect(digested.GetName()).To(Equal(cm.GetName()))
+			Expect(digested.GetNamespace()).To(Equal(cm.GetNamespace()))
+			Expect(digested.GetLabels()).To(Equal(cm.GetLabels()))
+			Expect(digested.GetOwnerReferences()).To(Equal(cm.GetOwnerReferences()))
+		})
+
+		It("removes the annotations", func() {
+			Expect(digested.GetAnnotations()).To(BeEmpty())
+		})
+
+		It("doesn't modify the original", func() {
+			Expect(cm.Data).To(Equal(utils.ExampleConfigMap1.Data))
+		})
+	})
+
+	Context("digestSecret", func() {
+		var s *corev1.Secret
+		var digested *corev1.Secret
+
+		BeforeEach(func() {
+			s = utils.ExampleSecret1.DeepCopy()
+			s.Data = map[string][]byte{"key1": []byte("value1")}
+			s.Type = corev1.SecretTypeOpaque
+			s.SetAnnotations(map[string]string{lastAppliedAnnotation: `{"data":{"key1":"dmFsdWUx"}}`})
+			digested = digestSecret(s)
+		})
+
+		It("replaces each Data value with its digest", func() {
+			digest := sha256.Sum256([]byte("value1"))
+			Expect(digested.Data).To(HaveKeyWithValue("key1", digest[:]))
+		})
+
+		It("keeps the identifying metadata and type", func() {
+			Expect(digested.GetName()).To(Equal(s.GetName()))
+			Expect(digested.GetNamespace()).To(Equal(s.GetNamespace()))
+			Expect(digested.Type).To(Equal(corev1.SecretTypeOpaque))
+		})
+
+		It("removes the annotations", func() {
+			Expect(digested.GetAnnotations()).To(BeEmpty())
+		})
+
+		It("doesn't modify the original", func() {
+			Expect(s.Data).To(HaveKeyWithValue("key1", []byte("value1")))
+		})
+	})
+
+	Context("DigestCache", func() {
+		var c client.Client
+		var m utils.Matcher
+		var digests *DigestCache
+		var stopDigests chan struct{}
+		var digestsStopped *sync.WaitGroup
+		var mgrStopped *sync.WaitGroup
+		var stopMgr chan struct{}
+		var recorder record.EventRecorder
+
+		const timeout = time.Second * 5
+
+		var s1 *corev1.Secret
+
+		BeforeEach(func() {
+			mgr, err := manager.New(cfg, manager.Options{})
+			Expect(err).NotTo(HaveOccurred())
+			c = mgr.GetClient()
+			m = utils.Matcher{Client: c}
+			recorder = mgr.GetEventRecorderFor("wave")
+			stopMgr, mgrStopped = StartTestManager(mgr)
+
+			digests, err = NewDigestCache(cfg, 0)
+			Expect(err).NotTo(HaveOccurred())
+			stopDigests = make(chan struct{})
+			digestsStopped = &sync.WaitGroup{}
+			digestsStopped.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer digestsStopped.Done()
+				Expect(digests.Start(stopDigests)).To(Succeed())
+			}()
+			Eventually(digests.HasSynced, timeout).Should(BeTrue())
+
+			s1 = utils.ExampleSecret1.DeepCopy()
+			m.Create(s1).Should(Succeed())
+		})
+
+		AfterEach(func() {
+			close(stopDigests)
+			digestsStopped.Wait()
+			close(stopMgr)
+			mgrStopped.Wait()
+
+			utils.DeleteAll(cfg, timeout,
+				&appsv1.DeploymentList{},
+				&corev1.ConfigMapList{},
+				&corev1.SecretList{},
+			)
+		})
+
+		It("returns digested Secrets", func() {
+			key := types.NamespacedName{Namespace: s1.GetNamespace(), Name: s1.GetName()}
+			cached := &corev1.Secret{}
+			Eventually(func() error {
+				return digests.Get(context.TODO(), key, cached)
+			}, timeout).Should(Succeed())
+
+			for key, value := range utils.ExampleSecret1.StringData {
+				digest := sha256.Sum256([]byte(value))
+				Expect(cached.Data).To(HaveKeyWithValue(key, digest[:]))
+			}
+		})
+
+		It("lists digested Secrets by namespace", func() {
+			Eventually(func() ([]corev1.Secret, error) {
+				list := &corev1.SecretList{}
+				err := digests.List(context.TODO(), list, client.InNamespace(s1.GetNamespace()))
+				return list.Items, err
+			}, timeout).Should(ContainElement(WithTransform(func(s corev1.Secret) string {
+				return s.GetName()
+			}, Equal(s1.GetName()))))
+		})
+
+		It("returns NotFound for missing objects", func() {
+			key := types.NamespacedName{Namespace: "default", Name: "missing"}
+			err := digests.Get(context.TODO(), key, &corev1.ConfigMap{})
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("changes the configuration hash when a Secret value changes", func() {
+			h := NewHandlerWithOptions(c, nil, Options{TrackingMode: IndexTracking, DigestCache: digests})
+			hashChildren := func() (string, error) {
+				current, err := h.getCurrentChildren(&deployment{utils.ExampleDeployment.DeepCopy()})
+				if err != nil {
+					return "", err
+				}
+				return calculateConfigHash(current)
+			}
+
+			for _, obj := range []Object{
+				utils.ExampleConfigMap1.DeepCopy(),
+				utils.ExampleConfigMap2.DeepCopy(),
+				utils.ExampleConfigMap3.DeepCopy(),
+				utils.ExampleConfigMap4.DeepCopy(),
+				utils.ExampleSecret2.DeepCopy(),
+				utils.ExampleSecret3.DeepCopy(),
+				utils.ExampleSecret4.DeepCopy(),
+			} {
+				m.Create(obj).Should(Succeed())
+			}
+
+			var h1 string
+			Eventually(func() error {
+				var err error
+				h1, err = hashChildren()
+				return err
+			}, timeout).Should(Succeed())
+
+			m.Get(s1, timeout).Should(Succeed())
+			s1.Data["key1"] = []byte("modified")
+			m.Update(s1).Should(Succeed())
+
+			Eventually(hashChildren, timeout).ShouldNot(Equal(h1))
+		})
+
+		It("doesn't overwrite values when migrating from owner reference tracking", func() {
+			h := NewHandlerWithOptions(c, recorder, Options{TrackingMode: IndexTracking, DigestCache: digests})
+
+			d := utils.ExampleDeployment.DeepCopy()
+			d.SetAnnotations(map[string]string{RequiredAnnotation: "true"})
+			d.SetFinalizers([]string{FinalizerString})
+			m.Create(d).Should(Succeed())
+			m.Get(d, timeout).Should(Succeed())
+
+			cm := utils.ExampleConfigMap1.DeepCopy()
+			cm.SetOwnerReferences([]metav1.OwnerReference{utils.GetOwnerRef(d)})
+			m.Create(cm).Should(Succeed())
+
+			// Ensure the digest cache has seen the OwnerReference
+			Eventually(func() ([]corev1.ConfigMap, error) {
+				list := &corev1.ConfigMapList{}
+				err := digests.List(context.TODO(), list, client.InNamespace(d.GetNamespace()), client.MatchingField(ownerUIDIndexField, string(d.GetUID())))
+				return list.Items, err
+			}, timeout).Should(HaveLen(1))
+
+			_, err := h.HandleDeployment(d)
+			Expect(err).NotTo(HaveOccurred())
+
+			m.Eventually(cm, timeout).Should(utils.WithOwnerReferences(BeEmpty()))
+			Expect(cm.Data).To(Equal(utils.ExampleConfigMap1.Data))
+		})
+	})
+})
@@ -20,9 +20,13 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
@@ -33,27 +37,62 @@ import (
 type Handler struct {
 	client.Client
 	recorder record.EventRecorder
+	options  Options
 }
 
-// NewHandler constructs a new instance of Handler
+// NewHandler constructs a new instance of Handler using the DefaultOptions
 func NewHandler(c client.Client, r record.EventRecorder) *Handler {
-	return &Handler{Client: c, recorder: r}
+	return NewHandlerWithOptions(c, r, DefaultOptions)
+}
+
+// NewHandlerWithOptions constructs a new instance of Handler using the given
+// Options
+func NewHandlerWithOptions(c client.Client, r record.EventRecorder, o Options) *Handler {
+	return &Handler{Client: c, recorder: r, options: o}
 }
 
 func (h *Handler) HandleDeployment(instance *appsv1.Deployment) (reconcile.Result, error) {
 	return h.HandlePodController(&deployment{Deployment: instance})
 }
 
+// HandleStatefulSet is called by the StatefulSet controller to reconcile StatefulSets
+func (h *Handler) HandleStatefulSet(instance *appsv1.StatefulSet) (reconcile.Result, error) {
+	return h.HandlePodController(&statefulset{StatefulSet: instance})
+}
+
+// HandleDaemonSet is called by the DaemonSet controller to reconcile DaemonSets
+func (h *Handler) HandleDaemonSet(instance *appsv1.DaemonSet) (reconcile.Result, error) {
+	return h.HandlePodController(&daemonset{DaemonSet: instance})
+}
+
+// HandleCronJob is called by the CronJob controller to reconcile CronJobs
+func (h *Handler) HandleCronJob(instance *batchv1beta1.CronJob) (reconcile.Result, error) {
+	return h.HandlePodController(&cronjob{CronJob: instance})
+}
+
+// HandleUnstructured is called by the generic workload controllers to
+// reconcile custom resources which embed a PodTemplateSpec at templatePath
+func (h *Handler) HandleUnstructured(instance *unstructured.Unstructured, templatePath []string) (reconcile.Result, error) {
+	obj := &unstructuredPodController{Unstructured: instance, templatePath: templatePath}
+	if err := obj.hasPodTemplate(); err != nil {
+		return reconcile.Result{}, fmt.Errorf("error reading pod template of %s %s/%s: %v", instance.GetKind(), instance.GetNamespace(), instance.GetName(), err)
+	}
+	return h.HandlePodController(obj)
+}
+
 // HandlePodController is called by the deployment controller
 func (h *Handler) HandlePodController(instance podController) (reconcile.Result, error) {
 	log := logf.Log.WithName("wave")
 
+	result := reconcileIgnored
+	defer func() { observeReconcile(instance, result) }()
+
 	// If the required annotation isn't present, ignore the instance
 	if !hasRequiredAnnotation(instance) {
 		// Perform deletion logic if the finalizer is present on the object
 		if hasFinalizer(instance) {
 			log.V(0).Info("Required annotation removed from instance, cleaning up orphans", "namespace", instance.GetNamespace(), "name", instance.GetName())
-			return h.handleDelete(instance)
+			return h.handleCleanup(instance, &result)
 		}
 		return reconcile.Result{}, nil
 	}
@@ -61,46 +100,106 @@ func (h *Handler) HandlePodController(instance podController) (reconcile.Result,
 	// If the instance is marked for deletion, run cleanup process
 	if toBeDeleted(instance) {
 		log.V(0).Info("Instance marked for deletion, cleaning up orphans", "namespace", instance.GetNamespace(), "name", instance.GetName())
-		return h.handleDelete(instance)
+		return h.handleCleanup(instance, &result)
 	}
 
-	// Get all children that have an OwnerReference pointing to this instance
-	existing, err := h.getExistingChildren(instance)
-	if err != nil {
-		return reconcile.Result{}, fmt.Errorf("error fetching existing children: %v", err)
+	// When children are tracked by the index, OwnerReferences and the
+	// finalizer from owner reference tracking are no longer needed
+	if h.options.TrackingMode == IndexTracking && hasFinalizer(instance) {
+		log.V(0).Info("Instance tracked by index, cleaning up OwnerReferences", "namespace", instance.GetNamespace(), "name", instance.GetName())
+		return h.handleCleanup(instance, &result)
 	}
 
 	// Get all children that the instance currently references
 	current, err := h.getCurrentChildren(instance)
+	if missing, ok := err.(*missingChildrenError); ok {
+		result = reconcileMissingChildren
+		return h.handleMissingChildren(instance, missing)
+	}
 	if err != nil {
+		result = reconcileFetchChildrenError
 		return reconcile.Result{}, fmt.Errorf("error fetching current children: %v", err)
 	}
 
-	// Reconcile the OwnerReferences on the existing and current children
-	err = h.updateOwnerReferences(instance, existing, current)
-	if err != nil {
-		return reconcile.Result{}, fmt.Errorf("error updating OwnerReferences: %v", err)
+	if h.options.TrackingMode == OwnerReferencesTracking {
+		// Get all children that have an OwnerReference pointing to this instance
+		existing, err := h.getExistingChildren(instance)
+		if err != nil {
+			result = reconcileFetchChildrenError
+			return reconcile.Result{}, fmt.Errorf("error fetching existing children: %v", err)
+		}
+
+		// Reconcile the OwnerReferences on the existing and current children
+		err = h.updateOwnerReferences(instance, existing, current)
+		if err != nil {
+			result = reconcileOwnerReferencesError
+			return reconcile.Result{}, fmt.Errorf("error updating OwnerReferences: %v", err)
+		}
 	}
 
-	hash, err := calculateConfigHash(current)
+	hash, equivalent, err := h.calculateHash(instance, current)
 	if err != nil {
+		result = reconcileHashError
 		return reconcile.Result{}, fmt.Errorf("error calculating configuration hash: %v", err)
 	}
 
 	// Update the desired state of the Deployment in a DeepCopy
 	copy := instance.DeepCopy()
 	setConfigHash(copy, hash)
-	addFinalizer(copy)
+	setEquivalentConfigHash(copy, equivalent)
+	err = h.setConfigSummary(copy, current)
+	if err != nil {
+		result = reconcileHashError
+		return reconcile.Result{}, fmt.Errorf("error recording configuration digests: %v", err)
+	}
+	if getConfigHash(instance) != hash {
+		setTriggerAnnotations(instance, copy, time.Now())
+	}
+	if h.options.TrackingMode == OwnerReferencesTracking {
+		addFinalizer(copy)
+	}
+	clearMissingDependencies(copy)
 
 	// If the desired state doesn't match the existing state, update it
+	result = reconcileUnchanged
 	if !reflect.DeepEqual(instance, copy) {
-		log.V(0).Info("Updating instance hash", "namespace", instance.GetNamespace(), "name", instance.GetName(), "hash", hash)
-		h.recorder.Eventf(copy.GetObject(), corev1.EventTypeNormal, "ConfigChanged", "Configuration hash updated to %s", hash)
+		hashChanged := getConfigHash(instance) != hash
+		triggeredBy, forgetAttributed := "", func() {}
+		if hashChanged {
+			triggeredBy, forgetAttributed = attributeChange(instance, copy)
+			setTriggeredBy(copy, triggeredBy)
+		}
+		log.V(0).Info("Updating instance hash", "namespace", instance.GetNamespace(), "name", instance.GetName(), "hash", hash, "triggeredBy", triggeredBy)
+		if hashChanged {
+			h.recorder.Event(copy.GetObject(), corev1.EventTypeNormal, "ConfigChanged", configChangedMessage(hash, getConfigChanges(instance, copy), triggeredBy))
+		}
 		err := h.Update(context.TODO(), copy.GetObject())
 		if err != nil {
+			result = reconcileUpdateError
 			return reconcile.Result{}, fmt.Errorf("error updating instance %s/%s: %v", instance.GetNamespace(), instance.GetName(), err)
 		}
+		result = reconcileUpdated
+		if hashChanged {
+			observeRollout(instance)
+			forgetAttributed()
+		}
 	}
 
 	return reconcile.Result{}, nil
 }
+
+// handleCleanup runs handleDelete and records its result
+func (h *Handler) handleCleanup(instance podController, result *string) (reconcile.Result, error) {
+	res, err := h.handleDelete(instance)
+	*result = reconcileCleanedUp
+	if err != nil {
+		*result = reconcileCleanupError
+	}
+	return res, err
+}
+
+// HandleNotFound is called by the controllers when the instance being
+// reconciled no longer exists
+func (h *Handler) HandleNotFound(kind string, name types.NamespacedName) {
+	managed.set(kind, name, false)
+}
@@ -57,6 +57,7 @@ var _ = Describe("Wave controller Suite", func() {
 	BeforeEach(func() {
 		mgr, err := manager.New(cfg, manager.Options{})
 		Expect(err).NotTo(HaveOccurred())
+		Expect(IndexOwners(mgr.GetFieldIndexer())).To(Succeed())
 		c = mgr.GetClient()
 		h = NewHandler(c, mgr.GetEventRecorderFor("wave"))
 		m = utils.Matcher{Client: c}
@@ -168,6 +169,12 @@ var _ = Describe("Wave controller Suite", func() {
 				m.Eventually(deployment, timeout).Should(utils.WithPodTemplateAnnotations(HaveKey(ConfigHashAnnotation)))
 			})
 
+			It("Doesn't record a trigger when the hash is first set", func() {
+				m.Eventually(deployment, timeout).Should(utils.WithPodTemplateAnnotations(HaveKey(ConfigHashAnnotation)))
+				Expect(deployment.Spec.Template.GetAnnotations()).NotTo(HaveKey(TriggeredAtAnnotation))
+				Expect(deployment.Spec.Template.GetAnnotations()).NotTo(HaveKey(PreviousConfigHashAnnotation))
+			})
+
 			It("Sends an event when updating the hash", func() {
 				m.Eventually(deployment, timeout).Should(utils.WithPodTemplateAnnotations(HaveKey(ConfigHashAnnotation)))
 
@@ -176,7 +183,7 @@ var _ = Describe("Wave controller Suite", func() {
 					return event.Message
 				}
 
-				hashMessage := "Configuration hash updated to ebabf80ef45218b27078a41ca16b35a4f91cb5672f389e520ae9da6ee3df3b1c"
+				hashMessage := "Configuration hash updated to v1:f445cf63c10f7fc531f81beb46bd96e9dc36ab495f864f789c51d4bec49fdca5"
 				m.Eventually(events, timeout).Should(utils.WithItems(ContainElement(WithTransform(eventMessage, Equal(hashMessage)))))
 			})
 
@@ -212,6 +219,73 @@ var _ = Describe("Wave controller Suite", func() {
 				})
 			})
 
+			Context("And a required child is missing", func() {
+				var originalHash string
+				var missing *corev1.ConfigMap
+
+				BeforeEach(func() {
+					m.Eventually(deployment, timeout).Should(utils.WithPodTemplateAnnotations(HaveKey(ConfigHashAnnotation)))
+					originalHash = deployment.Spec.Template.GetAnnotations()[ConfigHashAnnotation]
+
+					missing = utils.ExampleConfigMap1.DeepCopy()
+					missing.SetName("missing")
+
+					deployment.Spec.Template.Spec.Volumes = append(deployment.Spec.Template.Spec.Volumes, corev1.Volume{
+						Name: "missing",
+						VolumeSource: corev1.VolumeSource{
+							ConfigMap: &corev1.ConfigMapVolumeSource{
+								LocalObjectReference: corev1.LocalObjectReference{
+									Name: missing.GetName(),
+								},
+							},
+						},
+					})
+					m.Update(deployment).Should(Succeed())
+					_, err := h.HandleDeployment(deployment)
+					Expect(err).NotTo(HaveOccurred())
+
+					// Get the updated Deployment
+					m.Get(deployment, timeout).Should(Succeed())
+				})
+
+				It("Lists the missing child in an annotation", func() {
+					m.Eventually(deployment, timeout).Should(utils.WithAnnotations(HaveKeyWithValue(MissingDependenciesAnnotation, "ConfigMap/missing")))
+				})
+
+				It("Sends a warning event", func() {
+					events := &corev1.EventList{}
+					eventReason := func(event *corev1.Event) string {
+						return event.Reason
+					}
+					m.Eventually(events, timeout).Should(utils.WithItems(ContainElement(WithTransform(eventReason, Equal("MissingDependencies")))))
+				})
+
+				It("Does not update the config hash in the Pod Template", func() {
+					m.Consistently(deployment, consistentlyTimeout).Should(utils.WithPodTemplateAnnotations(HaveKeyWithValue(ConfigHashAnnotation, originalHash)))
+				})
+
+				Context("And the child is created", func() {
+					BeforeEach(func() {
+						m.Create(missing).Should(Succeed())
+						m.Get(missing, timeout).Should(Succeed())
+
+						_, err := h.HandleDeployment(deployment)
+						Expect(err).NotTo(HaveOccurred())
+
+						// Get the updated Deployment
+						m.Get(deployment, timeout).Should(Succeed())
+					})
+
+					It("Removes the missing dependencies annotation", func() {
+						m.Eventually(deployment, timeout).ShouldNot(utils.WithAnnotations(HaveKey(MissingDependenciesAnnotation)))
+					})
+
+					It("Updates the config hash in the Pod Template", func() {
+						m.Eventually(deployment, timeout).ShouldNot(utils.WithPodTemplateAnnotations(HaveKeyWithValue(ConfigHashAnnotation, originalHash)))
+					})
+				})
+			})
+
 			Context("And a child is updated", func() {
 				var originalHash string
 
@@ -236,6 +310,104 @@ var _ = Describe("Wave controller Suite", func() {
 					It("Updates the config hash in the Pod Template", func() {
 						m.Eventually(deployment, timeout).ShouldNot(utils.WithPodTemplateAnnotations(HaveKeyWithValue(ConfigHashAnnotation, originalHash)))
 					})
+
+					It("Lists the changed key in the event", func() {
+						events := &corev1.EventList{}
+						eventMessage := func(event *corev1.Event) string {
+							return event.Message
+						}
+						m.Eventually(events, timeout).Should(utils.WithItems(ContainElement(WithTransform(eventMessage, ContainSubstring(": ConfigMap/example1[key1] changed")))))
+					})
+
+					It("Records the trigger on the Pod Template", func() {
+						m.Eventually(deployment, timeout).Should(utils.WithPodTemplateAnnotations(And(
+							HaveKeyWithValue(TriggeredByAnnotation, "ConfigMap/example1"),
+							HaveKeyWithValue(PreviousConfigHashAnnotation, originalHash),
+							HaveKey(TriggeredAtAnnotation),
+						)))
+					})
+				})
+
+				Context("A ConfigMap volume is updated through the webhook", func() {
+					BeforeEach(func() {
+						m.Get(cm1, timeout).Should(Succeed())
+						cm1.Data["key1"] = "modified"
+						h.RecordChange(cm1, []string{"Deployment/" + deployment.GetName()}, "alice", "Update")
+						m.Update(cm1).Should(Succeed())
+
+						_, err := h.HandleDeployment(deployment)
+						Expect(err).NotTo(HaveOccurred())
+
+						// Get the updated Deployment
+						m.Get(deployment, timeout).Should(Succeed())
+					})
+
+					AfterEach(func() {
+						attributions = &attributionRecorder{changes: make(map[string]changeAttribution)}
+					})
+
+					It("Records who triggered the change on the Deployment", func() {
+						m.Eventually(deployment, timeout).Should(utils.WithAnnotations(HaveKeyWithValue(LastTriggeredByAnnotation, HavePrefix("alice (Update ConfigMap/example1 at "))))
+					})
+
+					It("Includes who triggered the change in the event", func() {
+						events := &corev1.EventList{}
+						eventMessage := func(event *corev1.Event) string {
+							return event.Message
+						}
+						m.Eventually(events, timeout).Should(utils.WithItems(ContainElement(WithTransform(eventMessage, ContainSubstring("; triggered by alice (Update ConfigMap/example1 at ")))))
+					})
+
+					It("Forgets the change once it has been attributed", func() {
+						Expect(attributions.changes).To(BeEmpty())
+					})
+
+					Context("And then updated by someone unknown", func() {
+						BeforeEach(func() {
+							m.Eventually(deployment, timeout).Should(utils.WithAnnotations(HaveKey(LastTriggeredByAnnotation)))
+
+							m.Get(cm2, timeout).Should(Succeed())
+							cm2.Data["key1"] = "modified"
+							m.Update(cm2).Should(Succeed())
+
+							_, err := h.HandleDeployment(deployment)
+							Expect(err).NotTo(HaveOccurred())
+
+							// Get the updated Deployment
+							m.Get(deployment, timeout).Should(Succeed())
+						})
+
+						It("Removes who triggered the earlier change", func() {
+							m.Eventually(deployment, timeout).ShouldNot(utils.WithAnnotations(HaveKey(LastTriggeredByAnnotation)))
+						})
+					})
+				})
+
+				Context("A ConfigMap volume is updated through the webhook and then again by someone unknown", func() {
+					BeforeEach(func() {
+						m.Get(cm1, timeout).Should(Succeed())
+						cm1.Data["key1"] = "modified"
+						h.RecordChange(cm1, []string{"Deployment/" + deployment.GetName()}, "alice", "Update")
+						m.Update(cm1).Should(Succeed())
+
+						m.Get(cm1, timeout).Should(Succeed())
+						cm1.Data["key1"] = "modified again"
+						m.Update(cm1).Should(Succeed())
+
+						_, err := h.HandleDeployment(deployment)
+						Expect(err).NotTo(HaveOccurred())
+
+						// Get the updated Deployment
+						m.Get(deployment, timeout).Should(Succeed())
+					})
+
+					AfterEach(func() {
+						attributions = &attributionRecorder{changes: make(map[string]changeAttribution)}
+					})
+
+					It("Doesn't attribute the change", func() {
+						m.Eventually(deployment, timeout).ShouldNot(utils.WithAnnotations(HaveKey(LastTriggeredByAnnotation)))
+					})
 				})
 
 				Context("A ConfigMap EnvSource is updated", func() {
@@ -311,6 +483,15 @@ var _ = Describe("Wave controller Suite", func() {
 					It("Updates the config hash in the Pod Template", func() {
 						m.Eventually(deployment, timeout).ShouldNot(utils.WithPodTemplateAnnotations(HaveKeyWithValue(ConfigHashAnnotation, originalHash)))
 					})
+
+					It("Doesn't list which Secret key changed without a hash key", func() {
+						events := &corev1.EventList{}
+						eventMessage := func(event *corev1.Event) string {
+							return event.Message
+						}
+						m.Eventually(events, timeout).Should(utils.WithItems(ContainElement(WithTransform(eventMessage, HavePrefix("Configuration hash updated to ")))))
+						Expect(events).To(utils.WithItems(Not(ContainElement(WithTransform(eventMessage, ContainSubstring("Secret/example1["))))))
+					})
 				})
 
 				Context("A Secret EnvSource is updated", func() {
@@ -377,6 +558,76 @@ var _ = Describe("Wave controller Suite", func() {
 				})
 			})
 
+			Context("And it has a hash from an earlier version", func() {
+				var legacyHash string
+
+				BeforeEach(func() {
+					m.Eventually(deployment, timeout).Should(utils.WithPodTemplateAnnotations(HaveKey(ConfigHashAnnotation)))
+					hash := deployment.Spec.Template.GetAnnotations()[ConfigHashAnnotation]
+					Expect(hash).To(HavePrefix(currentHashVersion + hashVersionSeparator))
+
+					var err error
+					legacyHash, err = calculateLegacyHash(h, deployment)
+					Expect(err).NotTo(HaveOccurred())
+					deployment.Spec.Template.Annotations[ConfigHashAnnotation] = legacyHash
+					m.Update(deployment).Should(Succeed())
+
+					_, err = h.HandleDeployment(deployment)
+					Expect(err).NotTo(HaveOccurred())
+
+					// Get the updated Deployment
+					m.Get(deployment, timeout).Should(Succeed())
+				})
+
+				It("Keeps the existing config hash", func() {
+					m.Consistently(deployment, consistentlyTimeout).Should(utils.WithPodTemplateAnnotations(HaveKeyWithValue(ConfigHashAnnotation, legacyHash)))
+				})
+
+				It("Records the config hash of the current version on the Deployment", func() {
+					m.Eventually(deployment, timeout).Should(utils.WithAnnotations(HaveKeyWithValue(EquivalentConfigHashAnnotation, HavePrefix(currentHashVersion+hashVersionSeparator))))
+				})
+
+				Context("And BinaryData is added to a child", func() {
+					BeforeEach(func() {
+						m.Get(cm1, timeout).Should(Succeed())
+						cm1.BinaryData = map[string][]byte{"binary1": []byte("binary")}
+						m.Update(cm1).Should(Succeed())
+
+						_, err := h.HandleDeployment(deployment)
+						Expect(err).NotTo(HaveOccurred())
+
+						// Get the updated Deployment
+						m.Get(deployment, timeout).Should(Succeed())
+					})
+
+					It("Updates the config hash to the current version", func() {
+						m.Eventually(deployment, timeout).Should(utils.WithPodTemplateAnnotations(HaveKeyWithValue(ConfigHashAnnotation, HavePrefix(currentHashVersion+hashVersionSeparator))))
+					})
+
+					It("Removes the recorded config hash", func() {
+						m.Eventually(deployment, timeout).ShouldNot(utils.WithAnnotations(HaveKey(EquivalentConfigHashAnnotation)))
+					})
+				})
+
+				Context("And a child is updated", func() {
+					BeforeEach(func() {
+						m.Get(cm1, timeout).Should(Succeed())
+						cm1.Data["key1"] = "modified"
+						m.Update(cm1).Should(Succeed())
+
+						_, err := h.HandleDeployment(deployment)
+						Expect(err).NotTo(HaveOccurred())
+
+						// Get the updated Deployment
+						m.Get(deployment, timeout).Should(Succeed())
+					})
+
+					It("Updates the config hash to the current version", func() {
+						m.Eventually(deployment, timeout).Should(utils.WithPodTemplateAnnotations(HaveKeyWithValue(ConfigHashAnnotation, HavePrefix(currentHashVersion+hashVersionSeparator))))
+					})
+				})
+			})
+
 			Context("And the annotation is removed", func() {
 				BeforeEach(func() {
 					// Make sure the cache has synced before we run the test
@@ -447,4 +698,211 @@ var _ = Describe("Wave controller Suite", func() {
 		})
 	})
 
+	Context("When a Deployment is reconciled with index tracking", func() {
+		var indexHandler *Handler
+
+		BeforeEach(func() {
+			indexHandler = NewHandlerWithOptions(h.Client, h.recorder, Options{TrackingMode: IndexTracking})
+
+			annotations := deployment.GetAnnotations()
+			if annotations == nil {
+				annotations = make(map[string]string)
+			}
+			annotations[RequiredAnnotation] = "true"
+			deployment.SetAnnotations(annotations)
+		})
+
+		Context("And it has the required annotation", func() {
+			BeforeEach(func() {
+				m.Update(deployment).Should(Succeed())
+				_, err := indexHandler.HandleDeployment(deployment)
+				Expect(err).NotTo(HaveOccurred())
+
+				// Get the updated Deployment
+				m.Get(deployment, timeout).Should(Succeed())
+			})
+
+			It("Doesn't add any OwnerReferences to any children", func() {
+				for _, obj := range []Object{cm1, cm2, cm3, s1, s2, s3} {
+					m.Consistently(obj, consistentlyTimeout).Should(utils.WithOwnerReferences(BeEmpty()))
+				}
+			})
+
+			It("Doesn't add a finalizer to the Deployment", func() {
+				m.Consistently(deployment, consistentlyTimeout).ShouldNot(utils.WithFinalizers(ContainElement(FinalizerString)))
+			})
+
+			It("Adds a config hash to the Pod Template", func() {
+				m.Eventually(deployment, timeout).Should(utils.WithPodTemplateAnnotations(HaveKey(ConfigHashAnnotation)))
+			})
+		})
+
+		Context("And it was previously tracked by OwnerReferences", func() {
+			BeforeEach(func() {
+				m.Update(deployment).Should(Succeed())
+				_, err := h.HandleDeployment(deployment)
+				Expect(err).NotTo(HaveOccurred())
+				m.Get(deployment, timeout).Should(Succeed())
+				m.Eventually(deployment, timeout).Should(utils.WithFinalizers(ContainElement(FinalizerString)))
+
+				_, err = indexHandler.HandleDeployment(deployment)
+				Expect(err).NotTo(HaveOccurred())
+
+				// Get the updated Deployment
+				m.Get(deployment, timeout).Should(Succeed())
+			})
+
+			It("Removes the OwnerReference from the all children", func() {
+				for _, obj := range []Object{cm1, cm2, cm3, s1, s2, s3} {
+					m.Eventually(obj, timeout).ShouldNot(utils.WithOwnerReferences(ContainElement(ownerRef)))
+				}
+			})
+
+			It("Removes the Deployment's finalizer", func() {
+				m.Eventually(deployment, timeout).ShouldNot(utils.WithFinalizers(ContainElement(FinalizerString)))
+			})
+		})
+	})
+
+	Context("When a Deployment is reconciled with a hash key", func() {
+		var keyedHandler *Handler
+		var keyedHash string
+
+		BeforeEach(func() {
+			keyedHandler = NewHandlerWithOptions(h.Client, h.recorder, Options{
+				TrackingMode: OwnerReferencesTracking,
+				HashKey:      []byte("key1"),
+			})
+
+			annotations := deployment.GetAnnotations()
+			if annotations == nil {
+				annotations = make(map[string]string)
+			}
+			annotations[RequiredAnnotation] = "true"
+			deployment.SetAnnotations(annotations)
+
+			m.Update(deployment).Should(Succeed())
+			_, err := keyedHandler.HandleDeployment(deployment)
+			Expect(err).NotTo(HaveOccurred())
+
+			// Get the updated Deployment
+			m.Get(deployment, timeout).Should(Succeed())
+			m.Eventually(deployment, timeout).Should(utils.WithPodTemplateAnnotations(HaveKey(ConfigHashAnnotation)))
+			keyedHash = deployment.Spec.Template.GetAnnotations()[ConfigHashAnnotation]
+		})
+
+		It("Sets a config hash that differs from the unkeyed hash", func() {
+			_, err := h.HandleDeployment(deployment)
+			Expect(err).NotTo(HaveOccurred())
+
+			m.Get(deployment, timeout).Should(Succeed())
+			m.Eventually(deployment, timeout).ShouldNot(utils.WithPodTemplateAnnotations(HaveKeyWithValue(ConfigHashAnnotation, keyedHash)))
+		})
+
+		Context("And the key is rotated", func() {
+			var rotatedHandler *Handler
+
+			BeforeEach(func() {
+				rotatedHandler = NewHandlerWithOptions(h.Client, h.recorder, Options{
+					TrackingMode:    OwnerReferencesTracking,
+					HashKey:         []byte("key2"),
+					PreviousHashKey: []byte("key1"),
+				})
+
+				_, err := rotatedHandler.HandleDeployment(deployment)
+				Expect(err).NotTo(HaveOccurred())
+
+				// Get the updated Deployment
+				m.Get(deployment, timeout).Should(Succeed())
+			})
+
+			It("Keeps the existing config hash", func() {
+				m.Consistently(deployment, consistentlyTimeout).Should(utils.WithPodTemplateAnnotations(HaveKeyWithValue(ConfigHashAnnotation, keyedHash)))
+			})
+
+			It("Records the config hash calculated with the new key on the Deployment", func() {
+				m.Eventually(deployment, timeout).Should(utils.WithAnnotations(HaveKeyWithValue(EquivalentConfigHashAnnotation, And(
+					HavePrefix(currentHashVersion+hashVersionSeparator),
+					Not(Equal(keyedHash)),
+				))))
+			})
+
+			Context("And the previous key is retired", func() {
+				var newKeyHandler *Handler
+
+				BeforeEach(func() {
+					newKeyHandler = NewHandlerWithOptions(h.Client, h.recorder, Options{
+						TrackingMode: OwnerReferencesTracking,
+						HashKey:      []byte("key2"),
+					})
+
+					_, err := newKeyHandler.HandleDeployment(deployment)
+					Expect(err).NotTo(HaveOccurred())
+
+					// Get the updated Deployment
+					m.Get(deployment, timeout).Should(Succeed())
+				})
+
+				It("Keeps the existing config hash", func() {
+					m.Consistently(deployment, consistentlyTimeout).Should(utils.WithPodTemplateAnnotations(HaveKeyWithValue(ConfigHashAnnotation, keyedHash)))
+				})
+
+				It("Updates the config hash when a child is updated", func() {
+					m.Get(cm1, timeout).Should(Succeed())
+					cm1.Data["key1"] = "modified"
+					m.Update(cm1).Should(Succeed())
+
+					_, err := newKeyHandler.HandleDeployment(deployment)
+					Expect(err).NotTo(HaveOccurred())
+
+					m.Get(deployment, timeout).Should(Succeed())
+					m.Eventually(deployment, timeout).ShouldNot(utils.WithPodTemplateAnnotations(HaveKeyWithValue(ConfigHashAnnotation, keyedHash)))
+					m.Eventually(deployment, timeout).ShouldNot(utils.WithAnnotations(HaveKey(EquivalentConfigHashAnnotation)))
+				})
+			})
+
+			Context("And a child is updated", func() {
+				BeforeEach(func() {
+					m.Get(cm1, timeout).Should(Succeed())
+					cm1.Data["key1"] = "modified"
+					m.Update(cm1).Should(Succeed())
+
+					_, err := rotatedHandler.HandleDeployment(deployment)
+					Expect(err).NotTo(HaveOccurred())
+
+					// Get the updated Deployment
+					m.Get(deployment, timeout).Should(Succeed())
+				})
+
+				It("Updates the config hash in the Pod Template", func() {
+					m.Eventually(deployment, timeout).ShouldNot(utils.WithPodTemplateAnnotations(HaveKeyWithValue(ConfigHashAnnotation, keyedHash)))
+				})
+
+				It("Calculates the config hash with the new key", func() {
+					m.Eventually(deployment, timeout).ShouldNot(utils.WithPodTemplateAnnotations(HaveKeyWithValue(ConfigHashAnnotation, keyedHash)))
+					rotatedHash := deployment.Spec.Template.GetAnnotations()[ConfigHashAnnotation]
+
+					newKeyHandler := NewHandlerWithOptions(h.Client, h.recorder, Options{
+						TrackingMode: OwnerReferencesTracking,
+						HashKey:      []byte("key2"),
+					})
+					_, err := newKeyHandler.HandleDeployment(deployment)
+					Expect(err).NotTo(HaveOccurred())
+
+					m.Consistently(deployment, consistentlyTimeout).Should(utils.WithPodTemplateAnnotations(HaveKeyWithValue(ConfigHashAnnotation, rotatedHash)))
+				})
+			})
+		})
+	})
 })
+
+// calculateLegacyHash returns the hash the Deployment would have been given
+// before hashes were versioned
+func calculateLegacyHash(h *Handler, d *appsv1.Deployment) (string, error) {
+	instance := &deployment{d}
+	children, err := h.getCurrentChildren(instance)
+	if err != nil {
+		return "", err
+	}
+	return calculateVersionedHash(instance, children, legacyHashVersion, nil, false)
+}
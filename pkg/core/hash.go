@@ -17,18 +17,178 @@ limitations under the License.
 package core
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"strings"
 
 	corev1 "k8s.io/api/core/v1"
 )
 
+const (
+	// legacyHashVersion is the version of hashes calculated before hashes were
+	// prefixed with their version
+	legacyHashVersion = ""
+
+	// currentHashVersion is the version of newly calculated hashes
+	currentHashVersion = "v1"
+
+	// hashVersionSeparator separates the version of a hash from its digest
+	hashVersionSeparator = ":"
+)
+
+// hashSource builds the input to a version of the configuration hash from the
+// instance and its current children.
+// digested is true when the children were read from the DigestCache and hold
+// the SHA256 digest of each value rather than the value itself.
+type hashSource struct {
+	build func(instance podController, children []configObject, digested bool) ([]byte, error)
+
+	// fromDigests is true if the version can be calculated from children read
+	// from the DigestCache
+	fromDigests bool
+}
+
+// hashSources builds the input to each version of the configuration hash.
+// When the input changes, add a new version rather than modifying an existing
+// one so that hashes calculated by earlier releases can still be compared
+// against the current configuration.
+var hashSources = map[string]hashSource{
+	legacyHashVersion:  {build: getLegacyHashSource},
+	currentHashVersion: {build: getCurrentHashSource, fromDigests: true},
+}
+
 // calculateConfigHash uses sha256 to hash the configuration within the child
 // objects and returns a hash as a string
 func calculateConfigHash(children []configObject) (string, error) {
-	// hashSource contains all the data to be hashed
+	hashSourceBytes, err := getHashSource(children)
+	if err != nil {
+		return "", err
+	}
+	return digestHashSource(hashSourceBytes, nil), nil
+}
+
+// calculateVersionedHash hashes the configuration within the child objects
+// using the input for the given version and returns the hash prefixed with
+// the version
+func calculateVersionedHash(instance podController, children []configObject, version string, key []byte, digested bool) (string, error) {
+	source, ok := hashSources[version]
+	if !ok {
+		return "", fmt.Errorf("unknown hash version %q", version)
+	}
+	if digested && !source.fromDigests {
+		return "", fmt.Errorf("hash version %q can't be calculated from digests", version)
+	}
+	hashSourceBytes, err := source.build(instance, children, digested)
+	if err != nil {
+		return "", err
+	}
+
+	digest := digestHashSource(hashSourceBytes, key)
+	if version == legacyHashVersion {
+		return digest, nil
+	}
+	return version + hashVersionSeparator + digest, nil
+}
+
+// digestHashSource hashes the serialized configuration with sha256, or with
+// HMAC-SHA256 when a key is given
+func digestHashSource(hashSourceBytes []byte, key []byte) string {
+	if len(key) == 0 {
+		return fmt.Sprintf("%x", sha256.Sum256(hashSourceBytes))
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(hashSourceBytes)
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+// getHashVersion returns the version of the given hash
+func getHashVersion(hash string) string {
+	if i := strings.Index(hash, hashVersionSeparator); i >= 0 {
+		return hash[:i]
+	}
+	return legacyHashVersion
+}
+
+// getCurrentHashSource builds the input to the current hash version from the
+// SHA256 digest of each value selected from each child.
+// As the DigestCache holds the same digests, the hash is the same whether or
+// not the children were read from it.
+func getCurrentHashSource(_ podController, children []configObject, digested bool) ([]byte, error) {
+	hashSource := struct {
+		ConfigMaps       map[string]map[string]string `json:"configMaps"`
+		ConfigMapsBinary map[string]map[string]string `json:"configMapsBinary"`
+		Secrets          map[string]map[string]string `json:"secrets"`
+	}{
+		ConfigMaps:       make(map[string]map[string]string),
+		ConfigMapsBinary: make(map[string]map[string]string),
+		Secrets:          make(map[string]map[string]string),
+	}
+
+	for _, child := range children {
+		if child.object == nil {
+			continue
+		}
+		name := child.object.GetName()
+		switch child.object.(type) {
+		case *corev1.ConfigMap:
+			hashSource.ConfigMaps[name] = getStringDigests(getConfigMapData(child), digested)
+			hashSource.ConfigMapsBinary[name] = getBytesDigests(getConfigMapBinaryData(child), digested)
+		case *corev1.Secret:
+			hashSource.Secrets[name] = getBytesDigests(getSecretData(child), digested)
+		default:
+			return nil, fmt.Errorf("passed unknown type: %v", reflect.TypeOf(child))
+		}
+	}
+
+	hashSourceBytes, err := json.Marshal(hashSource)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal JSON: %v", err)
+	}
+	return hashSourceBytes, nil
+}
+
+// getStringDigests returns the hex encoded SHA256 digest of each value.
+// Values read from the DigestCache are already hex encoded digests.
+func getStringDigests(data map[string]string, digested bool) map[string]string {
+	digests := make(map[string]string, len(data))
+	for key, value := range data {
+		if digested {
+			digests[key] = value
+		} else {
+			digests[key] = digestValue([]byte(value))
+		}
+	}
+	return digests
+}
+
+// getBytesDigests returns the hex encoded SHA256 digest of each value.
+// Values read from the DigestCache are already digests.
+func getBytesDigests(data map[string][]byte, digested bool) map[string]string {
+	digests := make(map[string]string, len(data))
+	for key, value := range data {
+		if digested {
+			digests[key] = hex.EncodeToString(value)
+		} else {
+			digests[key] = digestValue(value)
+		}
+	}
+	return digests
+}
+
+// getLegacyHashSource builds the input to hashes calculated before hashes were
+// versioned.
+// These only included the ConfigMaps and Secrets referenced by the Volumes,
+// EnvFrom and Env of the Pod Template's Containers, in full unless only
+// referenced by Env, and did not include BinaryData.
+// They were calculated from the values themselves, so can't be calculated
+// from digests.
+func getLegacyHashSource(instance podController, children []configObject, _ bool) ([]byte, error) {
+	configMaps, secrets := getLegacyChildNamesByType(instance)
+
 	hashSource := struct {
 		ConfigMaps map[string]map[string]string `json:"configMaps"`
 		Secrets    map[string]map[string][]byte `json:"secrets"`
@@ -37,6 +197,103 @@ func calculateConfigHash(children []configObject) (string, error) {
 		Secrets:    make(map[string]map[string][]byte),
 	}
 
+	// Every child referenced by the legacy selection is also referenced by the
+	// current selection, so only its keys need to be selected again
+	for _, child := range children {
+		if child.object == nil {
+			continue
+		}
+		name := child.object.GetName()
+		switch child.object.(type) {
+		case *corev1.ConfigMap:
+			if metadata, ok := configMaps[name]; ok {
+				hashSource.ConfigMaps[name] = getConfigMapData(configObject{object: child.object, allKeys: metadata.allKeys, keys: metadata.keys})
+			}
+		case *corev1.Secret:
+			if metadata, ok := secrets[name]; ok {
+				hashSource.Secrets[name] = getSecretData(configObject{object: child.object, allKeys: metadata.allKeys, keys: metadata.keys})
+			}
+		default:
+			return nil, fmt.Errorf("passed unknown type: %v", reflect.TypeOf(child))
+		}
+	}
+
+	hashSourceBytes, err := json.Marshal(hashSource)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal JSON: %v", err)
+	}
+	return hashSourceBytes, nil
+}
+
+// getLegacyChildNamesByType returns the ConfigMaps and Secrets referenced by
+// the instance as they were selected before hashes were versioned
+func getLegacyChildNamesByType(obj podController) (map[string]configMetadata, map[string]configMetadata) {
+	configMaps := make(map[string]configMetadata)
+	secrets := make(map[string]configMetadata)
+
+	for _, vol := range obj.GetPodTemplate().Spec.Volumes {
+		if cm := vol.VolumeSource.ConfigMap; cm != nil {
+			configMaps[cm.Name] = configMetadata{allKeys: true}
+		}
+		if s := vol.VolumeSource.Secret; s != nil {
+			secrets[s.SecretName] = configMetadata{allKeys: true}
+		}
+	}
+
+	for _, container := range obj.GetPodTemplate().Spec.Containers {
+		for _, env := range container.EnvFrom {
+			if cm := env.ConfigMapRef; cm != nil {
+				configMaps[cm.Name] = configMetadata{allKeys: true}
+			}
+			if s := env.SecretRef; s != nil {
+				secrets[s.Name] = configMetadata{allKeys: true}
+			}
+		}
+	}
+
+	for _, container := range obj.GetPodTemplate().Spec.Containers {
+		for _, env := range container.Env {
+			if valFrom := env.ValueFrom; valFrom != nil {
+				if cm := valFrom.ConfigMapKeyRef; cm != nil {
+					configMaps[cm.Name] = addLegacyKey(configMaps[cm.Name], cm.Key)
+				}
+				if s := valFrom.SecretKeyRef; s != nil {
+					secrets[s.Name] = addLegacyKey(secrets[s.Name], s.Key)
+				}
+			}
+		}
+	}
+
+	return configMaps, secrets
+}
+
+// addLegacyKey adds the key to the metadata unless all keys are selected
+func addLegacyKey(metadata configMetadata, key string) configMetadata {
+	if !metadata.allKeys {
+		if metadata.keys == nil {
+			metadata.keys = make(map[string]struct{})
+		}
+		metadata.keys[key] = struct{}{}
+	}
+	return metadata
+}
+
+// getHashSource serializes the configuration within the child objects in a
+// reproducible manner so that it can be hashed
+func getHashSource(children []configObject) ([]byte, error) {
+	// hashSource contains all the data to be hashed
+	// ConfigMapsBinary is omitted when no ConfigMap has BinaryData so that the
+	// hash for existing configuration is unchanged
+	hashSource := struct {
+		ConfigMaps       map[string]map[string]string `json:"configMaps"`
+		ConfigMapsBinary map[string]map[string][]byte `json:"configMapsBinary,omitempty"`
+		Secrets          map[string]map[string][]byte `json:"secrets"`
+	}{
+		ConfigMaps:       make(map[string]map[string]string),
+		ConfigMapsBinary: make(map[string]map[string][]byte),
+		Secrets:          make(map[string]map[string][]byte),
+	}
+
 	// Add the data from each child to the hashSource
 	// All children should be in the same namespace so each one should have a
 	// unique name
@@ -45,10 +302,13 @@ func calculateConfigHash(children []configObject) (string, error) {
 			switch child.object.(type) {
 			case *corev1.ConfigMap:
 				hashSource.ConfigMaps[child.object.GetName()] = getConfigMapData(child)
+				if binaryData := getConfigMapBinaryData(child); len(binaryData) > 0 {
+					hashSource.ConfigMapsBinary[child.object.GetName()] = binaryData
+				}
 			case *corev1.Secret:
 				hashSource.Secrets[child.object.GetName()] = getSecretData(child)
 			default:
-				return "", fmt.Errorf("passed unknown type: %v", reflect.TypeOf(child))
+				return nil, fmt.Errorf("passed unknown type: %v", reflect.TypeOf(child))
 			}
 		}
 	}
@@ -56,11 +316,80 @@ func calculateConfigHash(children []configObject) (string, error) {
 	// Convert the hashSource to a byte slice so that it can be hashed
 	hashSourceBytes, err := json.Marshal(hashSource)
 	if err != nil {
-		return "", fmt.Errorf("unable to marshal JSON: %v", err)
+		return nil, fmt.Errorf("unable to marshal JSON: %v", err)
+	}
+	return hashSourceBytes, nil
+}
+
+// calculateHash returns the configuration hash to set on the instance and the
+// hash to record as its equivalent, if any.
+// The hash is calculated with the current hash version and the hash key from
+// the Handler's Options. If the existing hash was calculated from the same
+// configuration by an earlier hash version or with the previous hash key, it
+// is kept so that upgrading Wave or rotating the key doesn't trigger a
+// rollout of every instance, and the current hash is returned as its
+// equivalent.
+// Once an equivalent hash has been recorded it is compared in place of the
+// existing hash, so later changes are detected with the current hash version
+// and the previous hash key can be retired.
+// Hash versions that can't be calculated from digests are never matched when
+// the DigestCache is used.
+func (h *Handler) calculateHash(instance podController, children []configObject) (string, string, error) {
+	hash, err := calculateVersionedHash(instance, children, currentHashVersion, h.options.HashKey, h.digested())
+	if err != nil {
+		return "", "", err
+	}
+
+	existing := getConfigHash(instance)
+	if existing == "" || existing == hash {
+		return hash, "", nil
+	}
+
+	recorded := existing
+	if equivalent := getEquivalentConfigHash(instance); equivalent != "" {
+		recorded = equivalent
+	}
+	matches, err := h.hashMatches(instance, children, recorded)
+	if err != nil {
+		return "", "", err
+	}
+	if matches {
+		return existing, hash, nil
 	}
+	return hash, "", nil
+}
 
-	hashBytes := sha256.Sum256(hashSourceBytes)
-	return fmt.Sprintf("%x", hashBytes), nil
+// digested returns true if the Handler reads children from the DigestCache
+func (h *Handler) digested() bool {
+	return h.options.DigestCache != nil
+}
+
+// hashMatches returns true if the given hash was calculated from the children
+// by its hash version with any of the Handler's hash keys
+func (h *Handler) hashMatches(instance podController, children []configObject, hash string) (bool, error) {
+	version := getHashVersion(hash)
+	if source, ok := hashSources[version]; !ok || (h.digested() && !source.fromDigests) {
+		return false, nil
+	}
+	for _, key := range h.hashKeys() {
+		calculated, err := calculateVersionedHash(instance, children, version, key, h.digested())
+		if err != nil {
+			return false, err
+		}
+		if hmac.Equal([]byte(calculated), []byte(hash)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// hashKeys returns the keys that existing hashes may have been calculated with
+func (h *Handler) hashKeys() [][]byte {
+	keys := [][]byte{h.options.HashKey}
+	if len(h.options.PreviousHashKey) > 0 {
+		keys = append(keys, h.options.PreviousHashKey)
+	}
+	return keys
 }
 
 // getConfigMapData extracts all the relevant data from the ConfigMap, whether that is
@@ -79,6 +408,22 @@ func getConfigMapData(child configObject) map[string]string {
 	return keyData
 }
 
+// getConfigMapBinaryData extracts all the relevant binary data from the
+// ConfigMap, whether that is the whole ConfigMap or only the specified keys.
+func getConfigMapBinaryData(child configObject) map[string][]byte {
+	cm := *child.object.(*corev1.ConfigMap)
+	if child.allKeys {
+		return cm.BinaryData
+	}
+	keyData := make(map[string][]byte)
+	for key := range child.keys {
+		if value, exists := cm.BinaryData[key]; exists {
+			keyData[key] = value
+		}
+	}
+	return keyData
+}
+
 // getSecretData extracts all the relevant data from the Secret, whether that is
 // the whole Secret or only the specified keys.
 func getSecretData(child configObject) map[string][]byte {
@@ -95,6 +440,12 @@ func getSecretData(child configObject) map[string][]byte {
 	return keyData
 }
 
+// getConfigHash returns the configuration hash currently set on the given
+// podController
+func getConfigHash(obj podController) string {
+	return obj.GetPodTemplate().GetAnnotations()[ConfigHashAnnotation]
+}
+
 // setConfigHash upates the configuration hash of the given Deployment to the
 // given string
 func setConfigHash(obj podController, hash string) {
@@ -110,3 +461,30 @@ func setConfigHash(obj podController, hash string) {
 	podTemplate.SetAnnotations(annotations)
 	obj.SetPodTemplate(podTemplate)
 }
+
+// getEquivalentConfigHash returns the current configuration hash recorded on
+// the given podController when its Pod Template keeps an earlier hash
+func getEquivalentConfigHash(obj podController) string {
+	return obj.GetAnnotations()[EquivalentConfigHashAnnotation]
+}
+
+// setEquivalentConfigHash records the current configuration hash on the given
+// podController, or removes it if hash is empty.
+// It is set on the podController's metadata so that recording it doesn't
+// modify the Pod Template.
+func setEquivalentConfigHash(obj podController, hash string) {
+	annotations := obj.GetAnnotations()
+	if hash == "" {
+		if _, ok := annotations[EquivalentConfigHashAnnotation]; ok {
+			delete(annotations, EquivalentConfigHashAnnotation)
+			obj.SetAnnotations(annotations)
+		}
+		return
+	}
+
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[EquivalentConfigHashAnnotation] = hash
+	obj.SetAnnotations(annotations)
+}
@@ -17,6 +17,9 @@ limitations under the License.
 package core
 
 import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
 	"sync"
 	"time"
 
@@ -25,6 +28,7 @@ import (
 	"github.com/pusher/wave/test/utils"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
@@ -179,6 +183,92 @@ var _ = Describe("Wave hash Suite", func() {
 			Expect(h2).To(Equal(h1))
 		})
 
+		It("returns a different hash when an allKeys ConfigMap's BinaryData is updated", func() {
+			c := []configObject{
+				{object: cm1, allKeys: true},
+				{object: s1, allKeys: true},
+			}
+
+			h1, err := calculateConfigHash(c)
+			Expect(err).NotTo(HaveOccurred())
+
+			cm1.BinaryData = map[string][]byte{"binary1": []byte("binary")}
+			m.Update(cm1).Should(Succeed())
+			h2, err := calculateConfigHash(c)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(h2).NotTo(Equal(h1))
+
+			cm1.BinaryData["binary1"] = []byte("modified")
+			m.Update(cm1).Should(Succeed())
+			h3, err := calculateConfigHash(c)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(h3).NotTo(Equal(h2))
+		})
+
+		It("returns a different hash when a single-field ConfigMap's BinaryData is updated", func() {
+			cm1.BinaryData = map[string][]byte{"binary1": []byte("binary")}
+			m.Update(cm1).Should(Succeed())
+
+			c := []configObject{
+				{object: cm1, allKeys: false, keys: map[string]struct{}{
+					"binary1": {},
+				},
+				},
+			}
+
+			h1, err := calculateConfigHash(c)
+			Expect(err).NotTo(HaveOccurred())
+
+			cm1.BinaryData["binary1"] = []byte("modified")
+			m.Update(cm1).Should(Succeed())
+			h2, err := calculateConfigHash(c)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(h2).NotTo(Equal(h1))
+		})
+
+		It("returns the same hash when a single-field ConfigMap's BinaryData is updated but not for that field", func() {
+			c := []configObject{
+				{object: cm1, allKeys: false, keys: map[string]struct{}{
+					"key1": {},
+				},
+				},
+			}
+
+			h1, err := calculateConfigHash(c)
+			Expect(err).NotTo(HaveOccurred())
+
+			cm1.BinaryData = map[string][]byte{"binary1": []byte("binary")}
+			m.Update(cm1).Should(Succeed())
+			h2, err := calculateConfigHash(c)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(h2).To(Equal(h1))
+		})
+
+		It("returns the same hash as earlier versions when there is no BinaryData", func() {
+			c := []configObject{
+				{object: cm1, allKeys: true},
+				{object: s1, allKeys: true},
+			}
+
+			legacySource := struct {
+				ConfigMaps map[string]map[string]string `json:"configMaps"`
+				Secrets    map[string]map[string][]byte `json:"secrets"`
+			}{
+				ConfigMaps: map[string]map[string]string{cm1.GetName(): cm1.Data},
+				Secrets:    map[string]map[string][]byte{s1.GetName(): s1.Data},
+			}
+			legacyBytes, err := json.Marshal(legacySource)
+			Expect(err).NotTo(HaveOccurred())
+
+			h, err := calculateConfigHash(c)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(h).To(Equal(fmt.Sprintf("%x", sha256.Sum256(legacyBytes))))
+		})
+
 		It("returns the same hash when a child's metadata is updated", func() {
 			c := []configObject{
 				{object: cm1, allKeys: true},
@@ -241,6 +331,173 @@ var _ = Describe("Wave hash Suite", func() {
 		})
 	})
 
+	Context("calculateVersionedHash with a hash key", func() {
+		var instance podController
+		var c []configObject
+
+		BeforeEach(func() {
+			instance = &deployment{utils.ExampleDeployment.DeepCopy()}
+			c = []configObject{
+				{object: utils.ExampleConfigMap1.DeepCopy(), allKeys: true},
+				{object: utils.ExampleSecret1.DeepCopy(), allKeys: true},
+			}
+		})
+
+		It("returns the same hash for the same key", func() {
+			h1, err := calculateVersionedHash(instance, c, currentHashVersion, []byte("key1"), false)
+			Expect(err).NotTo(HaveOccurred())
+			h2, err := calculateVersionedHash(instance, c, currentHashVersion, []byte("key1"), false)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(h2).To(Equal(h1))
+		})
+
+		It("returns a different hash for a different key", func() {
+			h1, err := calculateVersionedHash(instance, c, currentHashVersion, []byte("key1"), false)
+			Expect(err).NotTo(HaveOccurred())
+			h2, err := calculateVersionedHash(instance, c, currentHashVersion, []byte("key2"), false)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(h2).NotTo(Equal(h1))
+		})
+
+		It("returns a different hash to the unkeyed hash", func() {
+			h1, err := calculateVersionedHash(instance, c, currentHashVersion, nil, false)
+			Expect(err).NotTo(HaveOccurred())
+			h2, err := calculateVersionedHash(instance, c, currentHashVersion, []byte("key1"), false)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(h2).NotTo(Equal(h1))
+		})
+	})
+
+	Context("calculateVersionedHash", func() {
+		var instance podController
+		var c []configObject
+
+		BeforeEach(func() {
+			instance = &deployment{utils.ExampleDeployment.DeepCopy()}
+			c = []configObject{
+				{object: utils.ExampleConfigMap1.DeepCopy(), allKeys: true},
+				{object: utils.ExampleSecret1.DeepCopy(), allKeys: true},
+			}
+		})
+
+		It("prefixes the hash with its version", func() {
+			h, err := calculateVersionedHash(instance, c, currentHashVersion, nil, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(h).To(HavePrefix(currentHashVersion + hashVersionSeparator))
+			Expect(getHashVersion(h)).To(Equal(currentHashVersion))
+		})
+
+		It("does not prefix legacy hashes", func() {
+			h, err := calculateVersionedHash(instance, c, legacyHashVersion, nil, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(h).NotTo(ContainSubstring(hashVersionSeparator))
+			Expect(getHashVersion(h)).To(Equal(legacyHashVersion))
+		})
+
+		It("returns the same hash from children read from the DigestCache", func() {
+			cm := c[0].object.(*corev1.ConfigMap)
+			cm.BinaryData = map[string][]byte{"binary1": []byte("binary")}
+			secret := c[1].object.(*corev1.Secret)
+			secret.Data = map[string][]byte{"key1": []byte("example1:key1")}
+
+			digested := []configObject{
+				{object: digestConfigMap(cm), allKeys: true},
+				{object: digestSecret(secret), allKeys: true},
+			}
+
+			h1, err := calculateVersionedHash(instance, c, currentHashVersion, nil, false)
+			Expect(err).NotTo(HaveOccurred())
+			h2, err := calculateVersionedHash(instance, digested, currentHashVersion, nil, true)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(h2).To(Equal(h1))
+		})
+
+		It("returns an error when calculating a legacy hash from digests", func() {
+			_, err := calculateVersionedHash(instance, c, legacyHashVersion, nil, true)
+			Expect(err).To(HaveOccurred())
+		})
+
+		Context("with references added since hashes were versioned", func() {
+			var legacyHash string
+			var cm2 *corev1.ConfigMap
+
+			BeforeEach(func() {
+				var err error
+				legacyHash, err = calculateVersionedHash(instance, c, legacyHashVersion, nil, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				cm2 = utils.ExampleConfigMap2.DeepCopy()
+				c = append(c, configObject{object: cm2, allKeys: true})
+			})
+
+			It("ignores ConfigMaps referenced by init containers", func() {
+				template := instance.GetPodTemplate()
+				template.Spec.InitContainers = []corev1.Container{{
+					Name: "init",
+					EnvFrom: []corev1.EnvFromSource{{
+						ConfigMapRef: &corev1.ConfigMapEnvSource{
+							LocalObjectReference: corev1.LocalObjectReference{Name: cm2.GetName()},
+						},
+					}},
+				}}
+				instance.SetPodTemplate(template)
+
+				h, err := calculateVersionedHash(instance, c, legacyHashVersion, nil, false)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(h).To(Equal(legacyHash))
+			})
+
+			It("ignores ConfigMaps referenced by projected volumes", func() {
+				template := instance.GetPodTemplate()
+				template.Spec.Volumes = append(template.Spec.Volumes, corev1.Volume{
+					Name: "projected",
+					VolumeSource: corev1.VolumeSource{
+						Projected: &corev1.ProjectedVolumeSource{
+							Sources: []corev1.VolumeProjection{{
+								ConfigMap: &corev1.ConfigMapProjection{
+									LocalObjectReference: corev1.LocalObjectReference{Name: cm2.GetName()},
+								},
+							}},
+						},
+					},
+				})
+				instance.SetPodTemplate(template)
+
+				h, err := calculateVersionedHash(instance, c, legacyHashVersion, nil, false)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(h).To(Equal(legacyHash))
+			})
+
+			It("hashes ConfigMaps mounted with items in full", func() {
+				c[0] = configObject{object: c[0].object, allKeys: false, keys: map[string]struct{}{"key1": {}}}
+
+				h, err := calculateVersionedHash(instance, c, legacyHashVersion, nil, false)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(h).To(Equal(legacyHash))
+			})
+
+			It("ignores BinaryData", func() {
+				cm1 := c[0].object.(*corev1.ConfigMap)
+				cm1.BinaryData = map[string][]byte{"binary1": []byte("binary")}
+
+				h, err := calculateVersionedHash(instance, c, legacyHashVersion, nil, false)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(h).To(Equal(legacyHash))
+			})
+		})
+
+		It("returns an error for an unknown version", func() {
+			_, err := calculateVersionedHash(instance, c, "unknown", nil, false)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
 	Context("setConfigHash", func() {
 		var deploymentObject *appsv1.Deployment
 		var podControllerDeployment podController
@@ -281,5 +538,43 @@ var _ = Describe("Wave hash Suite", func() {
 			Expect(ok).To(BeTrue())
 			Expect(hash).To(Equal("annotation"))
 		})
+
+		It("sets the hash annotation on the Job template of a CronJob", func() {
+			cronjobObject := utils.ExampleCronJob.DeepCopy()
+			setConfigHash(&cronjob{cronjobObject}, "1234")
+
+			podAnnotations := cronjobObject.Spec.JobTemplate.Spec.Template.GetAnnotations()
+			Expect(podAnnotations).NotTo(BeNil())
+
+			hash, ok := podAnnotations[ConfigHashAnnotation]
+			Expect(ok).To(BeTrue())
+			Expect(hash).To(Equal("1234"))
+		})
+
+		Context("for a custom resource", func() {
+			var workloadObject *unstructured.Unstructured
+
+			BeforeEach(func() {
+				workloadObject = utils.ExampleWorkload.DeepCopy()
+				err := unstructured.SetNestedField(workloadObject.Object, "preserved", "spec", "template", "spec", "unknownField")
+				Expect(err).NotTo(HaveOccurred())
+
+				setConfigHash(&unstructuredPodController{workloadObject, []string{"spec", "template"}}, "1234")
+			})
+
+			It("sets the hash annotation on the embedded template", func() {
+				hash, found, err := unstructured.NestedString(workloadObject.Object, "spec", "template", "metadata", "annotations", ConfigHashAnnotation)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(found).To(BeTrue())
+				Expect(hash).To(Equal("1234"))
+			})
+
+			It("preserves fields unknown to the PodTemplateSpec", func() {
+				value, found, err := unstructured.NestedString(workloadObject.Object, "spec", "template", "spec", "unknownField")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(found).To(BeTrue())
+				Expect(value).To(Equal("preserved"))
+			})
+		})
 	})
 })
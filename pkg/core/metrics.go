@@ -0,0 +1,153 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Results of reconciling a workload, used as the result label of
+// reconcileTotal
+const (
+	reconcileIgnored              = "ignored"
+	reconcileCleanedUp            = "cleaned_up"
+	reconcileMissingChildren      = "missing_children"
+	reconcileUnchanged            = "unchanged"
+	reconcileUpdated              = "updated"
+	reconcileCleanupError         = "cleanup_error"
+	reconcileFetchChildrenError   = "fetch_children_error"
+	reconcileOwnerReferencesError = "owner_references_error"
+	reconcileHashError            = "hash_error"
+	reconcileUpdateError          = "update_error"
+)
+
+var (
+	// filteredEvents counts the watch events dropped by Wave's predicates
+	filteredEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wave_filtered_events_total",
+		Help: "Total number of watch events dropped before reaching the work queue",
+	}, []string{"kind", "reason"})
+
+	// reconcileTotal counts the outcomes of reconciling workloads
+	reconcileTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wave_reconcile_total",
+		Help: "Total number of workload reconciliations by result",
+	}, []string{"kind", "result"})
+
+	// rolloutsTriggered counts the configuration hash changes made to each
+	// workload, each of which rolls the workload out
+	rolloutsTriggered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wave_rollouts_triggered_total",
+		Help: "Total number of rollouts triggered by configuration hash changes",
+	}, []string{"namespace", "kind", "name"})
+
+	// ownerReferenceUpdates counts the OwnerReferences added to and removed
+	// from children
+	ownerReferenceUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wave_owner_reference_updates_total",
+		Help: "Total number of OwnerReferences added to or removed from ConfigMaps and Secrets",
+	}, []string{"kind", "operation"})
+
+	// dependencyFetchDuration observes how long fetching each child takes
+	dependencyFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wave_dependency_fetch_duration_seconds",
+		Help:    "Time taken to fetch the ConfigMaps and Secrets referenced by workloads",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"kind"})
+
+	// managedWorkloads is the number of workloads with the required annotation
+	managedWorkloads = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "wave_managed_workloads",
+		Help: "Number of workloads with the wave.pusher.com/update-on-config-change annotation",
+	}, []string{"kind"})
+
+	// stalePods is the number of each workload's Pods that are not running
+	// its current configuration
+	stalePods = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "wave_stale_pods",
+		Help: "Number of Pods whose configuration hash differs from their workload's",
+	}, []string{"namespace", "kind", "name"})
+
+	// stalePodsDuration is how long each workload has had stale Pods
+	stalePodsDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "wave_stale_pods_duration_seconds",
+		Help: "Time since the workload's Pods started running a stale configuration",
+	}, []string{"namespace", "kind", "name"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		filteredEvents,
+		reconcileTotal,
+		rolloutsTriggered,
+		ownerReferenceUpdates,
+		dependencyFetchDuration,
+		managedWorkloads,
+		stalePods,
+		stalePodsDuration,
+	)
+}
+
+// managed tracks the workloads counted by managedWorkloads
+var managed = &managedSet{workloads: make(map[string]map[types.NamespacedName]struct{})}
+
+// managedSet is the set of managed workloads of each kind
+type managedSet struct {
+	mutex     sync.Mutex
+	workloads map[string]map[types.NamespacedName]struct{}
+}
+
+// set adds the workload to or removes it from the set and updates the
+// managedWorkloads gauge
+func (m *managedSet) set(kind string, name types.NamespacedName, isManaged bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.workloads[kind]; !ok {
+		m.workloads[kind] = make(map[types.NamespacedName]struct{})
+	}
+	if isManaged {
+		m.workloads[kind][name] = struct{}{}
+	} else {
+		delete(m.workloads[kind], name)
+	}
+	managedWorkloads.WithLabelValues(kind).Set(float64(len(m.workloads[kind])))
+}
+
+// observeReconcile records the result of reconciling the instance
+func observeReconcile(instance podController, result string) {
+	kind := groupVersionKindOf(instance).Kind
+	reconcileTotal.WithLabelValues(kind, result).Inc()
+
+	name := types.NamespacedName{Namespace: instance.GetNamespace(), Name: instance.GetName()}
+	managed.set(kind, name, hasRequiredAnnotation(instance) && !toBeDeleted(instance))
+}
+
+// observeRollout records a configuration hash change on the instance
+func observeRollout(instance podController) {
+	rolloutsTriggered.WithLabelValues(instance.GetNamespace(), groupVersionKindOf(instance).Kind, instance.GetName()).Inc()
+}
+
+// observeFetch records the time taken to fetch a child since start
+func observeFetch(obj Object, start time.Time) {
+	dependencyFetchDuration.WithLabelValues(kindOf(obj)).Observe(time.Since(start).Seconds())
+}
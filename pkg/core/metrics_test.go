@@ -0,0 +1,102 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/pusher/wave/test/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("Wave metrics Suite", func() {
+	var d *appsv1.Deployment
+	var name types.NamespacedName
+
+	var reconcileCount = func(result string) float64 {
+		metric := &dto.Metric{}
+		Expect(reconcileTotal.WithLabelValues("Deployment", result).Write(metric)).To(Succeed())
+		return metric.GetCounter().GetValue()
+	}
+
+	var managedCount = func() float64 {
+		metric := &dto.Metric{}
+		Expect(managedWorkloads.WithLabelValues("Deployment").Write(metric)).To(Succeed())
+		return metric.GetGauge().GetValue()
+	}
+
+	var rolloutCount = func() float64 {
+		metric := &dto.Metric{}
+		Expect(rolloutsTriggered.WithLabelValues(d.GetNamespace(), "Deployment", d.GetName()).Write(metric)).To(Succeed())
+		return metric.GetCounter().GetValue()
+	}
+
+	BeforeEach(func() {
+		d = utils.ExampleDeployment.DeepCopy()
+		d.SetName("metrics-example")
+		name = types.NamespacedName{Namespace: d.GetNamespace(), Name: d.GetName()}
+		managed.set("Deployment", name, false)
+	})
+
+	It("counts reconciles of workloads without the required annotation as ignored", func() {
+		before := reconcileCount(reconcileIgnored)
+		h := NewHandler(nil, nil)
+		_, err := h.HandleDeployment(d)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reconcileCount(reconcileIgnored)).To(Equal(before + 1))
+	})
+
+	It("counts reconciles by result", func() {
+		before := reconcileCount(reconcileUpdateError)
+		observeReconcile(&deployment{Deployment: d}, reconcileUpdateError)
+		Expect(reconcileCount(reconcileUpdateError)).To(Equal(before + 1))
+	})
+
+	It("counts workloads with the required annotation as managed", func() {
+		before := managedCount()
+		d.SetAnnotations(map[string]string{RequiredAnnotation: "true"})
+		observeReconcile(&deployment{Deployment: d}, reconcileUnchanged)
+		Expect(managedCount()).To(Equal(before + 1))
+
+		By("counting each workload once")
+		observeReconcile(&deployment{Deployment: d}, reconcileUnchanged)
+		Expect(managedCount()).To(Equal(before + 1))
+
+		By("no longer counting the workload once the annotation is removed")
+		d.SetAnnotations(map[string]string{})
+		observeReconcile(&deployment{Deployment: d}, reconcileCleanedUp)
+		Expect(managedCount()).To(Equal(before))
+	})
+
+	It("no longer counts workloads that are not found", func() {
+		before := managedCount()
+		d.SetAnnotations(map[string]string{RequiredAnnotation: "true"})
+		observeReconcile(&deployment{Deployment: d}, reconcileUnchanged)
+		Expect(managedCount()).To(Equal(before + 1))
+
+		NewHandler(nil, nil).HandleNotFound("Deployment", name)
+		Expect(managedCount()).To(Equal(before))
+	})
+
+	It("counts rollouts per workload", func() {
+		before := rolloutCount()
+		observeRollout(&deployment{Deployment: d})
+		Expect(rolloutCount()).To(Equal(before + 1))
+	})
+})
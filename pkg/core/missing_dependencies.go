@@ -0,0 +1,70 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+)
+
+// handleMissingChildren records that required children of the instance do
+// not exist.
+// The instance is not requeued as it will be reconciled once the missing
+// children are created.
+func (h *Handler) handleMissingChildren(obj podController, err *missingChildrenError) (reconcile.Result, error) {
+	log := logf.Log.WithName("wave")
+	log.V(0).Info("Waiting for missing children", "namespace", obj.GetNamespace(), "name", obj.GetName(), "missing", err.missing)
+	h.recorder.Eventf(obj.GetObject(), corev1.EventTypeWarning, "MissingDependencies", "Waiting for required children to be created: %s", strings.Join(err.missing, ", "))
+
+	copy := obj.DeepCopy()
+	setMissingDependencies(copy, err.missing)
+	if !reflect.DeepEqual(obj, copy) {
+		err := h.Update(context.TODO(), copy.GetObject())
+		if err != nil {
+			return reconcile.Result{}, fmt.Errorf("error updating instance %s/%s: %v", obj.GetNamespace(), obj.GetName(), err)
+		}
+	}
+	return reconcile.Result{}, nil
+}
+
+// setMissingDependencies sets the missing dependencies annotation on the
+// given podController to list the missing children
+func setMissingDependencies(obj podController, missing []string) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[MissingDependenciesAnnotation] = strings.Join(missing, ",")
+	obj.SetAnnotations(annotations)
+}
+
+// clearMissingDependencies removes the missing dependencies annotation from
+// the given podController
+func clearMissingDependencies(obj podController) {
+	annotations := obj.GetAnnotations()
+	if _, ok := annotations[MissingDependenciesAnnotation]; !ok {
+		return
+	}
+	delete(annotations, MissingDependenciesAnnotation)
+	obj.SetAnnotations(annotations)
+}
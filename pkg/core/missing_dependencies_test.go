@@ -0,0 +1,66 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pusher/wave/test/utils"
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+var _ = Describe("Wave missing dependencies Suite", func() {
+	var deploymentObject *appsv1.Deployment
+	var podControllerDeployment podController
+
+	BeforeEach(func() {
+		deploymentObject = utils.ExampleDeployment.DeepCopy()
+		podControllerDeployment = &deployment{deploymentObject}
+	})
+
+	Context("setMissingDependencies", func() {
+		It("lists the missing children in the annotation", func() {
+			setMissingDependencies(podControllerDeployment, []string{"ConfigMap/example1", "Secret/example1"})
+
+			Expect(deploymentObject.GetAnnotations()).To(HaveKeyWithValue(MissingDependenciesAnnotation, "ConfigMap/example1,Secret/example1"))
+		})
+
+		It("leaves existing annotations in place", func() {
+			deploymentObject.SetAnnotations(map[string]string{"existing": "annotation"})
+			setMissingDependencies(podControllerDeployment, []string{"ConfigMap/example1"})
+
+			Expect(deploymentObject.GetAnnotations()).To(HaveKeyWithValue("existing", "annotation"))
+		})
+	})
+
+	Context("clearMissingDependencies", func() {
+		It("removes the annotation", func() {
+			setMissingDependencies(podControllerDeployment, []string{"ConfigMap/example1"})
+			clearMissingDependencies(podControllerDeployment)
+
+			Expect(deploymentObject.GetAnnotations()).NotTo(HaveKey(MissingDependenciesAnnotation))
+		})
+
+		It("leaves existing annotations in place", func() {
+			deploymentObject.SetAnnotations(map[string]string{"existing": "annotation"})
+			setMissingDependencies(podControllerDeployment, []string{"ConfigMap/example1"})
+			clearMissingDependencies(podControllerDeployment)
+
+			Expect(deploymentObject.GetAnnotations()).To(HaveKeyWithValue("existing", "annotation"))
+		})
+	})
+})
@@ -0,0 +1,162 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// TrackingMode determines how Wave tracks the ConfigMaps and Secrets
+// referenced by an instance
+type TrackingMode string
+
+const (
+	// OwnerReferencesTracking adds an OwnerReference pointing to the instance
+	// to each referenced ConfigMap and Secret, so that changes to them trigger
+	// a reconcile of the instance
+	OwnerReferencesTracking TrackingMode = "owner-references"
+
+	// IndexTracking maps changes to ConfigMaps and Secrets back to the
+	// instances referencing them using an in-memory index of their Pod
+	// Templates. ConfigMaps and Secrets are never modified in this mode.
+	IndexTracking TrackingMode = "index"
+)
+
+// ValidationMode determines how the validating webhook handles instances that
+// reference required ConfigMaps, Secrets or keys that don't exist
+type ValidationMode string
+
+const (
+	// DenyValidation rejects the instance
+	DenyValidation ValidationMode = "deny"
+
+	// WarnValidation admits the instance and reports what is missing
+	WarnValidation ValidationMode = "warn"
+)
+
+// Options configures the Handler and the controllers that use it
+type Options struct {
+	// TrackingMode determines how referenced ConfigMaps and Secrets are tracked
+	TrackingMode TrackingMode
+
+	// DigestCache, when set, is used to read and watch ConfigMaps and Secrets
+	// in place of the Manager's cache. Configuration hashes are then
+	// calculated from the digests of their values.
+	// It requires IndexTracking as digested objects must never be written back.
+	DigestCache *DigestCache
+
+	// HashKey, when set, is used to calculate configuration hashes with
+	// HMAC-SHA256 so that they cannot be used to confirm guesses of the
+	// configuration
+	HashKey []byte
+
+	// PreviousHashKey is the HashKey being rotated out.
+	// Hashes calculated with it are kept until the configuration changes, and
+	// the equivalent hash calculated with HashKey is recorded on the instance.
+	PreviousHashKey []byte
+
+	// ValidationMode determines whether the validating webhook rejects
+	// instances with missing required children.
+	// Instances are rejected unless it is WarnValidation.
+	ValidationMode ValidationMode
+
+	// StalePodsThreshold is how long Pods may run a stale configuration
+	// before a StalePods Event is recorded on their instance.
+	// No Events are recorded if it is zero.
+	StalePodsThreshold time.Duration
+
+	// ServiceAccount is the username Wave authenticates as, for example
+	// system:serviceaccount:wave:wave. The validating webhook doesn't check
+	// updates made by it.
+	ServiceAccount string
+
+	// ConfigDigestsKey is used to calculate the digests of ConfigMap and
+	// Secret values recorded on instances to summarise configuration changes.
+	// It is generated by Wave and stored in a Secret by
+	// EnsureConfigDigestsKey. A key generated as Wave starts is used if it is
+	// empty.
+	ConfigDigestsKey []byte
+
+	// ConfigMapValueDiffs, when set, records the ConfigMap values behind the
+	// configuration hash so that ConfigChanged Events show how they changed.
+	// Secret values are never recorded.
+	// It can't be used with the DigestCache, which doesn't hold the values.
+	ConfigMapValueDiffs bool
+}
+
+// LoadHashKey reads a hash key from the file at path.
+// Trailing newlines are removed.
+func LoadHashKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading hash key: %v", err)
+	}
+	key = bytes.TrimRight(key, "\r\n")
+	if len(key) == 0 {
+		return nil, fmt.Errorf("hash key %s is empty", path)
+	}
+	return key, nil
+}
+
+// Validate checks that the Options can be used together
+func (o Options) Validate() error {
+	if o.DigestCache != nil && o.TrackingMode != IndexTracking {
+		return fmt.Errorf("the digest cache requires the %q tracking mode", IndexTracking)
+	}
+	if o.DigestCache != nil && o.ConfigMapValueDiffs {
+		return fmt.Errorf("ConfigMap value diffs can't be used with the digest cache")
+	}
+	if len(o.PreviousHashKey) > 0 && len(o.HashKey) == 0 {
+		return fmt.Errorf("a previous hash key requires a hash key")
+	}
+	if o.StalePodsThreshold < 0 {
+		return fmt.Errorf("the stale pods threshold must not be negative")
+	}
+	return nil
+}
+
+// DefaultOptions are used by NewHandler and by the controllers when setting
+// up their watches.
+// They must be set before the controllers are added to the Manager.
+var DefaultOptions = Options{
+	TrackingMode:       OwnerReferencesTracking,
+	ValidationMode:     DenyValidation,
+	StalePodsThreshold: 10 * time.Minute,
+}
+
+// ParseTrackingMode validates the given tracking mode
+func ParseTrackingMode(mode string) (TrackingMode, error) {
+	switch TrackingMode(mode) {
+	case OwnerReferencesTracking, IndexTracking:
+		return TrackingMode(mode), nil
+	default:
+		return "", fmt.Errorf("unknown tracking mode %q, must be one of %q or %q", mode, OwnerReferencesTracking, IndexTracking)
+	}
+}
+
+// ParseValidationMode validates the given validation mode
+func ParseValidationMode(mode string) (ValidationMode, error) {
+	switch ValidationMode(mode) {
+	case DenyValidation, WarnValidation:
+		return ValidationMode(mode), nil
+	default:
+		return "", fmt.Errorf("unknown validation mode %q, must be one of %q or %q", mode, DenyValidation, WarnValidation)
+	}
+}
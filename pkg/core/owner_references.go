@@ -22,35 +22,62 @@ import (
 	"reflect"
 	"strings"
 
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
 // removeOwnerReferences iterates over a list of children and removes the owner
 // reference from the child before updating it
 func (h *Handler) removeOwnerReferences(obj podController, children []Object) error {
 	for _, child := range children {
-		// Filter the existing ownerReferences
-		ownerRefs := []metav1.OwnerReference{}
-		for _, ref := range child.GetOwnerReferences() {
-			if ref.UID != obj.GetUID() {
-				ownerRefs = append(ownerRefs, ref)
+		// Compare the ownerRefs and update if they have changed
+		if !reflect.DeepEqual(withoutOwnerReference(child, obj), child.GetOwnerReferences()) {
+			name := fmt.Sprintf("%s/%s", child.GetNamespace(), child.GetName())
+			child, err := h.writableChild(child)
+			if err != nil {
+				return fmt.Errorf("error getting child %s: %v", name, err)
 			}
-		}
+			ownerRefs := withoutOwnerReference(child, obj)
 
-		// Compare the ownerRefs and update if they have changed
-		if !reflect.DeepEqual(ownerRefs, child.GetOwnerReferences()) {
 			h.recorder.Eventf(child, corev1.EventTypeNormal, "RemoveWatch", "Removing watch for %s %s", kindOf(child), child.GetName())
 			child.SetOwnerReferences(ownerRefs)
-			err := h.Update(context.TODO(), child)
+			err = h.Update(context.TODO(), child)
 			if err != nil {
-				return fmt.Errorf("error updating child %s/%s: %v", child.GetNamespace(), child.GetName(), err)
+				return fmt.Errorf("error updating child %s: %v", name, err)
 			}
+			ownerReferenceUpdates.WithLabelValues(kindOf(child), "remove").Inc()
 		}
 	}
 	return nil
 }
 
+// withoutOwnerReference returns the child's OwnerReferences, filtering out any
+// pointing to the owner
+func withoutOwnerReference(child Object, owner podController) []metav1.OwnerReference {
+	ownerRefs := []metav1.OwnerReference{}
+	for _, ref := range child.GetOwnerReferences() {
+		if ref.UID != owner.GetUID() {
+			ownerRefs = append(ownerRefs, ref)
+		}
+	}
+	return ownerRefs
+}
+
+// writableChild returns a copy of the child that can be written back to the
+// API server.
+// Children read from the DigestCache hold digests in place of their values,
+// so they are read again from the API server.
+func (h *Handler) writableChild(child Object) (Object, error) {
+	if h.options.DigestCache == nil {
+		return child, nil
+	}
+	return h.options.DigestCache.getUndigested(child)
+}
+
 // updateOwnerReferences determines which children need to have their
 // OwnerReferences added/updated and which need to have their OwnerReferences
 // removed and then performs all updates
@@ -96,14 +123,20 @@ func (h *Handler) updateOwnerReference(owner podController, child Object) error
 		}
 	}
 
+	child, err := h.writableChild(child)
+	if err != nil {
+		return fmt.Errorf("error getting child: %v", err)
+	}
+
 	// Append the new OwnerReference and update the child
 	h.recorder.Eventf(child, corev1.EventTypeNormal, "AddWatch", "Adding watch for %s %s", kindOf(child), child.GetName())
 	ownerRefs := append(child.GetOwnerReferences(), ownerRef)
 	child.SetOwnerReferences(ownerRefs)
-	err := h.Update(context.TODO(), child)
+	err = h.Update(context.TODO(), child)
 	if err != nil {
 		return fmt.Errorf("error updating child: %v", err)
 	}
+	ownerReferenceUpdates.WithLabelValues(kindOf(child), "add").Inc()
 	return nil
 }
 
@@ -123,9 +156,10 @@ func getOrphans(existing []Object, current []configObject) []Object {
 func getOwnerReference(obj podController) metav1.OwnerReference {
 	t := true
 	f := false
+	gvk := groupVersionKindOf(obj)
 	return metav1.OwnerReference{
-		APIVersion:         "apps/v1",
-		Kind:               "Deployment",
+		APIVersion:         gvk.GroupVersion().String(),
+		Kind:               gvk.Kind,
 		Name:               obj.GetName(),
 		UID:                obj.GetUID(),
 		BlockOwnerDeletion: &t,
@@ -143,14 +177,20 @@ func isIn(list []configObject, child Object) bool {
 	return false
 }
 
-// kindOf returns the Kind of the given object as a string
-func kindOf(obj Object) string {
-	switch obj.(type) {
-	case *corev1.ConfigMap:
-		return "ConfigMap"
-	case *corev1.Secret:
-		return "Secret"
+// groupVersionKindOf returns the GroupVersionKind of the given podController
+func groupVersionKindOf(obj podController) schema.GroupVersionKind {
+	switch o := obj.GetObject().(type) {
+	case *appsv1.Deployment:
+		return appsv1.SchemeGroupVersion.WithKind("Deployment")
+	case *appsv1.StatefulSet:
+		return appsv1.SchemeGroupVersion.WithKind("StatefulSet")
+	case *appsv1.DaemonSet:
+		return appsv1.SchemeGroupVersion.WithKind("DaemonSet")
+	case *batchv1beta1.CronJob:
+		return batchv1beta1.SchemeGroupVersion.WithKind("CronJob")
+	case *unstructured.Unstructured:
+		return o.GroupVersionKind()
 	default:
-		return "Unknown"
+		return schema.GroupVersionKind{}
 	}
 }
@@ -26,6 +26,8 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
@@ -53,6 +55,7 @@ var _ = Describe("Wave owner references Suite", func() {
 	BeforeEach(func() {
 		mgr, err := manager.New(cfg, manager.Options{})
 		Expect(err).NotTo(HaveOccurred())
+		Expect(IndexOwners(mgr.GetFieldIndexer())).To(Succeed())
 		c = mgr.GetClient()
 		h = NewHandler(c, mgr.GetEventRecorderFor("wave"))
 		m = utils.Matcher{Client: c}
@@ -347,5 +350,83 @@ var _ = Describe("Wave owner references Suite", func() {
 			Expect(ref.BlockOwnerDeletion).NotTo(BeNil())
 			Expect(*ref.BlockOwnerDeletion).To(BeTrue())
 		})
+
+		Context("for a StatefulSet", func() {
+			var statefulsetObject *appsv1.StatefulSet
+
+			BeforeEach(func() {
+				statefulsetObject = utils.ExampleStatefulSet.DeepCopy()
+				statefulsetObject.SetUID(types.UID("statefulset-uid"))
+				ref = getOwnerReference(&statefulset{statefulsetObject})
+			})
+
+			It("sets the APIVersion", func() {
+				Expect(ref.APIVersion).To(Equal("apps/v1"))
+			})
+
+			It("sets the Kind", func() {
+				Expect(ref.Kind).To(Equal("StatefulSet"))
+			})
+
+			It("sets the UID", func() {
+				Expect(ref.UID).To(Equal(statefulsetObject.UID))
+			})
+
+			It("sets the Name", func() {
+				Expect(ref.Name).To(Equal(statefulsetObject.Name))
+			})
+		})
+
+		Context("for a DaemonSet", func() {
+			var daemonsetObject *appsv1.DaemonSet
+
+			BeforeEach(func() {
+				daemonsetObject = utils.ExampleDaemonSet.DeepCopy()
+				daemonsetObject.SetUID(types.UID("daemonset-uid"))
+				ref = getOwnerReference(&daemonset{daemonsetObject})
+			})
+
+			It("sets the APIVersion", func() {
+				Expect(ref.APIVersion).To(Equal("apps/v1"))
+			})
+
+			It("sets the Kind", func() {
+				Expect(ref.Kind).To(Equal("DaemonSet"))
+			})
+
+			It("sets the UID", func() {
+				Expect(ref.UID).To(Equal(daemonsetObject.UID))
+			})
+
+			It("sets the Name", func() {
+				Expect(ref.Name).To(Equal(daemonsetObject.Name))
+			})
+		})
+
+		Context("for a custom resource", func() {
+			var workloadObject *unstructured.Unstructured
+
+			BeforeEach(func() {
+				workloadObject = utils.ExampleWorkload.DeepCopy()
+				workloadObject.SetUID(types.UID("workload-uid"))
+				ref = getOwnerReference(&unstructuredPodController{workloadObject, []string{"spec", "template"}})
+			})
+
+			It("sets the APIVersion", func() {
+				Expect(ref.APIVersion).To(Equal("test.wave.pusher.com/v1alpha1"))
+			})
+
+			It("sets the Kind", func() {
+				Expect(ref.Kind).To(Equal("Example"))
+			})
+
+			It("sets the UID", func() {
+				Expect(ref.UID).To(Equal(workloadObject.GetUID()))
+			})
+
+			It("sets the Name", func() {
+				Expect(ref.Name).To(Equal(workloadObject.GetName()))
+			})
+		})
 	})
 })
@@ -0,0 +1,177 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+const (
+	// resyncReason is recorded when an update event was caused by an informer
+	// resync rather than a change to the object
+	resyncReason = "resync"
+
+	// dataUnchangedReason is recorded when a ConfigMap or Secret was updated
+	// without changing its data
+	dataUnchangedReason = "data-unchanged"
+
+	// statusOnlyReason is recorded when only the status of an instance was
+	// updated
+	statusOnlyReason = "status-only"
+
+	// podUnchangedReason is recorded when a Pod was updated without changing
+	// whether it is counted as stale
+	podUnchangedReason = "pod-unchanged"
+)
+
+// ChildDataChanged returns a Predicate for ConfigMaps and Secrets which drops
+// update events that don't change their data.
+// Updates from informer resyncs are also dropped as the instances are
+// resynced by their own watches.
+func ChildDataChanged() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if e.MetaOld.GetResourceVersion() == e.MetaNew.GetResourceVersion() {
+				filteredEvents.WithLabelValues(kindOf(e.ObjectNew), resyncReason).Inc()
+				return false
+			}
+			if !childDataChanged(e.ObjectOld, e.ObjectNew) {
+				filteredEvents.WithLabelValues(kindOf(e.ObjectNew), dataUnchangedReason).Inc()
+				return false
+			}
+			return true
+		},
+	}
+}
+
+// childDataChanged returns true unless both objects are ConfigMaps or
+// Secrets holding the same data
+func childDataChanged(old, new runtime.Object) bool {
+	switch o := old.(type) {
+	case *corev1.ConfigMap:
+		n, ok := new.(*corev1.ConfigMap)
+		return !ok || !reflect.DeepEqual(o.Data, n.Data) || !reflect.DeepEqual(o.BinaryData, n.BinaryData)
+	case *corev1.Secret:
+		n, ok := new.(*corev1.Secret)
+		return !ok || !reflect.DeepEqual(o.Data, n.Data)
+	default:
+		return true
+	}
+}
+
+// InstanceChanged returns a Predicate for instances which drops update events
+// that only change their status.
+// Updates from informer resyncs are kept so that instances are periodically
+// reconciled.
+func InstanceChanged() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if e.MetaOld.GetResourceVersion() == e.MetaNew.GetResourceVersion() {
+				return true
+			}
+			if statusOnlyChange(e.ObjectOld, e.ObjectNew) {
+				filteredEvents.WithLabelValues(kindOf(e.ObjectNew), statusOnlyReason).Inc()
+				return false
+			}
+			return true
+		},
+	}
+}
+
+// PodChanged returns a Predicate for Pods which drops update events that
+// don't change whether the Pod is counted as stale, such as status updates of
+// running Pods.
+// Updates from informer resyncs are also dropped as the instances are
+// resynced by their own watches.
+func PodChanged() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if e.MetaOld.GetResourceVersion() == e.MetaNew.GetResourceVersion() {
+				filteredEvents.WithLabelValues(kindOf(e.ObjectNew), resyncReason).Inc()
+				return false
+			}
+			if !podChanged(e.ObjectOld, e.ObjectNew) {
+				filteredEvents.WithLabelValues(kindOf(e.ObjectNew), podUnchangedReason).Inc()
+				return false
+			}
+			return true
+		},
+	}
+}
+
+// podChanged returns true unless both objects are Pods with the same labels,
+// configuration hash and running state
+func podChanged(old, new runtime.Object) bool {
+	o, ok := old.(*corev1.Pod)
+	if !ok {
+		return true
+	}
+	n, ok := new.(*corev1.Pod)
+	if !ok {
+		return true
+	}
+	return !reflect.DeepEqual(o.GetLabels(), n.GetLabels()) ||
+		o.GetAnnotations()[ConfigHashAnnotation] != n.GetAnnotations()[ConfigHashAnnotation] ||
+		isRunning(o) != isRunning(n)
+}
+
+// statusOnlyChange returns true if the objects are equal once their status,
+// resourceVersion and generation are ignored
+func statusOnlyChange(old, new runtime.Object) bool {
+	oldFields, err := withoutStatus(old)
+	if err != nil {
+		return false
+	}
+	newFields, err := withoutStatus(new)
+	if err != nil {
+		return false
+	}
+	return reflect.DeepEqual(oldFields, newFields)
+}
+
+// withoutStatus converts the object to its unstructured form and removes the
+// fields that change when only its status is updated
+func withoutStatus(obj runtime.Object) (map[string]interface{}, error) {
+	fields, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	// ToUnstructured does not copy Unstructured objects
+	fields = runtime.DeepCopyJSON(fields)
+	delete(fields, "status")
+	unstructured.RemoveNestedField(fields, "metadata", "resourceVersion")
+	unstructured.RemoveNestedField(fields, "metadata", "generation")
+	return fields, nil
+}
+
+// kindOf returns the Kind of the object for use in metric labels
+func kindOf(obj runtime.Object) string {
+	if u, ok := obj.(*unstructured.Unstructured); ok {
+		return u.GetKind()
+	}
+	t := reflect.TypeOf(obj)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
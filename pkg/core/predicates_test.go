@@ -0,0 +1,185 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/pusher/wave/test/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+var _ = Describe("Wave predicates Suite", func() {
+	var filteredCount = func(kind, reason string) float64 {
+		metric := &dto.Metric{}
+		Expect(filteredEvents.WithLabelValues(kind, reason).Write(metric)).To(Succeed())
+		return metric.GetCounter().GetValue()
+	}
+
+	var updateEvent = func(old, new Object) event.UpdateEvent {
+		return event.UpdateEvent{
+			MetaOld:   old,
+			ObjectOld: old,
+			MetaNew:   new,
+			ObjectNew: new,
+		}
+	}
+
+	Context("ChildDataChanged", func() {
+		var oldCM *corev1.ConfigMap
+		var newCM *corev1.ConfigMap
+
+		BeforeEach(func() {
+			oldCM = utils.ExampleConfigMap1.DeepCopy()
+			oldCM.SetResourceVersion("1")
+			newCM = oldCM.DeepCopy()
+			newCM.SetResourceVersion("2")
+		})
+
+		It("keeps updates which change a ConfigMap's Data", func() {
+			newCM.Data["key1"] = "modified"
+			Expect(ChildDataChanged().Update(updateEvent(oldCM, newCM))).To(BeTrue())
+		})
+
+		It("keeps updates which change a ConfigMap's BinaryData", func() {
+			newCM.BinaryData = map[string][]byte{"binary": []byte("binary")}
+			Expect(ChildDataChanged().Update(updateEvent(oldCM, newCM))).To(BeTrue())
+		})
+
+		It("keeps updates which change a Secret's Data", func() {
+			oldS := utils.ExampleSecret1.DeepCopy()
+			oldS.SetResourceVersion("1")
+			oldS.Data = map[string][]byte{"key1": []byte("value")}
+			newS := oldS.DeepCopy()
+			newS.SetResourceVersion("2")
+			newS.Data["key1"] = []byte("modified")
+			Expect(ChildDataChanged().Update(updateEvent(oldS, newS))).To(BeTrue())
+		})
+
+		It("drops and counts updates which only change metadata", func() {
+			before := filteredCount("ConfigMap", dataUnchangedReason)
+			newCM.SetLabels(map[string]string{"new": "label"})
+			Expect(ChildDataChanged().Update(updateEvent(oldCM, newCM))).To(BeFalse())
+			Expect(filteredCount("ConfigMap", dataUnchangedReason)).To(Equal(before + 1))
+		})
+
+		It("drops and counts resyncs", func() {
+			before := filteredCount("ConfigMap", resyncReason)
+			Expect(ChildDataChanged().Update(updateEvent(oldCM, oldCM.DeepCopy()))).To(BeFalse())
+			Expect(filteredCount("ConfigMap", resyncReason)).To(Equal(before + 1))
+		})
+
+		It("keeps create and delete events", func() {
+			Expect(ChildDataChanged().Create(event.CreateEvent{Meta: newCM, Object: newCM})).To(BeTrue())
+			Expect(ChildDataChanged().Delete(event.DeleteEvent{Meta: newCM, Object: newCM})).To(BeTrue())
+		})
+	})
+
+	Context("InstanceChanged", func() {
+		var oldDeployment *appsv1.Deployment
+		var newDeployment *appsv1.Deployment
+
+		BeforeEach(func() {
+			oldDeployment = utils.ExampleDeployment.DeepCopy()
+			oldDeployment.SetResourceVersion("1")
+			oldDeployment.SetGeneration(1)
+			newDeployment = oldDeployment.DeepCopy()
+			newDeployment.SetResourceVersion("2")
+		})
+
+		It("keeps updates which change the spec", func() {
+			newDeployment.SetGeneration(2)
+			newDeployment.Spec.Template.Spec.Containers[0].Image = "modified"
+			Expect(InstanceChanged().Update(updateEvent(oldDeployment, newDeployment))).To(BeTrue())
+		})
+
+		It("keeps updates which change the annotations", func() {
+			newDeployment.SetAnnotations(map[string]string{RequiredAnnotation: "true"})
+			Expect(InstanceChanged().Update(updateEvent(oldDeployment, newDeployment))).To(BeTrue())
+		})
+
+		It("keeps resyncs", func() {
+			Expect(InstanceChanged().Update(updateEvent(oldDeployment, oldDeployment.DeepCopy()))).To(BeTrue())
+		})
+
+		It("drops and counts updates which only change the status", func() {
+			before := filteredCount("Deployment", statusOnlyReason)
+			newDeployment.Status.ObservedGeneration = 1
+			newDeployment.Status.Replicas = 3
+			Expect(InstanceChanged().Update(updateEvent(oldDeployment, newDeployment))).To(BeFalse())
+			Expect(filteredCount("Deployment", statusOnlyReason)).To(Equal(before + 1))
+		})
+
+		It("drops updates which only change the status of a custom resource", func() {
+			oldWorkload := utils.ExampleWorkload.DeepCopy()
+			oldWorkload.SetResourceVersion("1")
+			newWorkload := oldWorkload.DeepCopy()
+			newWorkload.SetResourceVersion("2")
+			Expect(unstructured.SetNestedField(newWorkload.Object, "Ready", "status", "phase")).To(Succeed())
+
+			before := filteredCount("Example", statusOnlyReason)
+			Expect(InstanceChanged().Update(updateEvent(oldWorkload, newWorkload))).To(BeFalse())
+			Expect(filteredCount("Example", statusOnlyReason)).To(Equal(before + 1))
+		})
+	})
+
+	Context("PodChanged", func() {
+		var oldPod *corev1.Pod
+		var newPod *corev1.Pod
+
+		BeforeEach(func() {
+			oldPod = &corev1.Pod{}
+			oldPod.SetName("example")
+			oldPod.SetResourceVersion("1")
+			oldPod.SetLabels(map[string]string{"app": "example"})
+			oldPod.SetAnnotations(map[string]string{ConfigHashAnnotation: "v1:a"})
+			oldPod.Status.Phase = corev1.PodRunning
+			newPod = oldPod.DeepCopy()
+			newPod.SetResourceVersion("2")
+		})
+
+		It("keeps updates which change the configuration hash", func() {
+			newPod.SetAnnotations(map[string]string{ConfigHashAnnotation: "v1:b"})
+			Expect(PodChanged().Update(updateEvent(oldPod, newPod))).To(BeTrue())
+		})
+
+		It("keeps updates which change the labels", func() {
+			newPod.SetLabels(map[string]string{"app": "other"})
+			Expect(PodChanged().Update(updateEvent(oldPod, newPod))).To(BeTrue())
+		})
+
+		It("keeps updates which finish the Pod", func() {
+			newPod.Status.Phase = corev1.PodSucceeded
+			Expect(PodChanged().Update(updateEvent(oldPod, newPod))).To(BeTrue())
+		})
+
+		It("drops and counts updates which only change the status of a running Pod", func() {
+			before := filteredCount("Pod", podUnchangedReason)
+			newPod.Status.PodIP = "10.0.0.1"
+			Expect(PodChanged().Update(updateEvent(oldPod, newPod))).To(BeFalse())
+			Expect(filteredCount("Pod", podUnchangedReason)).To(Equal(before + 1))
+		})
+
+		It("drops resyncs", func() {
+			Expect(PodChanged().Update(updateEvent(oldPod, oldPod.DeepCopy()))).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,281 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	// configMapsIndexField is the name of the field index holding the names of
+	// the ConfigMaps referenced by an instance
+	configMapsIndexField = "wave.pusher.com/configmaps"
+
+	// secretsIndexField is the name of the field index holding the names of
+	// the Secrets referenced by an instance
+	secretsIndexField = "wave.pusher.com/secrets"
+
+	// ownerUIDIndexField is the name of the field index holding the UIDs of
+	// the owners of a ConfigMap or Secret
+	ownerUIDIndexField = "wave.pusher.com/owner-uid"
+)
+
+// IndexOwners registers field indexes on ConfigMaps and Secrets so that they
+// can be listed by the UIDs of their owners.
+// It must be called exactly once for each Manager before the Manager is
+// started.
+func IndexOwners(indexer client.FieldIndexer) error {
+	for _, obj := range []runtime.Object{&corev1.ConfigMap{}, &corev1.Secret{}} {
+		err := indexer.IndexField(obj, ownerUIDIndexField, func(o runtime.Object) []string {
+			accessor, err := meta.Accessor(o)
+			if err != nil {
+				return nil
+			}
+			uids := []string{}
+			for _, ref := range accessor.GetOwnerReferences() {
+				uids = append(uids, string(ref.UID))
+			}
+			return uids
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IndexReferences registers field indexes for the kind of obj so that
+// instances can be listed by the names of the ConfigMaps and Secrets they
+// reference.
+// obj must be a Deployment, StatefulSet, DaemonSet or CronJob.
+func IndexReferences(indexer client.FieldIndexer, obj runtime.Object) error {
+	return indexReferences(indexer, obj, func(o runtime.Object) (podController, bool) {
+		return asPodController(o)
+	})
+}
+
+// IndexUnstructuredReferences registers field indexes for the kind of obj so
+// that custom resources embedding a PodTemplateSpec at templatePath can be
+// listed by the names of the ConfigMaps and Secrets they reference.
+func IndexUnstructuredReferences(indexer client.FieldIndexer, obj *unstructured.Unstructured, templatePath []string) error {
+	return indexReferences(indexer, obj, func(o runtime.Object) (podController, bool) {
+		u, ok := o.(*unstructured.Unstructured)
+		if !ok {
+			return nil, false
+		}
+		pc := &unstructuredPodController{Unstructured: u, templatePath: templatePath}
+		if pc.hasPodTemplate() != nil {
+			return nil, false
+		}
+		return pc, true
+	})
+}
+
+// indexReferences registers the ConfigMap and Secret field indexes using
+// convert to read the PodTemplate of each instance
+func indexReferences(indexer client.FieldIndexer, obj runtime.Object, convert func(runtime.Object) (podController, bool)) error {
+	err := indexer.IndexField(obj, configMapsIndexField, func(o runtime.Object) []string {
+		pc, ok := convert(o)
+		if !ok {
+			return nil
+		}
+		configMaps, _ := getChildNamesByType(pc)
+		return namesOf(configMaps)
+	})
+	if err != nil {
+		return err
+	}
+
+	return indexer.IndexField(obj, secretsIndexField, func(o runtime.Object) []string {
+		pc, ok := convert(o)
+		if !ok {
+			return nil
+		}
+		_, secrets := getChildNamesByType(pc)
+		return namesOf(secrets)
+	})
+}
+
+// asPodController wraps the known workload types as a podController
+func asPodController(obj runtime.Object) (podController, bool) {
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		return &deployment{Deployment: o}, true
+	case *appsv1.StatefulSet:
+		return &statefulset{StatefulSet: o}, true
+	case *appsv1.DaemonSet:
+		return &daemonset{DaemonSet: o}, true
+	case *batchv1beta1.CronJob:
+		return &cronjob{CronJob: o}, true
+	default:
+		return nil, false
+	}
+}
+
+// namesOf returns the keys of the given map of configMetadata
+func namesOf(children map[string]configMetadata) []string {
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	return names
+}
+
+// WatchChildren sets up the watches on ConfigMaps and Secrets for a
+// controller of instances of ownerType, according to the tracking mode in
+// DefaultOptions.
+// Updates which don't change the data of a child are ignored.
+// list is the list type of the instances, for example a DeploymentList.
+// The indexes registered by IndexReferences must be present for the instances.
+func WatchChildren(c controller.Controller, cl client.Client, ownerType runtime.Object, list runtime.Object) error {
+	for _, child := range []runtime.Object{&corev1.ConfigMap{}, &corev1.Secret{}} {
+		if DefaultOptions.TrackingMode == IndexTracking {
+			// Watch all children referenced by an instance
+			err := c.Watch(childSource(child), &handler.EnqueueRequestsFromMapFunc{
+				ToRequests: NewReferenceMapper(cl, list),
+			}, ChildDataChanged())
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Watch for children referenced by an instance being created
+		err := c.Watch(childSource(child), EnqueueRequestsForReferences(cl, list))
+		if err != nil {
+			return err
+		}
+
+		// Watch children owned by an instance
+		err = c.Watch(childSource(child), &handler.EnqueueRequestForOwner{
+			IsController: false,
+			OwnerType:    ownerType,
+		}, ChildDataChanged())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// childSource returns the Source for the given kind of child, reading from
+// the DigestCache when one is configured
+func childSource(child runtime.Object) source.Source {
+	if digests := DefaultOptions.DigestCache; digests != nil {
+		switch child.(type) {
+		case *corev1.ConfigMap:
+			return &source.Informer{Informer: digests.ConfigMapInformer()}
+		case *corev1.Secret:
+			return &source.Informer{Informer: digests.SecretInformer()}
+		}
+	}
+	return &source.Kind{Type: child}
+}
+
+// EnqueueRequestsForReferences returns an EventHandler for ConfigMaps and
+// Secrets which, when one is created, enqueues every instance in the same
+// namespace that references it.
+// list is the list type of the instances, for example a DeploymentList.
+// The indexes registered by IndexReferences must be present for the instances.
+func EnqueueRequestsForReferences(c client.Client, list runtime.Object) handler.EventHandler {
+	mapper := NewReferenceMapper(c, list)
+	return &handler.Funcs{
+		CreateFunc: func(e event.CreateEvent, q workqueue.RateLimitingInterface) {
+			for _, req := range mapper.Map(handler.MapObject{Meta: e.Meta, Object: e.Object}) {
+				q.Add(req)
+			}
+		},
+	}
+}
+
+// NewReferenceMapper returns a Mapper which maps ConfigMaps and Secrets to
+// requests for every instance in the same namespace that references them.
+// list is the list type of the instances, for example a DeploymentList.
+// The indexes registered by IndexReferences must be present for the instances.
+func NewReferenceMapper(c client.Client, list runtime.Object) handler.Mapper {
+	return &referenceMapper{client: c, list: list}
+}
+
+// referenceMapper maps ConfigMaps and Secrets to requests for the instances
+// that reference them
+type referenceMapper struct {
+	client client.Client
+	list   runtime.Object
+}
+
+// Map lists the instances referencing the ConfigMap or Secret and returns a
+// request for each of them
+func (r *referenceMapper) Map(obj handler.MapObject) []reconcile.Request {
+	log := logf.Log.WithName("wave")
+
+	var field string
+	switch obj.Object.(type) {
+	case *corev1.ConfigMap:
+		field = configMapsIndexField
+	case *corev1.Secret:
+		field = secretsIndexField
+	default:
+		return nil
+	}
+
+	list := r.list.DeepCopyObject()
+	err := r.client.List(context.TODO(), list,
+		client.InNamespace(obj.Meta.GetNamespace()),
+		client.MatchingField(field, obj.Meta.GetName()),
+	)
+	if err != nil {
+		log.Error(err, "error listing instances referencing child", "namespace", obj.Meta.GetNamespace(), "name", obj.Meta.GetName())
+		return nil
+	}
+
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		log.Error(err, "error extracting instances referencing child", "namespace", obj.Meta.GetNamespace(), "name", obj.Meta.GetName())
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, item := range items {
+		accessor, err := meta.Accessor(item)
+		if err != nil {
+			continue
+		}
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{
+				Namespace: accessor.GetNamespace(),
+				Name:      accessor.GetName(),
+			},
+		})
+	}
+	return requests
+}
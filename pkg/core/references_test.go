@@ -0,0 +1,111 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pusher/wave/test/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var _ = Describe("Wave references Suite", func() {
+	var m utils.Matcher
+	var mapper handler.Mapper
+	var deploymentObject *appsv1.Deployment
+	var mgrStopped *sync.WaitGroup
+	var stopMgr chan struct{}
+
+	const timeout = time.Second * 5
+
+	var mapObject = func(obj Object) handler.MapObject {
+		return handler.MapObject{Meta: obj, Object: obj}
+	}
+
+	BeforeEach(func() {
+		mgr, err := manager.New(cfg, manager.Options{})
+		Expect(err).NotTo(HaveOccurred())
+		m = utils.Matcher{Client: mgr.GetClient()}
+
+		Expect(IndexReferences(mgr.GetFieldIndexer(), &appsv1.Deployment{})).To(Succeed())
+		mapper = NewReferenceMapper(mgr.GetClient(), &appsv1.DeploymentList{})
+
+		stopMgr, mgrStopped = StartTestManager(mgr)
+
+		deploymentObject = utils.ExampleDeployment.DeepCopy()
+		m.Create(deploymentObject).Should(Succeed())
+		m.Get(deploymentObject, timeout).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		close(stopMgr)
+		mgrStopped.Wait()
+
+		utils.DeleteAll(cfg, timeout,
+			&appsv1.DeploymentList{},
+		)
+	})
+
+	Context("NewReferenceMapper", func() {
+		var request reconcile.Request
+
+		BeforeEach(func() {
+			request = reconcile.Request{
+				NamespacedName: types.NamespacedName{
+					Namespace: deploymentObject.GetNamespace(),
+					Name:      deploymentObject.GetName(),
+				},
+			}
+		})
+
+		It("maps referenced ConfigMaps to the Deployment", func() {
+			for _, cm := range []*corev1.ConfigMap{utils.ExampleConfigMap1, utils.ExampleConfigMap2, utils.ExampleConfigMap3} {
+				Eventually(func() []reconcile.Request {
+					return mapper.Map(mapObject(cm.DeepCopy()))
+				}, timeout).Should(ConsistOf(request))
+			}
+		})
+
+		It("maps referenced Secrets to the Deployment", func() {
+			for _, s := range []*corev1.Secret{utils.ExampleSecret1, utils.ExampleSecret2, utils.ExampleSecret3} {
+				Eventually(func() []reconcile.Request {
+					return mapper.Map(mapObject(s.DeepCopy()))
+				}, timeout).Should(ConsistOf(request))
+			}
+		})
+
+		It("doesn't map unreferenced ConfigMaps", func() {
+			cm := utils.ExampleConfigMap1.DeepCopy()
+			cm.SetName("unreferenced")
+			Expect(mapper.Map(mapObject(cm))).To(BeEmpty())
+		})
+
+		It("doesn't map ConfigMaps in other namespaces", func() {
+			cm := utils.ExampleConfigMap1.DeepCopy()
+			cm.SetNamespace("other")
+			Expect(mapper.Map(mapObject(cm))).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,113 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// dependentLists are the list types of the instances checked by GetRollouts
+var dependentLists = []runtime.Object{
+	&appsv1.DeploymentList{},
+	&appsv1.StatefulSetList{},
+	&appsv1.DaemonSetList{},
+	&batchv1beta1.CronJobList{},
+}
+
+// GetRollouts returns the instances, in the form Kind/name, whose
+// configuration hash will change when the child is updated from old to new.
+// Instances without the required annotation, or which only reference keys
+// that haven't changed, are not returned.
+// The indexes registered by IndexReferences must be present for Deployments,
+// StatefulSets, DaemonSets and CronJobs.
+func (h *Handler) GetRollouts(old, new Object) ([]string, error) {
+	var field string
+	switch new.(type) {
+	case *corev1.ConfigMap:
+		field = configMapsIndexField
+	case *corev1.Secret:
+		field = secretsIndexField
+	default:
+		return nil, fmt.Errorf("passed unknown type: %v", reflect.TypeOf(new))
+	}
+
+	rollouts := []string{}
+	for _, list := range dependentLists {
+		instances := list.DeepCopyObject()
+		err := h.List(context.TODO(), instances,
+			client.InNamespace(new.GetNamespace()),
+			client.MatchingField(field, new.GetName()),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error listing instances referencing %s/%s: %v", new.GetNamespace(), new.GetName(), err)
+		}
+
+		items, err := meta.ExtractList(instances)
+		if err != nil {
+			return nil, fmt.Errorf("error extracting instances referencing %s/%s: %v", new.GetNamespace(), new.GetName(), err)
+		}
+		for _, item := range items {
+			instance, ok := asPodController(item)
+			if !ok || !hasRequiredAnnotation(instance) {
+				continue
+			}
+			changed, err := childChanged(instance, old, new)
+			if err != nil {
+				return nil, err
+			}
+			if changed {
+				rollouts = append(rollouts, fmt.Sprintf("%s/%s", kindOf(item), instance.GetName()))
+			}
+		}
+	}
+
+	sort.Strings(rollouts)
+	return rollouts, nil
+}
+
+// childChanged returns true if the data of the child that is hashed for the
+// instance differs between old and new
+func childChanged(instance podController, old, new Object) (bool, error) {
+	configMaps, secrets := getChildNamesByType(instance)
+	metadata, ok := configMaps[new.GetName()]
+	if _, isSecret := new.(*corev1.Secret); isSecret {
+		metadata, ok = secrets[new.GetName()]
+	}
+	if !ok {
+		return false, nil
+	}
+
+	oldHash, err := calculateConfigHash([]configObject{{object: old, allKeys: metadata.allKeys, keys: metadata.keys}})
+	if err != nil {
+		return false, err
+	}
+	newHash, err := calculateConfigHash([]configObject{{object: new, allKeys: metadata.allKeys, keys: metadata.keys}})
+	if err != nil {
+		return false, err
+	}
+	return oldHash != newHash, nil
+}
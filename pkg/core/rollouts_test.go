@@ -0,0 +1,127 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pusher/wave/test/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+var _ = Describe("Wave rollouts Suite", func() {
+	var h *Handler
+	var m utils.Matcher
+	var mgrStopped *sync.WaitGroup
+	var stopMgr chan struct{}
+
+	const timeout = time.Second * 5
+
+	var cm1 *corev1.ConfigMap
+	var cm3 *corev1.ConfigMap
+	var s1 *corev1.Secret
+
+	BeforeEach(func() {
+		mgr, err := manager.New(cfg, manager.Options{})
+		Expect(err).NotTo(HaveOccurred())
+		for _, obj := range []runtime.Object{&appsv1.Deployment{}, &appsv1.StatefulSet{}, &appsv1.DaemonSet{}, &batchv1beta1.CronJob{}} {
+			Expect(IndexReferences(mgr.GetFieldIndexer(), obj)).To(Succeed())
+		}
+		h = NewHandler(mgr.GetClient(), mgr.GetEventRecorderFor("wave"))
+		m = utils.Matcher{Client: mgr.GetClient()}
+
+		stopMgr, mgrStopped = StartTestManager(mgr)
+
+		cm1 = utils.ExampleConfigMap1.DeepCopy()
+		cm3 = utils.ExampleConfigMap3.DeepCopy()
+		s1 = utils.ExampleSecret1.DeepCopy()
+		s1.Data = map[string][]byte{"key1": []byte("example1:key1")}
+
+		// The Deployment has the required annotation, the StatefulSet doesn't
+		deployment := utils.ExampleDeployment.DeepCopy()
+		deployment.SetAnnotations(map[string]string{RequiredAnnotation: "true"})
+		statefulset := utils.ExampleStatefulSet.DeepCopy()
+		m.Create(deployment).Should(Succeed())
+		m.Create(statefulset).Should(Succeed())
+		m.Get(deployment, timeout).Should(Succeed())
+		m.Get(statefulset, timeout).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		close(stopMgr)
+		mgrStopped.Wait()
+
+		utils.DeleteAll(cfg, timeout,
+			&appsv1.DeploymentList{},
+			&appsv1.StatefulSetList{},
+		)
+	})
+
+	Context("GetRollouts", func() {
+		It("returns instances referencing all keys of a ConfigMap that changed", func() {
+			updated := cm1.DeepCopy()
+			updated.Data["key3"] = "modified"
+
+			rollouts, err := h.GetRollouts(cm1, updated)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rollouts).To(ConsistOf("Deployment/example"))
+		})
+
+		It("returns instances referencing a key of a ConfigMap that changed", func() {
+			updated := cm3.DeepCopy()
+			updated.Data["key1"] = "modified"
+
+			rollouts, err := h.GetRollouts(cm3, updated)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rollouts).To(ConsistOf("Deployment/example"))
+		})
+
+		It("doesn't return instances when an unreferenced key changed", func() {
+			updated := cm3.DeepCopy()
+			updated.Data["key3"] = "modified"
+
+			rollouts, err := h.GetRollouts(cm3, updated)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rollouts).To(BeEmpty())
+		})
+
+		It("doesn't return instances when only metadata changed", func() {
+			updated := cm1.DeepCopy()
+			updated.SetLabels(map[string]string{"modified": "true"})
+
+			rollouts, err := h.GetRollouts(cm1, updated)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rollouts).To(BeEmpty())
+		})
+
+		It("returns instances referencing a Secret that changed", func() {
+			updated := s1.DeepCopy()
+			updated.Data["key1"] = []byte("modified")
+
+			rollouts, err := h.GetRollouts(s1, updated)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rollouts).To(ConsistOf("Deployment/example"))
+		})
+	})
+})
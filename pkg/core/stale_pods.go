@@ -0,0 +1,185 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// stalePodsRequeuePeriod is how often instances with stale Pods are
+// reconciled so that the time they have been stale stays up to date
+const stalePodsRequeuePeriod = 30 * time.Second
+
+// HandlePods is called by the stale pods controllers to compare the
+// configuration hash of an instance's Pods with its Pod Template
+func (h *Handler) HandlePods(obj runtime.Object) (reconcile.Result, error) {
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		return h.handlePods(&deployment{Deployment: o}, o.Spec.Selector)
+	case *appsv1.StatefulSet:
+		return h.handlePods(&statefulset{StatefulSet: o}, o.Spec.Selector)
+	case *appsv1.DaemonSet:
+		return h.handlePods(&daemonset{DaemonSet: o}, o.Spec.Selector)
+	default:
+		return reconcile.Result{}, fmt.Errorf("passed unknown type: %v", reflect.TypeOf(obj))
+	}
+}
+
+// ForgetPods is called by the stale pods controllers when the instance being
+// reconciled no longer exists
+func (h *Handler) ForgetPods(kind string, name types.NamespacedName) {
+	staleInstances.forget(kind, name)
+}
+
+// handlePods counts the instance's Pods whose configuration hash differs from
+// its Pod Template and records an Event once they have been stale for longer
+// than the StalePodsThreshold
+func (h *Handler) handlePods(instance podController, labelSelector *metav1.LabelSelector) (reconcile.Result, error) {
+	kind := groupVersionKindOf(instance).Kind
+	name := types.NamespacedName{Namespace: instance.GetNamespace(), Name: instance.GetName()}
+
+	hash := getConfigHash(instance)
+	if !hasRequiredAnnotation(instance) || toBeDeleted(instance) || hash == "" {
+		staleInstances.forget(kind, name)
+		return reconcile.Result{}, nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("error parsing selector of %s/%s: %v", instance.GetNamespace(), instance.GetName(), err)
+	}
+	pods := &corev1.PodList{}
+	err = h.List(context.TODO(), pods, client.InNamespace(instance.GetNamespace()), matchingSelector(selector))
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("error listing Pods of %s/%s: %v", instance.GetNamespace(), instance.GetName(), err)
+	}
+
+	count := 0
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !isRunning(pod) {
+			continue
+		}
+		if pod.GetAnnotations()[ConfigHashAnnotation] != hash {
+			count++
+		}
+	}
+
+	duration, exceeded := staleInstances.observe(kind, name, hash, count, getTriggeredAt(instance), time.Now(), h.options.StalePodsThreshold)
+	if exceeded {
+		h.recorder.Eventf(instance.GetObject(), corev1.EventTypeWarning, "StalePods", "%d Pod(s) have not run configuration %s for %s", count, hash, duration.Round(time.Second))
+	}
+	if count > 0 {
+		return reconcile.Result{RequeueAfter: stalePodsRequeuePeriod}, nil
+	}
+	return reconcile.Result{}, nil
+}
+
+// matchingSelector filters a list to the objects matching the label selector
+func matchingSelector(selector labels.Selector) client.ListOptionFunc {
+	return func(opts *client.ListOptions) {
+		opts.LabelSelector = selector
+	}
+}
+
+// isRunning returns true if the Pod has not finished and is not being deleted
+func isRunning(pod *corev1.Pod) bool {
+	if toBeDeleted(pod) {
+		return false
+	}
+	return pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed
+}
+
+// staleInstances tracks how long each instance's Pods have been stale
+var staleInstances = &staleTracker{instances: make(map[string]*staleState)}
+
+// staleTracker tracks how long each instance's Pods have been stale and sets
+// the stale pods gauges
+type staleTracker struct {
+	mutex     sync.Mutex
+	instances map[string]*staleState
+}
+
+// staleState records when an instance's Pods became stale
+type staleState struct {
+	hash     string
+	since    time.Time
+	exceeded bool
+}
+
+// observe records the number of the instance's Pods not running the hash
+// given.
+// The Pods are stale from when the hash changed, or from when they are first
+// observed if changedAt is zero.
+// It returns how long the Pods have been stale and whether that has just
+// exceeded the threshold.
+func (t *staleTracker) observe(kind string, name types.NamespacedName, hash string, count int, changedAt, now time.Time, threshold time.Duration) (time.Duration, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := fmt.Sprintf("%s/%s", kind, name)
+	if count == 0 {
+		delete(t.instances, key)
+		stalePods.WithLabelValues(name.Namespace, kind, name.Name).Set(0)
+		stalePodsDuration.WithLabelValues(name.Namespace, kind, name.Name).Set(0)
+		return 0, false
+	}
+
+	// The Pods became stale when the instance's hash last changed
+	state, ok := t.instances[key]
+	if !ok || state.hash != hash {
+		since := now
+		if !changedAt.IsZero() && changedAt.Before(now) {
+			since = changedAt
+		}
+		state = &staleState{hash: hash, since: since}
+		t.instances[key] = state
+	}
+
+	duration := now.Sub(state.since)
+	stalePods.WithLabelValues(name.Namespace, kind, name.Name).Set(float64(count))
+	stalePodsDuration.WithLabelValues(name.Namespace, kind, name.Name).Set(duration.Seconds())
+
+	if threshold == 0 || duration < threshold || state.exceeded {
+		return duration, false
+	}
+	state.exceeded = true
+	return duration, true
+}
+
+// forget stops tracking the instance and removes its gauges
+func (t *staleTracker) forget(kind string, name types.NamespacedName) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.instances, fmt.Sprintf("%s/%s", kind, name))
+	stalePods.DeleteLabelValues(name.Namespace, kind, name.Name)
+	stalePodsDuration.DeleteLabelValues(name.Namespace, kind, name.Name)
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/pusher/wave/test/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var _ = Describe("Wave stale pods Suite", func() {
+	var c client.Client
+	var h *Handler
+	var m utils.Matcher
+	var d *appsv1.Deployment
+	var stopMgr chan struct{}
+
+	const timeout = time.Second * 5
+	const hash = "v1:current"
+
+	var stalePodsCount = func() float64 {
+		metric := &dto.Metric{}
+		Expect(stalePods.WithLabelValues(d.GetNamespace(), "Deployment", d.GetName()).Write(metric)).To(Succeed())
+		return metric.GetGauge().GetValue()
+	}
+
+	var newPod = func(name, podHash string) *corev1.Pod {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: d.GetNamespace(),
+				Labels:    d.Spec.Selector.MatchLabels,
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "container", Image: "container"}},
+			},
+		}
+		if podHash != "" {
+			pod.SetAnnotations(map[string]string{ConfigHashAnnotation: podHash})
+		}
+		return pod
+	}
+
+	// handlePods reconciles the Deployment's Pods once the cache has seen n
+	// of them
+	var handlePods = func(n int) reconcile.Result {
+		Eventually(func() ([]corev1.Pod, error) {
+			pods := &corev1.PodList{}
+			err := c.List(context.TODO(), pods, client.InNamespace(d.GetNamespace()))
+			return pods.Items, err
+		}, timeout).Should(HaveLen(n))
+		result, err := h.HandlePods(d)
+		Expect(err).NotTo(HaveOccurred())
+		return result
+	}
+
+	BeforeEach(func() {
+		mgr, err := manager.New(cfg, manager.Options{})
+		Expect(err).NotTo(HaveOccurred())
+		c = mgr.GetClient()
+		h = NewHandlerWithOptions(c, mgr.GetEventRecorderFor("wave"), Options{StalePodsThreshold: time.Hour})
+		m = utils.Matcher{Client: c}
+		stopMgr, _ = StartTestManager(mgr)
+
+		d = utils.ExampleDeployment.DeepCopy()
+		d.SetAnnotations(map[string]string{RequiredAnnotation: "true"})
+		d.Spec.Template.SetAnnotations(map[string]string{ConfigHashAnnotation: hash})
+		m.Create(d).Should(Succeed())
+		m.Get(d, timeout).Should(Succeed())
+		staleInstances.forget("Deployment", types.NamespacedName{Namespace: d.GetNamespace(), Name: d.GetName()})
+
+		m.Create(newPod("current", hash)).Should(Succeed())
+		m.Create(newPod("stale", "v1:previous")).Should(Succeed())
+		m.Create(newPod("unannotated", "")).Should(Succeed())
+		other := newPod("other", "v1:previous")
+		other.SetLabels(map[string]string{"app": "other"})
+		m.Create(other).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		close(stopMgr)
+		utils.DeleteAll(cfg, timeout,
+			&appsv1.DeploymentList{},
+			&corev1.PodList{},
+			&corev1.EventList{},
+		)
+	})
+
+	It("counts the Pods not running the current hash", func() {
+		handlePods(4)
+		Expect(stalePodsCount()).To(Equal(2.0))
+	})
+
+	It("requeues while Pods are stale", func() {
+		Expect(handlePods(4).RequeueAfter).To(Equal(stalePodsRequeuePeriod))
+	})
+
+	It("does not count Pods being deleted", func() {
+		pod := newPod("stale", "")
+		m.Get(pod, timeout).Should(Succeed())
+		pod.SetFinalizers([]string{"wave.pusher.com/test"})
+		m.Update(pod, timeout).Should(Succeed())
+		m.Delete(pod).Should(Succeed())
+		m.Eventually(pod, timeout).Should(utils.WithDeletionTimestamp(Not(BeNil())))
+
+		Eventually(func() float64 {
+			_, err := h.HandlePods(d)
+			Expect(err).NotTo(HaveOccurred())
+			return stalePodsCount()
+		}, timeout).Should(Equal(1.0))
+
+		m.Get(pod, timeout).Should(Succeed())
+		pod.SetFinalizers([]string{})
+		m.Update(pod, timeout).Should(Succeed())
+	})
+
+	It("records an Event once the threshold is exceeded", func() {
+		h = NewHandlerWithOptions(c, h.recorder, Options{StalePodsThreshold: time.Nanosecond})
+		handlePods(4)
+		time.Sleep(time.Millisecond)
+		handlePods(4)
+
+		events := &corev1.EventList{}
+		eventReason := func(event *corev1.Event) string {
+			return event.Reason
+		}
+		m.Eventually(events, timeout).Should(utils.WithItems(ContainElement(WithTransform(eventReason, Equal("StalePods")))))
+	})
+
+	It("removes the gauges once the annotation is removed", func() {
+		handlePods(4)
+		d.SetAnnotations(map[string]string{})
+		handlePods(4)
+		Expect(stalePods.DeleteLabelValues(d.GetNamespace(), "Deployment", d.GetName())).To(BeFalse())
+	})
+})
+
+var _ = Describe("Wave stale pods tracker Suite", func() {
+	var tracker *staleTracker
+	var name types.NamespacedName
+	var now time.Time
+
+	BeforeEach(func() {
+		tracker = &staleTracker{instances: make(map[string]*staleState)}
+		name = types.NamespacedName{Namespace: "default", Name: "tracked"}
+		now = time.Now()
+	})
+
+	It("measures staleness from when the hash was first seen", func() {
+		tracker.observe("Deployment", name, "v1:a", 1, time.Time{}, now, 0)
+		duration, _ := tracker.observe("Deployment", name, "v1:a", 1, time.Time{}, now.Add(time.Minute), 0)
+		Expect(duration).To(Equal(time.Minute))
+	})
+
+	It("measures staleness from when the hash changed if that is known", func() {
+		duration, exceeded := tracker.observe("Deployment", name, "v1:a", 1, now.Add(-5*time.Minute), now, time.Minute)
+		Expect(duration).To(Equal(5 * time.Minute))
+		Expect(exceeded).To(BeTrue())
+	})
+
+	It("restarts the measurement when the hash changes", func() {
+		tracker.observe("Deployment", name, "v1:a", 1, time.Time{}, now, 0)
+		duration, _ := tracker.observe("Deployment", name, "v1:b", 1, time.Time{}, now.Add(time.Minute), 0)
+		Expect(duration).To(BeZero())
+	})
+
+	It("restarts the measurement once no Pods are stale", func() {
+		tracker.observe("Deployment", name, "v1:a", 1, time.Time{}, now, 0)
+		tracker.observe("Deployment", name, "v1:a", 0, time.Time{}, now.Add(time.Minute), 0)
+		duration, _ := tracker.observe("Deployment", name, "v1:a", 1, time.Time{}, now.Add(2*time.Minute), 0)
+		Expect(duration).To(BeZero())
+	})
+
+	It("reports exceeding the threshold once", func() {
+		_, exceeded := tracker.observe("Deployment", name, "v1:a", 1, time.Time{}, now, time.Minute)
+		Expect(exceeded).To(BeFalse())
+		_, exceeded = tracker.observe("Deployment", name, "v1:a", 1, time.Time{}, now.Add(time.Minute), time.Minute)
+		Expect(exceeded).To(BeTrue())
+		_, exceeded = tracker.observe("Deployment", name, "v1:a", 1, time.Time{}, now.Add(2*time.Minute), time.Minute)
+		Expect(exceeded).To(BeFalse())
+	})
+
+	It("never reports exceeding a zero threshold", func() {
+		tracker.observe("Deployment", name, "v1:a", 1, time.Time{}, now, 0)
+		_, exceeded := tracker.observe("Deployment", name, "v1:a", 1, time.Time{}, now.Add(time.Hour), 0)
+		Expect(exceeded).To(BeFalse())
+	})
+})
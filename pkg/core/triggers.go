@@ -0,0 +1,64 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"strings"
+	"time"
+)
+
+// setTriggerAnnotations records on the new instance's Pod Template why its
+// configuration hash changed from the old instance's, so that every
+// ReplicaSet or ControllerRevision created by a configuration change records
+// its cause.
+// Nothing is recorded when the hash is first set. The children that changed
+// are only listed when the old instance recorded comparable digests.
+func setTriggerAnnotations(old, new podController, now time.Time) {
+	previous := getConfigHash(old)
+	if previous == "" {
+		return
+	}
+
+	podTemplate := new.GetPodTemplate()
+	annotations := podTemplate.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[PreviousConfigHashAnnotation] = previous
+	annotations[TriggeredAtAnnotation] = now.UTC().Format(time.RFC3339)
+
+	delete(annotations, TriggeredByAnnotation)
+	if oldDigests, newDigests := getComparableDigests(old, new); oldDigests != nil {
+		children := changedChildren(oldDigests, newDigests)
+		if len(children) > 0 {
+			annotations[TriggeredByAnnotation] = strings.Join(children, ",")
+		}
+	}
+
+	podTemplate.SetAnnotations(annotations)
+	new.SetPodTemplate(podTemplate)
+}
+
+// getTriggeredAt returns when the instance's configuration hash last changed,
+// or the zero time if that wasn't recorded
+func getTriggeredAt(obj podController) time.Time {
+	triggeredAt, err := time.Parse(time.RFC3339, obj.GetPodTemplate().GetAnnotations()[TriggeredAtAnnotation])
+	if err != nil {
+		return time.Time{}
+	}
+	return triggeredAt
+}
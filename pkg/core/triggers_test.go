@@ -0,0 +1,87 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pusher/wave/test/utils"
+)
+
+var _ = Describe("Wave triggers Suite", func() {
+	var old, new podController
+	var now time.Time
+
+	BeforeEach(func() {
+		d := utils.ExampleDeployment.DeepCopy()
+		d.Spec.Template.SetAnnotations(map[string]string{
+			ConfigHashAnnotation:  "v1:old",
+			TriggeredByAnnotation: "ConfigMap/earlier",
+		})
+		old = &deployment{Deployment: d}
+		new = old.DeepCopy()
+		setConfigHash(new, "v1:new")
+		now = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	})
+
+	It("records the previous hash and when it changed", func() {
+		setTriggerAnnotations(old, new, now)
+		annotations := new.GetPodTemplate().GetAnnotations()
+		Expect(annotations).To(HaveKeyWithValue(PreviousConfigHashAnnotation, "v1:old"))
+		Expect(annotations).To(HaveKeyWithValue(TriggeredAtAnnotation, "2019-01-01T00:00:00Z"))
+	})
+
+	It("lists the children whose digests changed", func() {
+		Expect(setConfigKeys(old, ConfigDigestsAnnotation, configKeys{
+			"ConfigMap/app": {"key": "aaa"},
+			"Secret/creds":  {"key": "bbb"},
+		})).To(Succeed())
+		Expect(setConfigKeys(new, ConfigDigestsAnnotation, configKeys{
+			"ConfigMap/app": {"key": "ccc"},
+			"Secret/creds":  {"key": "bbb"},
+			"Secret/other":  {"key": "ddd"},
+		})).To(Succeed())
+
+		setTriggerAnnotations(old, new, now)
+		Expect(new.GetPodTemplate().GetAnnotations()).To(HaveKeyWithValue(TriggeredByAnnotation, "ConfigMap/app,Secret/other"))
+	})
+
+	It("removes an earlier trigger when the children that changed are unknown", func() {
+		setTriggerAnnotations(old, new, now)
+		Expect(new.GetPodTemplate().GetAnnotations()).NotTo(HaveKey(TriggeredByAnnotation))
+	})
+
+	It("returns when the hash changed", func() {
+		setTriggerAnnotations(old, new, now)
+		Expect(getTriggeredAt(new)).To(BeTemporally("==", now))
+	})
+
+	It("returns the zero time when the hash change wasn't recorded", func() {
+		Expect(getTriggeredAt(old)).To(BeZero())
+	})
+
+	It("records nothing when the hash is first set", func() {
+		old.GetPodTemplate().SetAnnotations(map[string]string{})
+		new = old.DeepCopy()
+		setConfigHash(new, "v1:new")
+
+		setTriggerAnnotations(old, new, now)
+		Expect(new.GetPodTemplate().GetAnnotations()).To(Equal(map[string]string{ConfigHashAnnotation: "v1:new"}))
+	})
+})
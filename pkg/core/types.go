@@ -17,9 +17,14 @@ limitations under the License.
 package core
 
 import (
+	"fmt"
+	"strings"
+
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -35,6 +40,48 @@ const (
 	// RequiredAnnotation is the key of the annotation on the Deployment that Wave
 	// checks for before processing the deployment
 	RequiredAnnotation = "wave.pusher.com/update-on-config-change"
+
+	// MissingDependenciesAnnotation is the key of the annotation on the
+	// Deployment that lists required ConfigMaps and Secrets which do not exist
+	MissingDependenciesAnnotation = "wave.pusher.com/missing-dependencies"
+
+	// ConfigDigestsAnnotation is the key of the annotation on the Deployment
+	// that records a digest of each ConfigMap and Secret key behind its
+	// configuration hash
+	ConfigDigestsAnnotation = "wave.pusher.com/config-digests"
+
+	// ConfigDigestsKeyAnnotation is the key of the annotation on the
+	// Deployment that identifies the key its config digests were calculated
+	// with
+	ConfigDigestsKeyAnnotation = "wave.pusher.com/config-digests-key"
+
+	// ConfigValuesAnnotation is the key of the annotation on the Deployment
+	// that records the ConfigMap values behind its configuration hash when
+	// ConfigMap value diffs are enabled
+	ConfigValuesAnnotation = "wave.pusher.com/config-values"
+
+	// LastTriggeredByAnnotation is the key of the annotation on the Deployment
+	// that records who made the last change to its configuration
+	LastTriggeredByAnnotation = "wave.pusher.com/last-triggered-by"
+
+	// TriggeredByAnnotation is the key of the annotation on the PodTemplate
+	// that lists the ConfigMaps and Secrets whose change updated the
+	// configuration hash
+	TriggeredByAnnotation = "wave.pusher.com/triggered-by"
+
+	// TriggeredAtAnnotation is the key of the annotation on the PodTemplate
+	// that holds the time the configuration hash was updated
+	TriggeredAtAnnotation = "wave.pusher.com/triggered-at"
+
+	// PreviousConfigHashAnnotation is the key of the annotation on the
+	// PodTemplate that holds the configuration hash it replaced
+	PreviousConfigHashAnnotation = "wave.pusher.com/previous-config-hash"
+
+	// EquivalentConfigHashAnnotation is the key of the annotation on the
+	// Deployment that holds the current configuration hash while the
+	// PodTemplate keeps a hash calculated by an earlier hash version or with a
+	// previous hash key
+	EquivalentConfigHashAnnotation = "wave.pusher.com/equivalent-config-hash"
 )
 
 // Object is used as a helper interface when passing Kubernetes resources
@@ -82,3 +129,124 @@ func (d *deployment) SetPodTemplate(template *corev1.PodTemplateSpec) {
 func (d *deployment) DeepCopy() podController {
 	return &deployment{d.Deployment.DeepCopy()}
 }
+
+type statefulset struct {
+	*appsv1.StatefulSet
+}
+
+func (s *statefulset) GetObject() runtime.Object {
+	return s.StatefulSet
+}
+
+func (s *statefulset) GetPodTemplate() *corev1.PodTemplateSpec {
+	return &s.StatefulSet.Spec.Template
+}
+
+func (s *statefulset) SetPodTemplate(template *corev1.PodTemplateSpec) {
+	s.StatefulSet.Spec.Template = *template
+}
+
+func (s *statefulset) DeepCopy() podController {
+	return &statefulset{s.StatefulSet.DeepCopy()}
+}
+
+type daemonset struct {
+	*appsv1.DaemonSet
+}
+
+func (d *daemonset) GetObject() runtime.Object {
+	return d.DaemonSet
+}
+
+func (d *daemonset) GetPodTemplate() *corev1.PodTemplateSpec {
+	return &d.DaemonSet.Spec.Template
+}
+
+func (d *daemonset) SetPodTemplate(template *corev1.PodTemplateSpec) {
+	d.DaemonSet.Spec.Template = *template
+}
+
+func (d *daemonset) DeepCopy() podController {
+	return &daemonset{d.DaemonSet.DeepCopy()}
+}
+
+type cronjob struct {
+	*batchv1beta1.CronJob
+}
+
+func (c *cronjob) GetObject() runtime.Object {
+	return c.CronJob
+}
+
+// GetPodTemplate returns the template of the Jobs created by the CronJob so
+// that every Job created after a configuration change carries the new hash
+func (c *cronjob) GetPodTemplate() *corev1.PodTemplateSpec {
+	return &c.CronJob.Spec.JobTemplate.Spec.Template
+}
+
+func (c *cronjob) SetPodTemplate(template *corev1.PodTemplateSpec) {
+	c.CronJob.Spec.JobTemplate.Spec.Template = *template
+}
+
+func (c *cronjob) DeepCopy() podController {
+	return &cronjob{c.CronJob.DeepCopy()}
+}
+
+// unstructuredPodController wraps a custom resource which embeds a
+// PodTemplateSpec at the given templatePath
+type unstructuredPodController struct {
+	*unstructured.Unstructured
+	templatePath []string
+}
+
+func (u *unstructuredPodController) GetObject() runtime.Object {
+	return u.Unstructured
+}
+
+// GetPodTemplate converts the PodTemplateSpec found at the templatePath.
+// If the template is missing or cannot be converted, an empty template is
+// returned, hasPodTemplate should be used to check for its presence first.
+func (u *unstructuredPodController) GetPodTemplate() *corev1.PodTemplateSpec {
+	template := &corev1.PodTemplateSpec{}
+	raw, found, err := unstructured.NestedMap(u.Object, u.templatePath...)
+	if err != nil || !found {
+		return template
+	}
+	_ = runtime.DefaultUnstructuredConverter.FromUnstructured(raw, template)
+	return template
+}
+
+// SetPodTemplate only writes back the annotations of the template given.
+// Wave never modifies any other part of the PodTemplate and rewriting the
+// whole template would drop any fields unknown to the vendored PodSpec.
+func (u *unstructuredPodController) SetPodTemplate(template *corev1.PodTemplateSpec) {
+	annotationsPath := append(append([]string{}, u.templatePath...), "metadata", "annotations")
+	if len(template.GetAnnotations()) == 0 {
+		unstructured.RemoveNestedField(u.Object, annotationsPath...)
+		return
+	}
+
+	annotations := make(map[string]interface{})
+	for key, value := range template.GetAnnotations() {
+		annotations[key] = value
+	}
+	_ = unstructured.SetNestedMap(u.Object, annotations, annotationsPath...)
+}
+
+func (u *unstructuredPodController) DeepCopy() podController {
+	return &unstructuredPodController{u.Unstructured.DeepCopy(), u.templatePath}
+}
+
+// hasPodTemplate checks that the templatePath points to an object within
+// the wrapped resource
+func (u *unstructuredPodController) hasPodTemplate() error {
+	raw, found, err := unstructured.NestedMap(u.Object, u.templatePath...)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no pod template found at %s", strings.Join(u.templatePath, "."))
+	}
+	template := &corev1.PodTemplateSpec{}
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(raw, template)
+}
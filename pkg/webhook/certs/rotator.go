@@ -0,0 +1,314 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certs
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+)
+
+const (
+	// CACertName is the key of the CA certificate in the Secret
+	CACertName = "ca.crt"
+
+	// CAKeyName is the key of the CA private key in the Secret
+	CAKeyName = "ca.key"
+
+	// PreviousCACertName is the key of the CA certificate that was rotated
+	// out in the Secret. It is trusted until it expires so that serving
+	// certificates signed by it remain valid.
+	PreviousCACertName = "ca-previous.crt"
+
+	// CertName is the key of the serving certificate in the Secret and its
+	// file name in the certificate directory
+	CertName = "tls.crt"
+
+	// KeyName is the key of the serving private key in the Secret and its
+	// file name in the certificate directory
+	KeyName = "tls.key"
+
+	caValidity      = 10 * 365 * 24 * time.Hour
+	caRotation      = 365 * 24 * time.Hour
+	servingValidity = 365 * 24 * time.Hour
+	servingRotation = 30 * 24 * time.Hour
+
+	defaultCheckInterval = 12 * time.Hour
+)
+
+// ErrRotated is returned by Start when the serving certificate has been
+// rotated. The webhook Server only reads its certificate when it starts, so
+// the process must be restarted to serve the new certificate.
+var ErrRotated = fmt.Errorf("webhook serving certificate rotated")
+
+// Rotator generates a self-signed CA and a serving certificate for the
+// webhook Server, stores them in a Secret, writes the serving certificate to
+// the Server's certificate directory and sets the caBundle of the webhook
+// configurations that point at the Service.
+// Certificates are rotated before they expire.
+type Rotator struct {
+	// Client must read directly from the API server as Ensure is called
+	// before the Manager's cache is started
+	Client client.Client
+
+	// Secret is the Secret the certificates are stored in
+	Secret types.NamespacedName
+
+	// Service is the Service fronting the webhook Server
+	Service types.NamespacedName
+
+	// CertDir is the directory the webhook Server reads its certificate from
+	CertDir string
+
+	// CheckInterval is how often the certificates are checked for expiry.
+	// Defaults to 12 hours.
+	CheckInterval time.Duration
+
+	// served is the serving certificate written when the Rotator was first
+	// ensured
+	served []byte
+
+	// now returns the current time
+	now func() time.Time
+}
+
+// Ensure makes sure that the Secret holds valid certificates, that the serving
+// certificate is written to the certificate directory and that the webhook
+// configurations trust the CA.
+// It must be called before the webhook Server is started.
+func (r *Rotator) Ensure() error {
+	serving, bundle, err := r.ensureSecret()
+	if err != nil {
+		return err
+	}
+	if err := r.writeCertDir(serving); err != nil {
+		return err
+	}
+	if r.served == nil {
+		r.served = serving.certPEM
+	}
+	return r.ensureCABundles(bundle)
+}
+
+// Start checks the certificates every CheckInterval until the stop channel is
+// closed. It returns ErrRotated once the certificate being served has been
+// replaced.
+func (r *Rotator) Start(stop <-chan struct{}) error {
+	log := logf.Log.WithName("wave")
+
+	interval := r.CheckInterval
+	if interval == 0 {
+		interval = defaultCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			if err := r.Ensure(); err != nil {
+				log.Error(err, "unable to ensure webhook certificates")
+				continue
+			}
+			if r.rotated() {
+				return ErrRotated
+			}
+		}
+	}
+}
+
+// rotated returns true if the serving certificate in the certificate
+// directory differs from the one being served
+func (r *Rotator) rotated() bool {
+	current, err := ioutil.ReadFile(filepath.Join(r.CertDir, CertName))
+	if err != nil {
+		return false
+	}
+	return !bytes.Equal(current, r.served)
+}
+
+// dnsNames returns the names the webhook Server is reached by
+func (r *Rotator) dnsNames() []string {
+	return []string{
+		fmt.Sprintf("%s.%s.svc", r.Service.Name, r.Service.Namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", r.Service.Name, r.Service.Namespace),
+	}
+}
+
+// timeNow returns the current time
+func (r *Rotator) timeNow() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+// ensureSecret generates any missing, invalid or expiring certificates and
+// stores them in the Secret.
+// It returns the serving certificate and the CA bundle to trust.
+func (r *Rotator) ensureSecret() (*keyPair, []byte, error) {
+	secret := &corev1.Secret{}
+	err := r.Client.Get(context.TODO(), r.Secret, secret)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, nil, fmt.Errorf("error getting Secret %s: %v", r.Secret, err)
+	}
+	exists := err == nil
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+
+	now := r.timeNow()
+	changed := false
+
+	ca, err := parseKeyPair(secret.Data[CACertName], secret.Data[CAKeyName])
+	if err != nil || expiresWithin(ca.cert, now, caRotation) {
+		if err == nil {
+			secret.Data[PreviousCACertName] = ca.certPEM
+		}
+		ca, err = newCA(now, caValidity)
+		if err != nil {
+			return nil, nil, err
+		}
+		secret.Data[CACertName] = ca.certPEM
+		secret.Data[CAKeyName] = ca.keyPEM
+		changed = true
+	}
+
+	serving, err := parseKeyPair(secret.Data[CertName], secret.Data[KeyName])
+	if err != nil || expiresWithin(serving.cert, now, servingRotation) || !validFor(serving, ca, r.dnsNames()) {
+		serving, err = newServingCert(ca, r.dnsNames(), now, servingValidity)
+		if err != nil {
+			return nil, nil, err
+		}
+		secret.Data[CertName] = serving.certPEM
+		secret.Data[KeyName] = serving.keyPEM
+		changed = true
+	}
+
+	bundle := ca.certPEM
+	if previous, ok := secret.Data[PreviousCACertName]; ok {
+		if cert, err := parseCert(previous); err == nil && now.Before(cert.NotAfter) {
+			bundle = appendPEM(ca.certPEM, previous)
+		}
+	}
+
+	if !changed {
+		return serving, bundle, nil
+	}
+	if exists {
+		err = r.Client.Update(context.TODO(), secret)
+	} else {
+		secret.ObjectMeta = metav1.ObjectMeta{Name: r.Secret.Name, Namespace: r.Secret.Namespace}
+		err = r.Client.Create(context.TODO(), secret)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error storing certificates in Secret %s: %v", r.Secret, err)
+	}
+	return serving, bundle, nil
+}
+
+// writeCertDir writes the serving certificate to the certificate directory
+func (r *Rotator) writeCertDir(serving *keyPair) error {
+	if err := os.MkdirAll(r.CertDir, 0700); err != nil {
+		return fmt.Errorf("error creating certificate directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(r.CertDir, KeyName), serving.keyPEM, 0600); err != nil {
+		return fmt.Errorf("error writing serving key: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(r.CertDir, CertName), serving.certPEM, 0600); err != nil {
+		return fmt.Errorf("error writing serving certificate: %v", err)
+	}
+	return nil
+}
+
+// ensureCABundles sets the caBundle of every webhook pointing at the Service.
+// The webhook configurations are read and updated as Unstructured objects so
+// that fields missing from the API types Wave is built against, such as
+// timeoutSeconds, are not dropped.
+func (r *Rotator) ensureCABundles(bundle []byte) error {
+	for _, kind := range []string{"MutatingWebhookConfiguration", "ValidatingWebhookConfiguration"} {
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(admissionregistrationv1beta1.SchemeGroupVersion.WithKind(kind + "List"))
+		if err := r.Client.List(context.TODO(), list); err != nil {
+			return fmt.Errorf("error listing %ss: %v", kind, err)
+		}
+		for i := range list.Items {
+			config := &list.Items[i]
+			changed, err := r.setCABundles(config, bundle)
+			if err != nil {
+				return fmt.Errorf("error setting caBundle of %s %s: %v", kind, config.GetName(), err)
+			}
+			if !changed {
+				continue
+			}
+			if err := r.Client.Update(context.TODO(), config); err != nil {
+				return fmt.Errorf("error updating %s %s: %v", kind, config.GetName(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// setCABundles sets the caBundle of each webhook in the configuration that
+// points at the Service. It returns true if any caBundle was changed.
+func (r *Rotator) setCABundles(config *unstructured.Unstructured, bundle []byte) (bool, error) {
+	webhooks, _, err := unstructured.NestedSlice(config.Object, "webhooks")
+	if err != nil {
+		return false, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(bundle)
+
+	changed := false
+	for _, w := range webhooks {
+		webhook, ok := w.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(webhook, "clientConfig", "service", "name")
+		namespace, _, _ := unstructured.NestedString(webhook, "clientConfig", "service", "namespace")
+		if name != r.Service.Name || namespace != r.Service.Namespace {
+			continue
+		}
+		if current, _, _ := unstructured.NestedString(webhook, "clientConfig", "caBundle"); current == encoded {
+			continue
+		}
+		if err := unstructured.SetNestedField(webhook, encoded, "clientConfig", "caBundle"); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, unstructured.SetNestedSlice(config.Object, webhooks, "webhooks")
+}
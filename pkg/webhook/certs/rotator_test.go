@@ -0,0 +1,289 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certs
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pusher/wave/test/utils"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("Rotator Suite", func() {
+	var c client.Client
+	var m utils.Matcher
+	var r *Rotator
+	var certDir string
+	var now time.Time
+
+	var secret *corev1.Secret
+	var mutating *admissionregistrationv1beta1.MutatingWebhookConfiguration
+	var other *admissionregistrationv1beta1.ValidatingWebhookConfiguration
+
+	const timeout = time.Second * 5
+
+	var webhook = func(name, service string) admissionregistrationv1beta1.Webhook {
+		path := "/" + name
+		return admissionregistrationv1beta1.Webhook{
+			Name: name + ".wave.pusher.com",
+			ClientConfig: admissionregistrationv1beta1.WebhookClientConfig{
+				Service: &admissionregistrationv1beta1.ServiceReference{
+					Name:      service,
+					Namespace: "default",
+					Path:      &path,
+				},
+			},
+		}
+	}
+
+	var getSecret = func() *corev1.Secret {
+		s := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "webhook-server-secret", Namespace: "default"}}
+		m.Get(s, timeout).Should(Succeed())
+		return s
+	}
+
+	BeforeEach(func() {
+		var err error
+		c, err = client.New(cfg, client.Options{Scheme: scheme.Scheme})
+		Expect(err).NotTo(HaveOccurred())
+		m = utils.Matcher{Client: c}
+
+		certDir, err = ioutil.TempDir("", "wave-certs")
+		Expect(err).NotTo(HaveOccurred())
+
+		now = time.Now()
+		r = &Rotator{
+			Client:  c,
+			Secret:  types.NamespacedName{Name: "webhook-server-secret", Namespace: "default"},
+			Service: types.NamespacedName{Name: "wave-webhook", Namespace: "default"},
+			CertDir: certDir,
+			now:     func() time.Time { return now },
+		}
+
+		mutating = &admissionregistrationv1beta1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "wave-mutating"},
+			Webhooks:   []admissionregistrationv1beta1.Webhook{webhook("mutate", "wave-webhook")},
+		}
+		m.Create(mutating).Should(Succeed())
+		other = &admissionregistrationv1beta1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "other-validating"},
+			Webhooks:   []admissionregistrationv1beta1.Webhook{webhook("validate", "other-webhook")},
+		}
+		m.Create(other).Should(Succeed())
+
+		Expect(r.Ensure()).To(Succeed())
+		secret = getSecret()
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(certDir)).To(Succeed())
+		utils.DeleteAll(cfg, timeout,
+			&corev1.SecretList{},
+			&admissionregistrationv1beta1.MutatingWebhookConfigurationList{},
+			&admissionregistrationv1beta1.ValidatingWebhookConfigurationList{},
+		)
+	})
+
+	It("stores the CA and serving certificate in the Secret", func() {
+		for _, key := range []string{CACertName, CAKeyName, CertName, KeyName} {
+			Expect(secret.Data).To(HaveKey(key))
+		}
+		ca, err := parseKeyPair(secret.Data[CACertName], secret.Data[CAKeyName])
+		Expect(err).NotTo(HaveOccurred())
+		serving, err := parseKeyPair(secret.Data[CertName], secret.Data[KeyName])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validFor(serving, ca, []string{"wave-webhook.default.svc", "wave-webhook.default.svc.cluster.local"})).To(BeTrue())
+	})
+
+	It("writes the serving certificate to the certificate directory", func() {
+		cert, err := ioutil.ReadFile(filepath.Join(certDir, CertName))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cert).To(Equal(secret.Data[CertName]))
+		key, err := ioutil.ReadFile(filepath.Join(certDir, KeyName))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(key).To(Equal(secret.Data[KeyName]))
+	})
+
+	It("sets the caBundle of webhooks pointing at the Service", func() {
+		m.Get(mutating, timeout).Should(Succeed())
+		Expect(mutating.Webhooks[0].ClientConfig.CABundle).To(Equal(appendPEM(secret.Data[CACertName])))
+	})
+
+	It("does not set the caBundle of other webhooks", func() {
+		m.Get(other, timeout).Should(Succeed())
+		Expect(other.Webhooks[0].ClientConfig.CABundle).To(BeEmpty())
+	})
+
+	It("keeps webhook fields missing from the client's API types", func() {
+		config := &unstructured.Unstructured{Object: map[string]interface{}{
+			"webhooks": []interface{}{
+				map[string]interface{}{
+					"name": "mutate.wave.pusher.com",
+					"clientConfig": map[string]interface{}{
+						"service": map[string]interface{}{"name": "wave-webhook", "namespace": "default"},
+					},
+					"timeoutSeconds": int64(3),
+				},
+			},
+		}}
+		bundle := appendPEM(secret.Data[CACertName])
+		Expect(r.setCABundles(config, bundle)).To(BeTrue())
+
+		webhooks, _, err := unstructured.NestedSlice(config.Object, "webhooks")
+		Expect(err).NotTo(HaveOccurred())
+		webhook := webhooks[0].(map[string]interface{})
+		Expect(webhook).To(HaveKeyWithValue("timeoutSeconds", int64(3)))
+		caBundle, _, err := unstructured.NestedString(webhook, "clientConfig", "caBundle")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(caBundle).To(Equal(base64.StdEncoding.EncodeToString(bundle)))
+	})
+
+	It("does not regenerate valid certificates", func() {
+		Expect(r.Ensure()).To(Succeed())
+		Expect(getSecret().Data).To(Equal(secret.Data))
+		Expect(r.rotated()).To(BeFalse())
+	})
+
+	Context("when the serving certificate is close to expiry", func() {
+		BeforeEach(func() {
+			now = now.Add(servingValidity - servingRotation + time.Hour)
+			Expect(r.Ensure()).To(Succeed())
+		})
+
+		It("rotates the serving certificate", func() {
+			updated := getSecret()
+			Expect(updated.Data[CertName]).NotTo(Equal(secret.Data[CertName]))
+			Expect(updated.Data[KeyName]).NotTo(Equal(secret.Data[KeyName]))
+		})
+
+		It("keeps the CA", func() {
+			updated := getSecret()
+			Expect(updated.Data[CACertName]).To(Equal(secret.Data[CACertName]))
+			Expect(updated.Data).NotTo(HaveKey(PreviousCACertName))
+		})
+
+		It("reports that the certificate was rotated", func() {
+			Expect(r.rotated()).To(BeTrue())
+		})
+	})
+
+	Context("when the CA is close to expiry", func() {
+		BeforeEach(func() {
+			now = now.Add(caValidity - caRotation + time.Hour)
+			Expect(r.Ensure()).To(Succeed())
+		})
+
+		It("rotates the CA and serving certificate", func() {
+			updated := getSecret()
+			Expect(updated.Data[CACertName]).NotTo(Equal(secret.Data[CACertName]))
+			Expect(updated.Data[CertName]).NotTo(Equal(secret.Data[CertName]))
+		})
+
+		It("keeps trusting the previous CA", func() {
+			updated := getSecret()
+			Expect(updated.Data[PreviousCACertName]).To(Equal(secret.Data[CACertName]))
+
+			m.Get(mutating, timeout).Should(Succeed())
+			Expect(mutating.Webhooks[0].ClientConfig.CABundle).To(Equal(
+				appendPEM(updated.Data[CACertName], secret.Data[CACertName]),
+			))
+		})
+	})
+
+	Context("when the Secret holds an invalid certificate", func() {
+		BeforeEach(func() {
+			secret.Data[CertName] = []byte("invalid")
+			m.Update(secret, timeout).Should(Succeed())
+			Expect(r.Ensure()).To(Succeed())
+		})
+
+		It("regenerates the serving certificate", func() {
+			updated := getSecret()
+			_, err := parseKeyPair(updated.Data[CertName], updated.Data[KeyName])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(updated.Data[CACertName]).To(Equal(secret.Data[CACertName]))
+		})
+	})
+
+	Context("Start", func() {
+		It("returns when the stop channel is closed", func() {
+			stop := make(chan struct{})
+			close(stop)
+			Expect(r.Start(stop)).To(Succeed())
+		})
+
+		It("returns ErrRotated once the serving certificate is rotated", func() {
+			now = now.Add(servingValidity)
+			r.CheckInterval = 10 * time.Millisecond
+			stop := make(chan struct{})
+			defer close(stop)
+			Expect(r.Start(stop)).To(Equal(ErrRotated))
+		})
+	})
+})
+
+var _ = Describe("Certificates", func() {
+	var ca *keyPair
+	now := time.Now()
+	names := []string{"wave.default.svc", "wave.default.svc.cluster.local"}
+
+	BeforeEach(func() {
+		var err error
+		ca, err = newCA(now, caValidity)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("generates a serving certificate valid for the DNS names", func() {
+		serving, err := newServingCert(ca, names, now, servingValidity)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validFor(serving, ca, names)).To(BeTrue())
+		Expect(validFor(serving, ca, []string{"other.default.svc"})).To(BeFalse())
+	})
+
+	It("rejects a serving certificate signed by another CA", func() {
+		other, err := newCA(now, caValidity)
+		Expect(err).NotTo(HaveOccurred())
+		serving, err := newServingCert(other, names, now, servingValidity)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(validFor(serving, ca, names)).To(BeFalse())
+	})
+
+	It("rejects a private key that does not match the certificate", func() {
+		other, err := newCA(now, caValidity)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = parseKeyPair(ca.certPEM, other.keyPEM)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("detects certificates close to expiry", func() {
+		Expect(expiresWithin(ca.cert, now, caRotation)).To(BeFalse())
+		Expect(expiresWithin(ca.cert, now.Add(caValidity-caRotation+time.Hour), caRotation)).To(BeTrue())
+	})
+})
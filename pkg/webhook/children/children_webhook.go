@@ -0,0 +1,132 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package children
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pusher/wave/pkg/core"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	// ConfigMapPath is the path the ConfigMap rollout webhook is served on
+	ConfigMapPath = "/validate-v1-configmap"
+
+	// SecretPath is the path the Secret rollout webhook is served on
+	SecretPath = "/validate-v1-secret"
+)
+
+// Add creates the ConfigMap and Secret rollout webhooks and registers them
+// with the Server
+func Add(mgr manager.Manager, server *webhook.Server) error {
+	configMaps, err := newWarnRollouts(mgr, func() core.Object { return &corev1.ConfigMap{} })
+	if err != nil {
+		return err
+	}
+	server.Register(ConfigMapPath, &admission.Webhook{Handler: configMaps})
+
+	secrets, err := newWarnRollouts(mgr, func() core.Object { return &corev1.Secret{} })
+	if err != nil {
+		return err
+	}
+	server.Register(SecretPath, &admission.Webhook{Handler: secrets})
+	return nil
+}
+
+// newWarnRollouts returns a new admission.Handler for the children
+// constructed by newObject
+func newWarnRollouts(mgr manager.Manager, newObject func() core.Object) (admission.Handler, error) {
+	decoder, err := admission.NewDecoder(mgr.GetScheme())
+	if err != nil {
+		return nil, err
+	}
+	return &WarnRollouts{
+		decoder:   decoder,
+		handler:   core.NewHandler(mgr.GetClient(), mgr.GetEventRecorderFor("wave")),
+		recorder:  mgr.GetEventRecorderFor("wave"),
+		newObject: newObject,
+	}, nil
+}
+
+var _ admission.Handler = &WarnRollouts{}
+
+// WarnRollouts warns when an update to a ConfigMap or Secret will trigger
+// rollouts of the instances referencing it.
+//
+// The Kubernetes API that Wave is built against predates admission warnings,
+// so the rollouts are reported in a Warning Event on the ConfigMap or Secret
+// and as the reason the update was allowed. Updates are never denied.
+type WarnRollouts struct {
+	decoder   *admission.Decoder
+	handler   *core.Handler
+	recorder  record.EventRecorder
+	newObject func() core.Object
+}
+
+// Handle records the instances whose configuration hash will change as a
+// result of the update in the request
+func (w *WarnRollouts) Handle(ctx context.Context, req admission.Request) admission.Response {
+	log := logf.Log.WithName("wave")
+
+	if req.Operation != admissionv1beta1.Update {
+		return admission.Allowed("")
+	}
+
+	new := w.newObject()
+	err := w.decoder.Decode(req, new)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	old := w.newObject()
+	err = json.Unmarshal(req.OldObject.Raw, old)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	rollouts, err := w.handler.GetRollouts(old, new)
+	if err != nil {
+		log.Error(err, "unable to determine rollouts", "namespace", new.GetNamespace(), "name", new.GetName())
+		return admission.Allowed("")
+	}
+	if len(rollouts) == 0 {
+		return admission.Allowed("")
+	}
+
+	warning := fmt.Sprintf("this change will trigger rollouts of: %s", strings.Join(rollouts, ", "))
+	if req.DryRun == nil || !*req.DryRun {
+		w.recorder.Event(new, corev1.EventTypeWarning, "RolloutsTriggered", warning)
+		w.handler.RecordChange(new, rollouts, req.UserInfo.Username, operationName(req.Operation))
+	}
+	return admission.Allowed(warning)
+}
+
+// operationName returns the operation in the form used by managedFields, for
+// example "Update"
+func operationName(operation admissionv1beta1.Operation) string {
+	return strings.Title(strings.ToLower(string(operation)))
+}
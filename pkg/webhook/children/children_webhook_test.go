@@ -0,0 +1,130 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package children
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pusher/wave/pkg/core"
+	"github.com/pusher/wave/test/utils"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+var _ = Describe("ConfigMap rollout webhook Suite", func() {
+	var m utils.Matcher
+	var warner admission.Handler
+	var cm *corev1.ConfigMap
+
+	var mgrStopped *sync.WaitGroup
+	var stopMgr chan struct{}
+
+	const timeout = time.Second * 5
+
+	BeforeEach(func() {
+		mgr, err := manager.New(cfg, manager.Options{})
+		Expect(err).NotTo(HaveOccurred())
+		for _, obj := range []runtime.Object{&appsv1.Deployment{}, &appsv1.StatefulSet{}, &appsv1.DaemonSet{}, &batchv1beta1.CronJob{}} {
+			Expect(core.IndexReferences(mgr.GetFieldIndexer(), obj)).To(Succeed())
+		}
+		m = utils.Matcher{Client: mgr.GetClient()}
+
+		warner, err = newWarnRollouts(mgr, func() core.Object { return &corev1.ConfigMap{} })
+		Expect(err).NotTo(HaveOccurred())
+
+		stopMgr, mgrStopped = StartTestManager(mgr)
+
+		cm = utils.ExampleConfigMap1.DeepCopy()
+		m.Create(cm).Should(Succeed())
+		m.Get(cm, timeout).Should(Succeed())
+
+		deployment := utils.ExampleDeployment.DeepCopy()
+		deployment.SetAnnotations(map[string]string{core.RequiredAnnotation: "true"})
+		m.Create(deployment).Should(Succeed())
+		m.Get(deployment, timeout).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		close(stopMgr)
+		mgrStopped.Wait()
+
+		utils.DeleteAll(cfg, timeout,
+			&appsv1.DeploymentList{},
+			&corev1.ConfigMapList{},
+			&corev1.EventList{},
+		)
+	})
+
+	Context("When a referenced ConfigMap's data is updated", func() {
+		var response admission.Response
+
+		BeforeEach(func() {
+			updated := cm.DeepCopy()
+			updated.Data["key1"] = "modified"
+			response = warner.Handle(context.TODO(), updateRequest(cm, updated))
+		})
+
+		It("Admits the update", func() {
+			Expect(response.Allowed).To(BeTrue())
+		})
+
+		It("Lists the rollouts in the response", func() {
+			Expect(string(response.Result.Reason)).To(Equal("this change will trigger rollouts of: Deployment/example"))
+		})
+
+		It("Sends a warning event for the ConfigMap", func() {
+			events := &corev1.EventList{}
+			eventMessage := func(event *corev1.Event) string {
+				return event.Message
+			}
+			m.Eventually(events, timeout).Should(utils.WithItems(ContainElement(WithTransform(eventMessage, Equal("this change will trigger rollouts of: Deployment/example")))))
+		})
+	})
+
+	Context("When a referenced ConfigMap's metadata is updated", func() {
+		var response admission.Response
+
+		BeforeEach(func() {
+			updated := cm.DeepCopy()
+			updated.SetLabels(map[string]string{"modified": "true"})
+			response = warner.Handle(context.TODO(), updateRequest(cm, updated))
+		})
+
+		It("Admits the update", func() {
+			Expect(response.Allowed).To(BeTrue())
+		})
+
+		It("Doesn't list any rollouts", func() {
+			Expect(string(response.Result.Reason)).To(BeEmpty())
+		})
+	})
+
+	Context("operationName", func() {
+		It("Returns the operation in the form used by managedFields", func() {
+			Expect(operationName(admissionv1beta1.Update)).To(Equal("Update"))
+		})
+	})
+})
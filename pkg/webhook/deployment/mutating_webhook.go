@@ -0,0 +1,100 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/pusher/wave/pkg/core"
+	appsv1 "k8s.io/api/apps/v1"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// MutatingPath is the path the Deployment mutating webhook is served on
+const MutatingPath = "/mutate-apps-v1-deployment"
+
+// AddMutating creates a new Deployment mutating webhook and registers it with
+// the Server
+func AddMutating(mgr manager.Manager, server *webhook.Server) error {
+	m, err := newMutator(mgr)
+	if err != nil {
+		return err
+	}
+	server.Register(MutatingPath, &admission.Webhook{Handler: m})
+	return nil
+}
+
+// newMutator returns a new admission.Handler
+func newMutator(mgr manager.Manager) (admission.Handler, error) {
+	decoder, err := admission.NewDecoder(mgr.GetScheme())
+	if err != nil {
+		return nil, err
+	}
+	return &MutateDeployment{
+		decoder: decoder,
+		handler: core.NewHandler(mgr.GetClient(), mgr.GetEventRecorderFor("wave")),
+	}, nil
+}
+
+var _ admission.Handler = &MutateDeployment{}
+
+// MutateDeployment sets the configuration hash on Deployments as they are
+// admitted
+type MutateDeployment struct {
+	decoder *admission.Decoder
+	handler *core.Handler
+}
+
+// Handle sets the configuration hash on the Deployment in the request so that
+// its first rollout doesn't need to be replaced once the controller
+// reconciles it.
+// Deployments are always admitted; if the hash can't be calculated the
+// Deployment is admitted unmodified and left for the controller.
+func (m *MutateDeployment) Handle(ctx context.Context, req admission.Request) admission.Response {
+	log := logf.Log.WithName("wave")
+
+	instance := &appsv1.Deployment{}
+	err := m.decoder.Decode(req, instance)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	// The namespace is not always set on objects being created
+	if instance.GetNamespace() == "" {
+		instance.SetNamespace(req.Namespace)
+	}
+
+	mutated, err := m.handler.MutateDeployment(instance)
+	if err != nil {
+		log.V(0).Info("Unable to set configuration hash at admission", "namespace", instance.GetNamespace(), "name", instance.GetName(), "error", err.Error())
+		return admission.Allowed(fmt.Sprintf("unable to calculate configuration hash: %v", err))
+	}
+	if !mutated {
+		return admission.Allowed("")
+	}
+
+	marshaled, err := json.Marshal(instance)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployment
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pusher/wave/pkg/core"
+	"github.com/pusher/wave/test/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+var _ = Describe("Deployment mutating webhook Suite", func() {
+	var m utils.Matcher
+	var mutator admission.Handler
+	var instance *appsv1.Deployment
+
+	var mgrStopped *sync.WaitGroup
+	var stopMgr chan struct{}
+
+	const timeout = time.Second * 5
+
+	BeforeEach(func() {
+		mgr, err := manager.New(cfg, manager.Options{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(core.IndexOwners(mgr.GetFieldIndexer())).To(Succeed())
+		m = utils.Matcher{Client: mgr.GetClient()}
+
+		mutator, err = newMutator(mgr)
+		Expect(err).NotTo(HaveOccurred())
+
+		stopMgr, mgrStopped = StartTestManager(mgr)
+
+		for _, obj := range []utils.Object{
+			utils.ExampleConfigMap1.DeepCopy(),
+			utils.ExampleConfigMap2.DeepCopy(),
+			utils.ExampleConfigMap3.DeepCopy(),
+			utils.ExampleSecret1.DeepCopy(),
+			utils.ExampleSecret2.DeepCopy(),
+			utils.ExampleSecret3.DeepCopy(),
+		} {
+			m.Create(obj).Should(Succeed())
+			m.Get(obj, timeout).Should(Succeed())
+		}
+
+		instance = utils.ExampleDeployment.DeepCopy()
+	})
+
+	AfterEach(func() {
+		close(stopMgr)
+		mgrStopped.Wait()
+
+		utils.DeleteAll(cfg, timeout,
+			&corev1.ConfigMapList{},
+			&corev1.SecretList{},
+		)
+	})
+
+	Context("When a Deployment with the required annotation is created", func() {
+		var response admission.Response
+
+		BeforeEach(func() {
+			instance.SetAnnotations(map[string]string{core.RequiredAnnotation: "true"})
+			response = mutator.Handle(context.TODO(), createRequest(instance))
+		})
+
+		It("Admits the Deployment", func() {
+			Expect(response.Allowed).To(BeTrue())
+		})
+
+		It("Patches the Deployment", func() {
+			Expect(response.Patches).NotTo(BeEmpty())
+		})
+	})
+
+	Context("When a Deployment without the required annotation is created", func() {
+		var response admission.Response
+
+		BeforeEach(func() {
+			response = mutator.Handle(context.TODO(), createRequest(instance))
+		})
+
+		It("Admits the Deployment", func() {
+			Expect(response.Allowed).To(BeTrue())
+		})
+
+		It("Doesn't patch the Deployment", func() {
+			Expect(response.Patches).To(BeEmpty())
+		})
+	})
+
+	Context("When a Deployment with a missing required child is created", func() {
+		var response admission.Response
+
+		BeforeEach(func() {
+			instance.SetAnnotations(map[string]string{core.RequiredAnnotation: "true"})
+			instance.Spec.Template.Spec.Volumes[0].Secret.SecretName = "missing"
+			response = mutator.Handle(context.TODO(), createRequest(instance))
+		})
+
+		It("Admits the Deployment", func() {
+			Expect(response.Allowed).To(BeTrue())
+		})
+
+		It("Doesn't patch the Deployment", func() {
+			Expect(response.Patches).To(BeEmpty())
+		})
+	})
+})
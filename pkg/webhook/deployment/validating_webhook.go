@@ -0,0 +1,105 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployment
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pusher/wave/pkg/core"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// ValidatingPath is the path the Deployment validating webhook is served on
+const ValidatingPath = "/validate-apps-v1-deployment"
+
+// AddValidating creates a new Deployment validating webhook and registers it
+// with the Server
+func AddValidating(mgr manager.Manager, server *webhook.Server) error {
+	v, err := newValidator(mgr)
+	if err != nil {
+		return err
+	}
+	server.Register(ValidatingPath, &admission.Webhook{Handler: v})
+	return nil
+}
+
+// newValidator returns a new admission.Handler
+func newValidator(mgr manager.Manager) (admission.Handler, error) {
+	decoder, err := admission.NewDecoder(mgr.GetScheme())
+	if err != nil {
+		return nil, err
+	}
+	return &ValidateDeployment{
+		decoder: decoder,
+		handler: core.NewHandler(mgr.GetClient(), mgr.GetEventRecorderFor("wave")),
+	}, nil
+}
+
+var _ admission.Handler = &ValidateDeployment{}
+
+// ValidateDeployment rejects Deployments that reference required ConfigMaps,
+// Secrets or keys that don't exist
+type ValidateDeployment struct {
+	decoder *admission.Decoder
+	handler *core.Handler
+}
+
+// Handle denies the Deployment in the request if its required children are
+// missing. Updates are only checked when they change the children the
+// Deployment references, and never when made by Wave.
+// Any warnings are logged and returned as the reason the Deployment was
+// allowed.
+func (v *ValidateDeployment) Handle(ctx context.Context, req admission.Request) admission.Response {
+	log := logf.Log.WithName("wave")
+
+	instance := &appsv1.Deployment{}
+	err := v.decoder.Decode(req, instance)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	// The namespace is not always set on objects being created
+	if instance.GetNamespace() == "" {
+		instance.SetNamespace(req.Namespace)
+	}
+
+	var warnings []string
+	if req.Operation == admissionv1beta1.Update {
+		old := &appsv1.Deployment{}
+		err = json.Unmarshal(req.OldObject.Raw, old)
+		if err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		warnings, err = v.handler.ValidateDeploymentUpdate(old, instance, req.UserInfo.Username)
+	} else {
+		warnings, err = v.handler.ValidateDeployment(instance)
+	}
+	if err != nil {
+		return admission.Denied(err.Error())
+	}
+	if len(warnings) > 0 {
+		log.V(0).Info("Admitting Deployment with warnings", "namespace", instance.GetNamespace(), "name", instance.GetName(), "warnings", warnings)
+	}
+	return admission.Allowed(strings.Join(warnings, "; "))
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployment
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pusher/wave/pkg/core"
+	"github.com/pusher/wave/test/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+var _ = Describe("Deployment validating webhook Suite", func() {
+	var mgr manager.Manager
+	var m utils.Matcher
+	var validator admission.Handler
+	var instance *appsv1.Deployment
+
+	var mgrStopped *sync.WaitGroup
+	var stopMgr chan struct{}
+
+	const timeout = time.Second * 5
+	const waveServiceAccount = "system:serviceaccount:wave-system:wave"
+
+	BeforeEach(func() {
+		var err error
+		mgr, err = manager.New(cfg, manager.Options{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(core.IndexOwners(mgr.GetFieldIndexer())).To(Succeed())
+		m = utils.Matcher{Client: mgr.GetClient()}
+
+		decoder, err := admission.NewDecoder(mgr.GetScheme())
+		Expect(err).NotTo(HaveOccurred())
+		validator = &ValidateDeployment{
+			decoder: decoder,
+			handler: core.NewHandlerWithOptions(mgr.GetClient(), mgr.GetEventRecorderFor("wave"), core.Options{ServiceAccount: waveServiceAccount}),
+		}
+
+		stopMgr, mgrStopped = StartTestManager(mgr)
+
+		for _, obj := range []utils.Object{
+			utils.ExampleConfigMap1.DeepCopy(),
+			utils.ExampleConfigMap2.DeepCopy(),
+			utils.ExampleConfigMap3.DeepCopy(),
+			utils.ExampleSecret1.DeepCopy(),
+			utils.ExampleSecret2.DeepCopy(),
+			utils.ExampleSecret3.DeepCopy(),
+		} {
+			m.Create(obj).Should(Succeed())
+			m.Get(obj, timeout).Should(Succeed())
+		}
+
+		instance = utils.ExampleDeployment.DeepCopy()
+		instance.SetAnnotations(map[string]string{core.RequiredAnnotation: "true"})
+	})
+
+	AfterEach(func() {
+		close(stopMgr)
+		mgrStopped.Wait()
+
+		utils.DeleteAll(cfg, timeout,
+			&corev1.ConfigMapList{},
+			&corev1.SecretList{},
+		)
+	})
+
+	It("Admits a Deployment whose required children exist", func() {
+		response := validator.Handle(context.TODO(), createRequest(instance))
+		Expect(response.Allowed).To(BeTrue())
+	})
+
+	It("Denies a Deployment referencing a missing ConfigMap", func() {
+		instance.Spec.Template.Spec.Volumes[1].ConfigMap.Name = "missing"
+		response := validator.Handle(context.TODO(), createRequest(instance))
+		Expect(response.Allowed).To(BeFalse())
+		Expect(string(response.Result.Reason)).To(ContainSubstring("ConfigMap/missing"))
+	})
+
+	It("Denies a Deployment referencing a missing ConfigMap key", func() {
+		container := &instance.Spec.Template.Spec.Containers[0]
+		container.Env[0].ValueFrom.ConfigMapKeyRef.Key = "missing"
+		response := validator.Handle(context.TODO(), createRequest(instance))
+		Expect(response.Allowed).To(BeFalse())
+		Expect(string(response.Result.Reason)).To(ContainSubstring("ConfigMap/example1[missing]"))
+	})
+
+	It("Admits a Deployment without the required annotation", func() {
+		instance.SetAnnotations(map[string]string{})
+		instance.Spec.Template.Spec.Volumes[1].ConfigMap.Name = "missing"
+		response := validator.Handle(context.TODO(), createRequest(instance))
+		Expect(response.Allowed).To(BeTrue())
+	})
+
+	Context("When a required child of an existing Deployment is deleted", func() {
+		var updated *appsv1.Deployment
+
+		BeforeEach(func() {
+			m.Create(instance).Should(Succeed())
+			m.Get(instance, timeout).Should(Succeed())
+
+			cm := utils.ExampleConfigMap1.DeepCopy()
+			m.Delete(cm).Should(Succeed())
+			m.Get(cm, timeout).ShouldNot(Succeed())
+
+			// Wave records the missing dependency with its own service account
+			h := core.NewHandlerWithOptions(mgr.GetClient(), mgr.GetEventRecorderFor("wave"), core.Options{
+				TrackingMode:   core.IndexTracking,
+				ServiceAccount: waveServiceAccount,
+			})
+			_, err := h.HandleDeployment(instance.DeepCopy())
+			Expect(err).NotTo(HaveOccurred())
+
+			updated = instance.DeepCopy()
+			m.Eventually(updated, timeout).Should(utils.WithAnnotations(HaveKey(core.MissingDependenciesAnnotation)))
+		})
+
+		AfterEach(func() {
+			utils.DeleteAll(cfg, timeout,
+				&appsv1.DeploymentList{},
+			)
+		})
+
+		It("Admits Wave's update recording the missing dependency", func() {
+			response := validator.Handle(context.TODO(), updateRequest(instance, updated, waveServiceAccount))
+			Expect(response.Allowed).To(BeTrue())
+		})
+
+		It("Admits updates that don't change the referenced children", func() {
+			bumped := updated.DeepCopy()
+			bumped.Spec.Template.Spec.Containers[0].Image = "container1:v2"
+			response := validator.Handle(context.TODO(), updateRequest(updated, bumped, "alice"))
+			Expect(response.Allowed).To(BeTrue())
+		})
+
+		It("Denies updates that reference another missing child", func() {
+			changed := updated.DeepCopy()
+			changed.Spec.Template.Spec.Volumes[1].ConfigMap.Name = "missing"
+			response := validator.Handle(context.TODO(), updateRequest(updated, changed, "alice"))
+			Expect(response.Allowed).To(BeFalse())
+			Expect(string(response.Result.Reason)).To(ContainSubstring("ConfigMap/missing"))
+		})
+
+		It("Admits updates made by Wave that change the referenced children", func() {
+			changed := updated.DeepCopy()
+			changed.Spec.Template.Spec.Volumes[1].ConfigMap.Name = "missing"
+			response := validator.Handle(context.TODO(), updateRequest(updated, changed, waveServiceAccount))
+			Expect(response.Allowed).To(BeTrue())
+		})
+	})
+})
@@ -18,20 +18,37 @@ package webhook
 
 import (
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	ctrlwebhook "sigs.k8s.io/controller-runtime/pkg/webhook"
 )
 
-// AddToManagerFuncs is a list of functions to add all Controllers to the Manager
-var AddToManagerFuncs []func(manager.Manager) error
+// Options configures the webhook Server
+type Options struct {
+	// Port is the port the webhook Server listens on
+	Port int
 
-// AddToManager adds all Controllers to the Manager
+	// CertDir is the directory containing the tls.crt and tls.key served by
+	// the webhook Server
+	CertDir string
+}
+
+// AddToManagerFuncs is a list of functions to register all Webhooks with the
+// Server
+var AddToManagerFuncs []func(manager.Manager, *ctrlwebhook.Server) error
+
+// AddToManager registers all Webhooks with a new Server and adds the Server to
+// the Manager
 // +kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations;validatingwebhookconfigurations,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update;patch;delete
-func AddToManager(m manager.Manager) error {
+func AddToManager(m manager.Manager, o Options) error {
+	server := &ctrlwebhook.Server{
+		Port:    o.Port,
+		CertDir: o.CertDir,
+	}
 	for _, f := range AddToManagerFuncs {
-		if err := f(m); err != nil {
+		if err := f(m, server); err != nil {
 			return err
 		}
 	}
-	return nil
+	return m.Add(server)
 }
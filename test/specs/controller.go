@@ -0,0 +1,440 @@
+/*
+Copyright 2018 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package specs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pusher/wave/pkg/core"
+	"github.com/pusher/wave/test/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// HashMessage is the Event message sent when the hash of the example
+// children is first set on a Pod Template
+const HashMessage = "Configuration hash updated to v1:f445cf63c10f7fc531f81beb46bd96e9dc36ab495f864f789c51d4bec49fdca5"
+
+// Controller describes a pod controller type for the shared controller spec
+type Controller struct {
+	// Kind is the kind of the pod controller, used in spec descriptions
+	Kind string
+
+	// New returns a new copy of the example instance to reconcile
+	New func() utils.Object
+
+	// List returns an empty list of the instance type, used to clean up
+	// after each spec
+	List func() runtime.Object
+
+	// OwnerRef constructs the owner reference Wave sets on children of the
+	// instance given
+	OwnerRef func(utils.Object) metav1.OwnerReference
+
+	// PodTemplate returns the Pod Template of the instance given so that specs
+	// can modify it in place
+	PodTemplate func(utils.Object) *corev1.PodTemplateSpec
+
+	// Add adds the controller under test to the Manager and returns a channel
+	// which receives each request once it has been reconciled
+	Add func(manager.Manager) (<-chan reconcile.Request, error)
+}
+
+// DescribeController runs the shared controller spec against the controller
+// given. The config is read once the suite has started the test environment.
+func DescribeController(cfg func() *rest.Config, controller Controller) bool {
+	return Describe(fmt.Sprintf("%s controller Suite", controller.Kind), func() {
+		var c client.Client
+		var m utils.Matcher
+
+		var instance utils.Object
+		var requests <-chan reconcile.Request
+		var mgrStopped *sync.WaitGroup
+		var stopMgr chan struct{}
+
+		const timeout = time.Second * 5
+		const consistentlyTimeout = time.Second
+
+		var ownerRef metav1.OwnerReference
+		var cm1 *corev1.ConfigMap
+		var cm2 *corev1.ConfigMap
+		var cm3 *corev1.ConfigMap
+		var s1 *corev1.Secret
+		var s2 *corev1.Secret
+		var s3 *corev1.Secret
+
+		var waitForInstanceReconciled = func(obj core.Object) {
+			request := reconcile.Request{
+				NamespacedName: types.NamespacedName{
+					Name:      obj.GetName(),
+					Namespace: obj.GetNamespace(),
+				},
+			}
+			// wait for reconcile for creating the instance
+			Eventually(requests, timeout).Should(Receive(Equal(request)))
+		}
+
+		BeforeEach(func() {
+			mgr, err := manager.New(cfg(), manager.Options{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(core.IndexOwners(mgr.GetFieldIndexer())).To(Succeed())
+			c = mgr.GetClient()
+			m = utils.Matcher{Client: c}
+
+			requests, err = controller.Add(mgr)
+			Expect(err).NotTo(HaveOccurred())
+
+			stopMgr, mgrStopped = StartTestManager(mgr)
+
+			// Create some configmaps and secrets
+			cm1 = utils.ExampleConfigMap1.DeepCopy()
+			cm2 = utils.ExampleConfigMap2.DeepCopy()
+			cm3 = utils.ExampleConfigMap3.DeepCopy()
+			s1 = utils.ExampleSecret1.DeepCopy()
+			s2 = utils.ExampleSecret2.DeepCopy()
+			s3 = utils.ExampleSecret3.DeepCopy()
+
+			m.Create(cm1).Should(Succeed())
+			m.Create(cm2).Should(Succeed())
+			m.Create(cm3).Should(Succeed())
+			m.Create(s1).Should(Succeed())
+			m.Create(s2).Should(Succeed())
+			m.Create(s3).Should(Succeed())
+			m.Get(cm1, timeout).Should(Succeed())
+			m.Get(cm2, timeout).Should(Succeed())
+			m.Get(cm3, timeout).Should(Succeed())
+			m.Get(s1, timeout).Should(Succeed())
+			m.Get(s2, timeout).Should(Succeed())
+			m.Get(s3, timeout).Should(Succeed())
+
+			instance = controller.New()
+
+			// Create an instance and wait for it to be reconciled
+			m.Create(instance).Should(Succeed())
+			waitForInstanceReconciled(instance)
+
+			ownerRef = controller.OwnerRef(instance)
+		})
+
+		AfterEach(func() {
+			// Make sure to delete any finalizers (if the instance exists)
+			Eventually(func() error {
+				key := types.NamespacedName{Namespace: instance.GetNamespace(), Name: instance.GetName()}
+				err := c.Get(context.TODO(), key, instance)
+				if err != nil && errors.IsNotFound(err) {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				instance.SetFinalizers([]string{})
+				return c.Update(context.TODO(), instance)
+			}, timeout).Should(Succeed())
+
+			Eventually(func() error {
+				key := types.NamespacedName{Namespace: instance.GetNamespace(), Name: instance.GetName()}
+				err := c.Get(context.TODO(), key, instance)
+				if err != nil && errors.IsNotFound(err) {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if len(instance.GetFinalizers()) > 0 {
+					return fmt.Errorf("Finalizers not upated")
+				}
+				return nil
+			}, timeout).Should(Succeed())
+
+			close(stopMgr)
+			mgrStopped.Wait()
+
+			utils.DeleteAll(cfg(), timeout,
+				controller.List(),
+				&corev1.ConfigMapList{},
+				&corev1.SecretList{},
+				&corev1.EventList{},
+			)
+		})
+
+		Context(fmt.Sprintf("When a %s is reconciled", controller.Kind), func() {
+			Context("And it has the required annotation", func() {
+				BeforeEach(func() {
+					annotations := instance.GetAnnotations()
+					if annotations == nil {
+						annotations = make(map[string]string)
+					}
+					annotations[core.RequiredAnnotation] = "true"
+					instance.SetAnnotations(annotations)
+
+					m.Update(instance).Should(Succeed())
+					waitForInstanceReconciled(instance)
+
+					// Get the updated instance
+					m.Get(instance, timeout).Should(Succeed())
+				})
+
+				It("Adds OwnerReferences to all children", func() {
+					for _, obj := range []core.Object{cm1, cm2, cm3, s1, s2, s3} {
+						m.Eventually(obj, timeout).Should(utils.WithOwnerReferences(ContainElement(ownerRef)))
+					}
+				})
+
+				It(fmt.Sprintf("Adds a finalizer to the %s", controller.Kind), func() {
+					m.Eventually(instance, timeout).Should(utils.WithFinalizers(ContainElement(core.FinalizerString)))
+				})
+
+				It("Adds a config hash to the Pod Template", func() {
+					m.Eventually(instance, timeout).Should(utils.WithPodTemplateAnnotations(HaveKey(core.ConfigHashAnnotation)))
+				})
+
+				It("Sends an event when updating the hash", func() {
+					m.Eventually(instance, timeout).Should(utils.WithPodTemplateAnnotations(HaveKey(core.ConfigHashAnnotation)))
+
+					events := &corev1.EventList{}
+					eventMessage := func(event *corev1.Event) string {
+						return event.Message
+					}
+
+					m.Eventually(events, timeout).Should(utils.WithItems(ContainElement(WithTransform(eventMessage, Equal(HashMessage)))))
+				})
+
+				Context("And a required child is missing", func() {
+					var missing *corev1.ConfigMap
+
+					BeforeEach(func() {
+						missing = utils.ExampleConfigMap1.DeepCopy()
+						missing.SetName("missing")
+
+						template := controller.PodTemplate(instance)
+						template.Spec.Volumes = append(template.Spec.Volumes, corev1.Volume{
+							Name: "missing",
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{
+										Name: missing.GetName(),
+									},
+								},
+							},
+						})
+						m.Update(instance).Should(Succeed())
+						m.Eventually(instance, timeout).Should(utils.WithAnnotations(HaveKey(core.MissingDependenciesAnnotation)))
+					})
+
+					It(fmt.Sprintf("Reconciles the %s once the child is created", controller.Kind), func() {
+						m.Create(missing).Should(Succeed())
+
+						m.Eventually(instance, timeout).ShouldNot(utils.WithAnnotations(HaveKey(core.MissingDependenciesAnnotation)))
+						m.Eventually(missing, timeout).Should(utils.WithOwnerReferences(ContainElement(ownerRef)))
+					})
+				})
+
+				Context("And a child is removed", func() {
+					var originalHash string
+					BeforeEach(func() {
+						m.Eventually(instance, timeout).Should(utils.WithPodTemplateAnnotations(HaveKey(core.ConfigHashAnnotation)))
+						template := controller.PodTemplate(instance)
+						originalHash = template.GetAnnotations()[core.ConfigHashAnnotation]
+
+						// Remove "container2" which references Secret example2 and ConfigMap
+						// example2
+						containers := template.Spec.Containers
+						Expect(containers[0].Name).To(Equal("container1"))
+						template.Spec.Containers = []corev1.Container{containers[0]}
+						m.Update(instance).Should(Succeed())
+						waitForInstanceReconciled(instance)
+
+						// Get the updated instance
+						m.Get(instance, timeout).Should(Succeed())
+					})
+
+					It("Removes the OwnerReference from the orphaned ConfigMap", func() {
+						m.Eventually(cm2, timeout).ShouldNot(utils.WithOwnerReferences(ContainElement(ownerRef)))
+					})
+
+					It("Removes the OwnerReference from the orphaned Secret", func() {
+						m.Eventually(s2, timeout).ShouldNot(utils.WithOwnerReferences(ContainElement(ownerRef)))
+					})
+
+					It("Updates the config hash in the Pod Template", func() {
+						m.Eventually(instance, timeout).ShouldNot(utils.WithPodTemplateAnnotations(HaveKeyWithValue(core.ConfigHashAnnotation, originalHash)))
+					})
+				})
+
+				Context("And a child is updated", func() {
+					var originalHash string
+
+					BeforeEach(func() {
+						m.Eventually(instance, timeout).Should(utils.WithPodTemplateAnnotations(HaveKey(core.ConfigHashAnnotation)))
+						originalHash = controller.PodTemplate(instance).GetAnnotations()[core.ConfigHashAnnotation]
+					})
+
+					Context("A ConfigMap volume is updated", func() {
+						BeforeEach(func() {
+							m.Get(cm1, timeout).Should(Succeed())
+							cm1.Data["key1"] = "modified"
+							m.Update(cm1).Should(Succeed())
+
+							waitForInstanceReconciled(instance)
+
+							// Get the updated instance
+							m.Get(instance, timeout).Should(Succeed())
+						})
+
+						It("Updates the config hash in the Pod Template", func() {
+							m.Eventually(instance, timeout).ShouldNot(utils.WithAnnotations(HaveKeyWithValue(core.ConfigHashAnnotation, originalHash)))
+						})
+					})
+
+					Context("A ConfigMap EnvSource is updated", func() {
+						BeforeEach(func() {
+							m.Get(cm2, timeout).Should(Succeed())
+							cm2.Data["key1"] = "modified"
+							m.Update(cm2).Should(Succeed())
+
+							waitForInstanceReconciled(instance)
+
+							// Get the updated instance
+							m.Get(instance, timeout).Should(Succeed())
+						})
+
+						It("Updates the config hash in the Pod Template", func() {
+							m.Eventually(instance, timeout).ShouldNot(utils.WithAnnotations(HaveKeyWithValue(core.ConfigHashAnnotation, originalHash)))
+						})
+					})
+
+					Context("A Secret volume is updated", func() {
+						BeforeEach(func() {
+							m.Get(s1, timeout).Should(Succeed())
+							if s1.StringData == nil {
+								s1.StringData = make(map[string]string)
+							}
+							s1.StringData["key1"] = "modified"
+							m.Update(s1).Should(Succeed())
+
+							waitForInstanceReconciled(instance)
+
+							// Get the updated instance
+							m.Get(instance, timeout).Should(Succeed())
+						})
+
+						It("Updates the config hash in the Pod Template", func() {
+							m.Eventually(instance, timeout).ShouldNot(utils.WithAnnotations(HaveKeyWithValue(core.ConfigHashAnnotation, originalHash)))
+						})
+					})
+
+					Context("A Secret EnvSource is updated", func() {
+						BeforeEach(func() {
+							m.Get(s2, timeout).Should(Succeed())
+							if s2.StringData == nil {
+								s2.StringData = make(map[string]string)
+							}
+							s2.StringData["key1"] = "modified"
+							m.Update(s2).Should(Succeed())
+
+							waitForInstanceReconciled(instance)
+
+							// Get the updated instance
+							m.Get(instance, timeout).Should(Succeed())
+						})
+
+						It("Updates the config hash in the Pod Template", func() {
+							m.Eventually(instance, timeout).ShouldNot(utils.WithAnnotations(HaveKeyWithValue(core.ConfigHashAnnotation, originalHash)))
+						})
+					})
+				})
+
+				Context("And the annotation is removed", func() {
+					BeforeEach(func() {
+						m.Get(instance, timeout).Should(Succeed())
+						instance.SetAnnotations(make(map[string]string))
+						m.Update(instance).Should(Succeed())
+						waitForInstanceReconciled(instance)
+
+						m.Eventually(instance, timeout).ShouldNot(utils.WithAnnotations(HaveKey(core.RequiredAnnotation)))
+					})
+
+					It("Removes the OwnerReference from the all children", func() {
+						for _, obj := range []core.Object{cm1, cm2, s1, s2} {
+							m.Eventually(obj, timeout).ShouldNot(utils.WithOwnerReferences(ContainElement(ownerRef)))
+						}
+					})
+
+					It(fmt.Sprintf("Removes the %s's finalizer", controller.Kind), func() {
+						m.Eventually(instance, timeout).ShouldNot(utils.WithFinalizers(ContainElement(core.FinalizerString)))
+					})
+				})
+
+				Context("And is deleted", func() {
+					BeforeEach(func() {
+						// Make sure the cache has synced before we run the test
+						m.Eventually(instance, timeout).Should(utils.WithPodTemplateAnnotations(HaveKey(core.ConfigHashAnnotation)))
+						m.Delete(instance).Should(Succeed())
+						m.Eventually(instance, timeout).ShouldNot(utils.WithDeletionTimestamp(BeNil()))
+						waitForInstanceReconciled(instance)
+
+						// Get the updated instance
+						m.Get(instance, timeout).Should(Succeed())
+					})
+					It("Removes the OwnerReference from the all children", func() {
+						for _, obj := range []core.Object{cm1, cm2, s1, s2} {
+							m.Eventually(obj, timeout).ShouldNot(utils.WithOwnerReferences(ContainElement(ownerRef)))
+						}
+					})
+
+					It(fmt.Sprintf("Removes the %s's finalizer", controller.Kind), func() {
+						// Removing the finalizer causes the instance to be deleted
+						m.Get(instance, timeout).ShouldNot(Succeed())
+					})
+				})
+			})
+
+			Context("And it does not have the required annotation", func() {
+				BeforeEach(func() {
+					// Get the updated instance
+					m.Get(instance, timeout).Should(Succeed())
+				})
+
+				It("Doesn't add any OwnerReferences to any children", func() {
+					for _, obj := range []core.Object{cm1, cm2, s1, s2} {
+						m.Consistently(obj, consistentlyTimeout).ShouldNot(utils.WithOwnerReferences(ContainElement(ownerRef)))
+					}
+				})
+
+				It(fmt.Sprintf("Doesn't add a finalizer to the %s", controller.Kind), func() {
+					m.Consistently(instance, consistentlyTimeout).ShouldNot(utils.WithFinalizers(ContainElement(core.FinalizerString)))
+				})
+
+				It("Doesn't add a config hash to the Pod Template", func() {
+					m.Consistently(instance, consistentlyTimeout).ShouldNot(utils.WithAnnotations(ContainElement(core.ConfigHashAnnotation)))
+				})
+			})
+		})
+	})
+}
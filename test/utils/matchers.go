@@ -22,8 +22,10 @@ import (
 	"github.com/onsi/gomega"
 	gtypes "github.com/onsi/gomega/types"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -167,14 +169,27 @@ func WithOwnerReferences(matcher gtypes.GomegaMatcher) gtypes.GomegaMatcher {
 	}, matcher)
 }
 
-// WithPodTemplateAnnotations returns the deployments PodTemplate's annotations
+// WithPodTemplateAnnotations returns the PodTemplate's annotations
 func WithPodTemplateAnnotations(matcher gtypes.GomegaMatcher) gtypes.GomegaMatcher {
 	return gomega.WithTransform(func(obj Object) map[string]string {
-		dep, ok := obj.(*appsv1.Deployment)
-		if !ok {
+		switch o := obj.(type) {
+		case *appsv1.Deployment:
+			return o.Spec.Template.GetAnnotations()
+		case *appsv1.StatefulSet:
+			return o.Spec.Template.GetAnnotations()
+		case *appsv1.DaemonSet:
+			return o.Spec.Template.GetAnnotations()
+		case *batchv1beta1.CronJob:
+			return o.Spec.JobTemplate.Spec.Template.GetAnnotations()
+		case *unstructured.Unstructured:
+			annotations, _, err := unstructured.NestedStringMap(o.Object, "spec", "template", "metadata", "annotations")
+			if err != nil {
+				panic(err)
+			}
+			return annotations
+		default:
 			panic("Unknown Object.")
 		}
-		return dep.Spec.Template.GetAnnotations()
 	}, matcher)
 }
 
@@ -18,7 +18,9 @@ package utils
 
 import (
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
 // GetOwnerRef constructs an owner reference for the Deployment given
@@ -34,3 +36,60 @@ func GetOwnerRef(deployment *appsv1.Deployment) metav1.OwnerReference {
 		BlockOwnerDeletion: &t,
 	}
 }
+
+// GetStatefulSetOwnerRef constructs an owner reference for the StatefulSet given
+func GetStatefulSetOwnerRef(statefulset *appsv1.StatefulSet) metav1.OwnerReference {
+	f := false
+	t := true
+	return metav1.OwnerReference{
+		APIVersion:         "apps/v1",
+		Kind:               "StatefulSet",
+		Name:               statefulset.Name,
+		UID:                statefulset.UID,
+		Controller:         &f,
+		BlockOwnerDeletion: &t,
+	}
+}
+
+// GetDaemonSetOwnerRef constructs an owner reference for the DaemonSet given
+func GetDaemonSetOwnerRef(daemonset *appsv1.DaemonSet) metav1.OwnerReference {
+	f := false
+	t := true
+	return metav1.OwnerReference{
+		APIVersion:         "apps/v1",
+		Kind:               "DaemonSet",
+		Name:               daemonset.Name,
+		UID:                daemonset.UID,
+		Controller:         &f,
+		BlockOwnerDeletion: &t,
+	}
+}
+
+// GetCronJobOwnerRef constructs an owner reference for the CronJob given
+func GetCronJobOwnerRef(cronjob *batchv1beta1.CronJob) metav1.OwnerReference {
+	f := false
+	t := true
+	return metav1.OwnerReference{
+		APIVersion:         "batch/v1beta1",
+		Kind:               "CronJob",
+		Name:               cronjob.Name,
+		UID:                cronjob.UID,
+		Controller:         &f,
+		BlockOwnerDeletion: &t,
+	}
+}
+
+// GetWorkloadOwnerRef constructs an owner reference for the custom resource
+// given
+func GetWorkloadOwnerRef(workload *unstructured.Unstructured) metav1.OwnerReference {
+	f := false
+	t := true
+	return metav1.OwnerReference{
+		APIVersion:         workload.GetAPIVersion(),
+		Kind:               workload.GetKind(),
+		Name:               workload.GetName(),
+		UID:                workload.GetUID(),
+		Controller:         &f,
+		BlockOwnerDeletion: &t,
+	}
+}
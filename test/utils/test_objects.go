@@ -18,8 +18,12 @@ package utils
 
 import (
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 var labels = map[string]string{
@@ -240,6 +244,86 @@ var ExampleDeployment = &appsv1.Deployment{
 	},
 }
 
+// ExampleStatefulSet is an example StatefulSet object for use within test suites
+var ExampleStatefulSet = &appsv1.StatefulSet{
+	ObjectMeta: metav1.ObjectMeta{
+		Name:      "example",
+		Namespace: "default",
+		Labels:    labels,
+	},
+	Spec: appsv1.StatefulSetSpec{
+		ServiceName: "example",
+		Selector: &metav1.LabelSelector{
+			MatchLabels: labels,
+		},
+		Template: *ExampleDeployment.Spec.Template.DeepCopy(),
+	},
+}
+
+// ExampleDaemonSet is an example DaemonSet object for use within test suites
+var ExampleDaemonSet = &appsv1.DaemonSet{
+	ObjectMeta: metav1.ObjectMeta{
+		Name:      "example",
+		Namespace: "default",
+		Labels:    labels,
+	},
+	Spec: appsv1.DaemonSetSpec{
+		Selector: &metav1.LabelSelector{
+			MatchLabels: labels,
+		},
+		Template: *ExampleDeployment.Spec.Template.DeepCopy(),
+	},
+}
+
+// ExampleCronJob is an example CronJob object for use within test suites
+var ExampleCronJob = &batchv1beta1.CronJob{
+	ObjectMeta: metav1.ObjectMeta{
+		Name:      "example",
+		Namespace: "default",
+		Labels:    labels,
+	},
+	Spec: batchv1beta1.CronJobSpec{
+		Schedule: "*/5 * * * *",
+		JobTemplate: batchv1beta1.JobTemplateSpec{
+			Spec: batchv1.JobSpec{
+				Template: examplePodTemplate(corev1.RestartPolicyNever),
+			},
+		},
+	},
+}
+
+// examplePodTemplate returns a copy of the ExampleDeployment's PodTemplate
+// with the given RestartPolicy
+func examplePodTemplate(restartPolicy corev1.RestartPolicy) corev1.PodTemplateSpec {
+	template := ExampleDeployment.Spec.Template.DeepCopy()
+	template.Spec.RestartPolicy = restartPolicy
+	return *template
+}
+
+// ExampleWorkload is an example custom resource which embeds the
+// ExampleDeployment's PodTemplate at spec.template, for use within test suites
+var ExampleWorkload = newExampleWorkload()
+
+// newExampleWorkload constructs the ExampleWorkload
+func newExampleWorkload() *unstructured.Unstructured {
+	template, err := runtime.DefaultUnstructuredConverter.ToUnstructured(ExampleDeployment.Spec.Template.DeepCopy())
+	if err != nil {
+		panic(err)
+	}
+
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("test.wave.pusher.com/v1alpha1")
+	obj.SetKind("Example")
+	obj.SetName("example")
+	obj.SetNamespace("default")
+	obj.SetLabels(labels)
+	err = unstructured.SetNestedField(obj.Object, template, "spec", "template")
+	if err != nil {
+		panic(err)
+	}
+	return obj
+}
+
 // ExampleConfigMap1 is an example ConfigMap object for use within test suites
 var ExampleConfigMap1 = &corev1.ConfigMap{
 	ObjectMeta: metav1.ObjectMeta{